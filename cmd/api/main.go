@@ -12,8 +12,10 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
@@ -23,11 +25,88 @@ func main() {
 	}
 }
 
+const usage = `Usage: %s [flags] [command]
+
+Commands:
+  (none)       run the labeler and feed server
+  publish      publish labeler to user profile (same as -publish)
+  dump-labels  print label definitions of upstream labelers and how we map them
+  rotate-key   replace the label signing key and publish the new one (-revert to restore the previous one)
+  export-key <file>
+               move the label signing key from the database to a key file
+  reports      list queued reports from non-moderators, escalated ones first
+  moderators   list moderators and their roles
+  add-moderator <handle or did> [admin|moderator|reviewer]
+               add a moderator (as moderator by default) or change their role
+  remove-moderator <handle or did>
+               remove a moderator
+  export-actions
+               print the audit trail of moderation actions as CSV
+  import-blocklist <file>
+               merge users in a CSV file into the external block list, skipping duplicates
+
+Flags:
+`
+
 func mainInner() int {
 	debug := flag.Bool("debug", false, "enable debug logging")
 	publish := flag.Bool("publish", false, "publish labeler to user profile")
+	revert := flag.Bool("revert", false, "with rotate-key, restore the previous signing key")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	command := flag.Arg(0)
+	if *publish {
+		command = "publish"
+	}
+	var run func() error
+	switch command {
+	case "":
+		run = runServer
+	case "publish":
+		run = publishLabeler
+	case "dump-labels":
+		run = dumpLabels
+	case "rotate-key":
+		run = func() error { return rotateKey(*revert) }
+	case "export-key":
+		if flag.Arg(1) == "" {
+			flag.Usage()
+			return 2
+		}
+		run = func() error { return exportKey(flag.Arg(1)) }
+	case "reports":
+		run = listReports
+	case "moderators":
+		run = listModerators
+	case "export-actions":
+		run = exportActions
+	case "import-blocklist":
+		if flag.Arg(1) == "" {
+			flag.Usage()
+			return 2
+		}
+		run = func() error { return importBlockList(flag.Arg(1)) }
+	case "add-moderator", "remove-moderator":
+		if flag.Arg(1) == "" {
+			flag.Usage()
+			return 2
+		}
+		role := flag.Arg(2)
+		if command == "remove-moderator" {
+			role = ""
+		} else if role == "" {
+			role = "moderator"
+		}
+		run = func() error { return setModerator(flag.Arg(1), role) }
+	default:
+		flag.Usage()
+		return 2
+	}
+
 	var level slog.Level
 	if *debug {
 		level = slog.LevelDebug
@@ -39,13 +118,7 @@ func mainInner() int {
 	}
 	defer closeGlobals()
 
-	var err error
-	if *publish {
-		err = publishLabeler()
-	} else {
-		err = runServer()
-	}
-	if err != nil {
+	if err := run(); err != nil {
 		return 1
 	}
 
@@ -99,7 +172,7 @@ func publishLabeler() error {
 		return err
 	}
 
-	if err := at_utils.PublishLabelInfo(background); err != nil {
+	if err := at_utils.PublishLabelInfo(background, listener.EmittedLabelValues()); err != nil {
 		logger.Error("failed to publish label", "err", err)
 		return err
 	}
@@ -112,6 +185,134 @@ func publishLabeler() error {
 	return nil
 }
 
+func dumpLabels() error {
+	if err := listener.DumpLabelMappings(background, os.Stdout); err != nil {
+		logger.Error("failed to dump label mappings", "err", err)
+		return err
+	}
+	return nil
+}
+
+func rotateKey(revert bool) error {
+	if err := at_utils.RotateKey(background, revert); err != nil {
+		logger.Error("failed to rotate key", "err", err)
+		return err
+	}
+	return nil
+}
+
+func exportKey(path string) error {
+	if err := at_utils.ExportKey(path); err != nil {
+		logger.Error("failed to export key", "err", err)
+		return err
+	}
+	return nil
+}
+
+func listReports() error {
+	reports, err := database.Instance().GetOpenReports(1000)
+	if err != nil {
+		logger.Error("failed to list reports", "err", err)
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tTIME\tSUBJECT\tREPORTER\tTYPE\tREASON")
+	for _, r := range reports {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%q\n",
+			r.Id, r.Status, time.UnixMilli(r.Cts).UTC().Format(time.RFC3339),
+			r.Subject, r.ReporterDid, strings.TrimPrefix(r.ReasonType, "com.atproto.moderation.defs#"), r.Reason,
+		)
+	}
+	return tw.Flush()
+}
+
+func listModerators() error {
+	moderators, err := database.Instance().GetModerators()
+	if err != nil {
+		logger.Error("failed to list moderators", "err", err)
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DID\tHANDLE\tROLE\tADDED")
+	for _, m := range moderators {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+			m.Did, at_utils.DisplayHandle(background, m.Did), m.Role,
+			time.UnixMilli(m.Cts).UTC().Format(time.RFC3339),
+		)
+	}
+	return tw.Flush()
+}
+
+// setModerator adds a moderator or changes their role, or removes them if role is empty
+func setModerator(id string, role string) error {
+	ident, err := at_utils.LookupIdentifier(background, id)
+	if err != nil {
+		logger.Error("failed to resolve moderator", "id", id, "err", err)
+		return err
+	}
+	db := database.Instance()
+	uid, err := db.GetUserId(ident.DID.String())
+	if err != nil {
+		logger.Error("failed to get user id", "err", err)
+		return err
+	}
+	if role == "" {
+		removed, err := db.RemoveModerator(uid)
+		if err != nil {
+			logger.Error("failed to remove moderator", "err", err)
+			return err
+		}
+		if !removed {
+			logger.Warn("not a moderator", "did", ident.DID.String())
+			return nil
+		}
+		return recordCliAction("remove-moderator", ident.DID.String(), "")
+	}
+	parsed, err := database.ParseModeratorRole(role)
+	if err != nil {
+		logger.Error("invalid role", "err", err)
+		return err
+	}
+	if err := db.SetModerator(uid, parsed); err != nil {
+		logger.Error("failed to set moderator", "err", err)
+		return err
+	}
+	logger.Info("moderator set", "did", ident.DID.String(), "handle", ident.Handle.String(), "role", parsed.String())
+	return recordCliAction("set-moderator", ident.DID.String(), parsed.String())
+}
+
+func recordCliAction(action, subject, reason string) error {
+	err := database.Instance().RecordAction(&database.ModerationAction{
+		Actor:   server.ActorCli,
+		Action:  action,
+		Subject: subject,
+		Reason:  reason,
+		Outcome: "ok",
+	})
+	if err != nil {
+		logger.Error("failed to record moderation action", "err", err)
+	}
+	return err
+}
+
+func exportActions() error {
+	if err := server.ExportActions(database.Instance(), os.Stdout, "", ""); err != nil {
+		logger.Error("failed to export moderation actions", "err", err)
+		return err
+	}
+	return nil
+}
+
+func importBlockList(path string) error {
+	added, err := listener.ImportBlockList(config.ExternalBlockList, path)
+	if err != nil {
+		logger.Error("failed to import block list", "err", err)
+		return err
+	}
+	logger.Info("block list imported", "new", added)
+	return nil
+}
+
 type Runnable interface {
 	Run(ctx context.Context) chan bool
 }
@@ -129,15 +330,42 @@ func runServer() error {
 		return err
 	}
 
-	jetstream, err := listener.NewJetStreamListener(subscription, blockList, logger)
+	modLists, err := listener.NewModListsInSync(config.BlockModLists, logger.WithGroup("modlist"))
+	if err != nil {
+		logger.Error("failed to create moderation lists", "err", err)
+		return err
+	}
+
+	curators, err := listener.NewCuratorBlocksInSync(
+		startupCtx, config.TrustedCurators, config.CuratorBlockThreshold, logger.WithGroup("curators"),
+	)
+	if err != nil {
+		logger.Error("failed to create curator blocks", "err", err)
+		return err
+	}
+
+	graph, err := listener.NewFollowGraph(logger.WithGroup("graph"))
+	if err != nil {
+		logger.Error("failed to create follow graph", "err", err)
+		return err
+	}
+
+	jetstream, err := listener.NewJetStreamListener(subscription, blockList, modLists, curators, graph, logger)
 	if err != nil {
 		logger.Error("failed to create jetstream listener", "err", err)
 		return err
 	}
 
+	exporter := listener.NewListExporter(blockList, logger.WithGroup("export"))
+
+	if err := server.SeedModerators(startupCtx, logger); err != nil {
+		logger.Error("failed to seed moderators", "err", err)
+		return err
+	}
+
 	server := server.New(subscription, jetstream, logger)
 
-	done := start(background, subscription, blockList, jetstream, server)
+	done := start(background, subscription, blockList, modLists, curators, jetstream, graph, exporter, server)
 	<-done
 
 	return nil
@@ -2,11 +2,13 @@ package at_utils
 
 import (
 	"bluesky-oneshot-labeler/internal/config"
-	"bluesky-oneshot-labeler/internal/database"
 	"context"
-	"encoding/base64"
+	"errors"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/atproto/crypto"
@@ -50,6 +52,28 @@ func DefaultDirectory() identity.Directory {
 	return dir
 }
 
+// LookupIdentifier resolves either a handle or a DID
+func LookupIdentifier(ctx context.Context, s string) (*identity.Identity, error) {
+	id, err := syntax.ParseAtIdentifier(strings.TrimPrefix(s, "@"))
+	if err != nil {
+		return nil, err
+	}
+	return IdentityDirectory.Lookup(ctx, *id)
+}
+
+// DisplayHandle returns the handle of a user for display, falling back to the DID
+func DisplayHandle(ctx context.Context, did string) string {
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return did
+	}
+	ident, err := IdentityDirectory.LookupDID(ctx, parsed)
+	if err != nil || ident.Handle == syntax.HandleInvalid {
+		return did
+	}
+	return ident.Handle.String()
+}
+
 func IsRegularFile(path string) bool {
 	if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
 		return true
@@ -92,35 +116,21 @@ func InitXrpcClient(ctx context.Context) error {
 	return nil
 }
 
-func InitKeys() error {
-	db := database.Instance()
-	keyStr, err := db.GetConfig("server-key", "")
-	if err != nil {
-		return err
-	}
-	if keyStr == "" {
-		key, err := crypto.GeneratePrivateKeyP256()
-		if err != nil {
-			return err
-		}
-		keyStr = base64.StdEncoding.EncodeToString(key.Bytes())
-		err = db.SetConfig("server-key", keyStr)
-		if err != nil {
-			return err
-		}
-	}
-
-	keyBytes, err := base64.StdEncoding.DecodeString(keyStr)
-	if err != nil {
-		return err
-	}
-
-	key, err := crypto.ParsePrivateBytesP256(keyBytes)
+// RefreshedClient returns a copy of an authenticated client with fresh tokens,
+// for long-running jobs that outlive the access token
+func RefreshedClient(ctx context.Context, client *xrpc.Client) (*xrpc.Client, error) {
+	refreshed := *client
+	auth := *client.Auth
+	// refreshSession takes the refresh token in place of the access token
+	auth.AccessJwt = auth.RefreshJwt
+	refreshed.Auth = &auth
+	resp, err := atproto.ServerRefreshSession(ctx, &refreshed)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	KeyP256 = key
-	return nil
+	auth.AccessJwt = resp.AccessJwt
+	auth.RefreshJwt = resp.RefreshJwt
+	return &refreshed, nil
 }
 
 func SignLabel(label *labels.UnsignedLabel) (*atproto.LabelDefs_Label, error) {
@@ -145,3 +155,64 @@ func SignLabel(label *labels.UnsignedLabel) (*atproto.LabelDefs_Label, error) {
 		Ver: label.Ver,
 	}, nil
 }
+
+var ErrUnsignedLabel = errors.New("label is not signed")
+
+// Refetching DID documents is throttled per DID so that a flood of
+// bad signatures does not turn into a flood of PLC requests.
+var keyRefetchTimes sync.Map
+
+const keyRefetchInterval = time.Minute
+
+// VerifyLabel checks the signature of a label against the atproto_label key of its source.
+//
+// If the verification fails, the DID document is refetched in case the key has been rotated.
+func VerifyLabel(ctx context.Context, label *atproto.LabelDefs_Label) error {
+	if len(label.Sig) == 0 {
+		return ErrUnsignedLabel
+	}
+	did, err := syntax.ParseDID(label.Src)
+	if err != nil {
+		return err
+	}
+	unsigned := labels.UnsignedLabel{
+		Cid: label.Cid,
+		Cts: label.Cts,
+		Exp: label.Exp,
+		Neg: label.Neg,
+		Src: label.Src,
+		Uri: label.Uri,
+		Val: label.Val,
+		Ver: label.Ver,
+	}
+	bytes, err := unsigned.BytesForSigning()
+	if err != nil {
+		return err
+	}
+
+	err = verifyWithLabelerKey(ctx, did, bytes, label.Sig)
+	if err == nil {
+		return nil
+	}
+	now := time.Now()
+	if last, ok := keyRefetchTimes.Load(did); ok && now.Sub(last.(time.Time)) < keyRefetchInterval {
+		return err
+	}
+	keyRefetchTimes.Store(did, now)
+	if err := IdentityDirectory.Purge(ctx, did.AtIdentifier()); err != nil {
+		return err
+	}
+	return verifyWithLabelerKey(ctx, did, bytes, label.Sig)
+}
+
+func verifyWithLabelerKey(ctx context.Context, did syntax.DID, content []byte, sig []byte) error {
+	ident, err := IdentityDirectory.LookupDID(ctx, did)
+	if err != nil {
+		return err
+	}
+	key, err := ident.GetPublicKey("atproto_label")
+	if err != nil {
+		return err
+	}
+	return key.HashAndVerifyLenient(content, sig)
+}
@@ -0,0 +1,165 @@
+package at_utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/util/labels"
+)
+
+// rotatingDirectory serves the stale identity until it is purged, and then the current one
+type rotatingDirectory struct {
+	stale, current *identity.Identity
+	purged         bool
+	purges         int
+}
+
+func (d *rotatingDirectory) LookupHandle(ctx context.Context, h syntax.Handle) (*identity.Identity, error) {
+	return nil, identity.ErrHandleNotFound
+}
+
+func (d *rotatingDirectory) LookupDID(ctx context.Context, did syntax.DID) (*identity.Identity, error) {
+	if d.purged {
+		return d.current, nil
+	}
+	return d.stale, nil
+}
+
+func (d *rotatingDirectory) Lookup(ctx context.Context, i syntax.AtIdentifier) (*identity.Identity, error) {
+	did, err := i.AsDID()
+	if err != nil {
+		return nil, err
+	}
+	return d.LookupDID(ctx, did)
+}
+
+func (d *rotatingDirectory) Purge(ctx context.Context, i syntax.AtIdentifier) error {
+	d.purged = true
+	d.purges++
+	return nil
+}
+
+func labelerIdentity(t *testing.T, did syntax.DID, key *crypto.PrivateKeyP256) *identity.Identity {
+	t.Helper()
+	pub, err := key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &identity.Identity{
+		DID: did,
+		Keys: map[string]identity.Key{
+			"atproto_label": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()},
+		},
+	}
+}
+
+func newP256Key(t *testing.T) *crypto.PrivateKeyP256 {
+	t.Helper()
+	key, err := crypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signLabel signs a label of the labeler with the key, which becomes KeyP256
+func signLabel(t *testing.T, did syntax.DID, key *crypto.PrivateKeyP256) *atproto.LabelDefs_Label {
+	t.Helper()
+	KeyP256 = key
+	label, err := SignLabel(&labels.UnsignedLabel{
+		Src: did.String(),
+		Uri: "did:plc:offender",
+		Val: "spam",
+		Cts: "2024-01-01T00:00:00Z",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return label
+}
+
+func TestVerifyLabel(t *testing.T) {
+	previousDirectory, previousKey := IdentityDirectory, KeyP256
+	t.Cleanup(func() {
+		IdentityDirectory, KeyP256 = previousDirectory, previousKey
+		keyRefetchTimes.Clear()
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		did := syntax.DID("did:plc:valid")
+		key := newP256Key(t)
+		directory := &rotatingDirectory{stale: labelerIdentity(t, did, key)}
+		IdentityDirectory = directory
+		label := signLabel(t, did, key)
+		if err := VerifyLabel(context.Background(), label); err != nil {
+			t.Errorf("VerifyLabel failed: %v", err)
+		}
+		if directory.purges != 0 {
+			t.Errorf("purged the identity of a valid label")
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		did := syntax.DID("did:plc:unsigned")
+		label := signLabel(t, did, newP256Key(t))
+		label.Sig = nil
+		if err := VerifyLabel(context.Background(), label); !errors.Is(err, ErrUnsignedLabel) {
+			t.Errorf("got %v, expected ErrUnsignedLabel", err)
+		}
+	})
+
+	t.Run("rotated key", func(t *testing.T) {
+		did := syntax.DID("did:plc:rotated")
+		old, rotated := newP256Key(t), newP256Key(t)
+		directory := &rotatingDirectory{
+			stale:   labelerIdentity(t, did, old),
+			current: labelerIdentity(t, did, rotated),
+		}
+		IdentityDirectory = directory
+		label := signLabel(t, did, rotated)
+		if err := VerifyLabel(context.Background(), label); err != nil {
+			t.Errorf("VerifyLabel failed after refetching: %v", err)
+		}
+		if directory.purges != 1 {
+			t.Errorf("purged %d times, expected once", directory.purges)
+		}
+	})
+
+	t.Run("bad signature is refetched once", func(t *testing.T) {
+		did := syntax.DID("did:plc:forged")
+		key := newP256Key(t)
+		directory := &rotatingDirectory{
+			stale:   labelerIdentity(t, did, key),
+			current: labelerIdentity(t, did, key),
+		}
+		IdentityDirectory = directory
+		label := signLabel(t, did, newP256Key(t))
+		for range 3 {
+			if err := VerifyLabel(context.Background(), label); err == nil {
+				t.Fatal("VerifyLabel accepted a forged label")
+			}
+		}
+		if directory.purges != 1 {
+			t.Errorf("purged %d times, expected once within the refetch interval", directory.purges)
+		}
+	})
+
+	t.Run("tampered label", func(t *testing.T) {
+		did := syntax.DID("did:plc:tampered")
+		key := newP256Key(t)
+		IdentityDirectory = &rotatingDirectory{
+			stale:   labelerIdentity(t, did, key),
+			current: labelerIdentity(t, did, key),
+		}
+		label := signLabel(t, did, key)
+		label.Val = "other"
+		if err := VerifyLabel(context.Background(), label); err == nil {
+			t.Error("VerifyLabel accepted a tampered label")
+		}
+	})
+}
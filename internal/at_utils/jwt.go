@@ -76,7 +76,9 @@ func (k keyProvider) FetchKeys(
 	return nil
 }
 
-func VerifyJwtToken(ctx context.Context, token string) (*identity.Identity, error) {
+// VerifyJwtToken verifies a service auth token addressed to us for the XRPC method (the lxm claim),
+// returning the issuer
+func VerifyJwtToken(ctx context.Context, token string, method string) (*identity.Identity, error) {
 	jwtToken, err := jwt.ParseString(
 		token,
 		jwt.WithKeyProvider(keyProvider{}),
@@ -88,6 +90,9 @@ func VerifyJwtToken(ctx context.Context, token string) (*identity.Identity, erro
 	if !slices.Contains(jwtToken.Audience(), UserDid.String()) {
 		return nil, fmt.Errorf("invalid audience")
 	}
+	if lxm, _ := jwtToken.PrivateClaims()["lxm"].(string); lxm != method {
+		return nil, fmt.Errorf("token is not for %s", method)
+	}
 
 	reporter, err := syntax.ParseDID(jwtToken.Issuer())
 	if err != nil {
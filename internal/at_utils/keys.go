@@ -0,0 +1,373 @@
+package at_utils
+
+import (
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/database"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+)
+
+const (
+	serverKeyConfig         = "server-key"
+	previousServerKeyConfig = "server-key-previous"
+	pendingServerKeyConfig  = "server-key-pending"
+	keyRotatedAtConfig      = "server-key-rotated-at"
+)
+
+var serverKeyConfigs = []string{
+	serverKeyConfig,
+	previousServerKeyConfig,
+	pendingServerKeyConfig,
+	keyRotatedAtConfig,
+}
+
+// PreviousKeyP256 is the signing key before the last rotation,
+// kept during the transition window so that the rotation can be reverted
+var PreviousKeyP256 *crypto.PrivateKeyP256
+
+// keyStore holds the signing key, along with the keys and states of key rotation,
+// under the names of serverKeyConfigs. Empty values mean absence.
+type keyStore interface {
+	Load(name string) (string, error)
+	Store(values map[string]string) error
+}
+
+// dbKeyStore keeps the keys in the config table, which is the default
+type dbKeyStore struct {
+	db *database.Service
+}
+
+func (s dbKeyStore) Load(name string) (string, error) {
+	return s.db.GetConfig(name, "")
+}
+
+func (s dbKeyStore) Store(values map[string]string) error {
+	return s.db.SetConfigs(values)
+}
+
+// fileKeyStore keeps the signing key in a file (SIGNING_KEY_FILE),
+// and the rest in files next to it, e.g. "<file>.server-key-previous".
+type fileKeyStore struct {
+	path string
+}
+
+func (s fileKeyStore) pathOf(name string) string {
+	if name == serverKeyConfig {
+		return s.path
+	}
+	return s.path + "." + name
+}
+
+func (s fileKeyStore) Load(name string) (string, error) {
+	path := s.pathOf(name)
+	stat, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if stat.Mode().Perm()&0o077 != 0 {
+		return "", fmt.Errorf("key file %s must not be accessible by others (chmod 600 %s)", path, path)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func (s fileKeyStore) Store(values map[string]string) error {
+	for name, value := range values {
+		path := s.pathOf(name)
+		if value == "" {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if err := writeFileAtomically(path, []byte(value+"\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFileAtomically(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// envKeyStore reads the signing key from SIGNING_KEY and cannot be written to
+type envKeyStore struct{}
+
+func (envKeyStore) Load(name string) (string, error) {
+	if name == serverKeyConfig {
+		return strings.TrimSpace(config.SigningKey), nil
+	}
+	return "", nil
+}
+
+func (envKeyStore) Store(values map[string]string) error {
+	return fmt.Errorf("the signing key is read from SIGNING_KEY and cannot be updated, use SIGNING_KEY_FILE instead")
+}
+
+func currentKeyStore() keyStore {
+	if config.SigningKey != "" {
+		return envKeyStore{}
+	}
+	if config.SigningKeyFile != "" {
+		return fileKeyStore{path: config.SigningKeyFile}
+	}
+	return dbKeyStore{db: database.Instance()}
+}
+
+// encodeKey encodes the key in the format of the key store
+func encodeKey(store keyStore, key *crypto.PrivateKeyP256) string {
+	if _, ok := store.(dbKeyStore); ok {
+		return base64.StdEncoding.EncodeToString(key.Bytes())
+	}
+	return key.Multibase()
+}
+
+// decodeKey parses a P-256 private key in PEM (SEC 1 or PKCS #8), multibase or base64
+func decodeKey(keyStr string) (*crypto.PrivateKeyP256, error) {
+	if block, _ := pem.Decode([]byte(keyStr)); block != nil {
+		return decodePemKey(block)
+	}
+	if strings.HasPrefix(keyStr, "z") {
+		key, err := crypto.ParsePrivateMultibase(keyStr)
+		if err == nil {
+			p256, ok := key.(*crypto.PrivateKeyP256)
+			if !ok {
+				return nil, fmt.Errorf("signing key must be a P-256 key, got %T", key)
+			}
+			return p256, nil
+		}
+	}
+	keyBytes, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil {
+		return nil, fmt.Errorf("signing key is neither PEM, multibase nor base64")
+	}
+	return crypto.ParsePrivateBytesP256(keyBytes)
+}
+
+func decodePemKey(block *pem.Block) (*crypto.PrivateKeyP256, error) {
+	var ecKey *ecdsa.PrivateKey
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ecKey = key
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if ecKey, ok = key.(*ecdsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("signing key must be an ECDSA key, got %T", key)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block: %s", block.Type)
+	}
+	if ecKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("signing key must be a P-256 key, got %s", ecKey.Curve.Params().Name)
+	}
+	return crypto.ParsePrivateBytesP256(ecKey.D.FillBytes(make([]byte, 32)))
+}
+
+func InitKeys() error {
+	store := currentKeyStore()
+	keyStr, err := store.Load(serverKeyConfig)
+	if err != nil {
+		return err
+	}
+	if keyStr == "" {
+		if _, ok := store.(dbKeyStore); !ok {
+			if stale, err := database.Instance().GetConfig(serverKeyConfig, ""); err != nil || stale != "" {
+				return fmt.Errorf("the signing key is still stored in the database, run export-key to move it")
+			}
+		}
+		key, err := crypto.GeneratePrivateKeyP256()
+		if err != nil {
+			return err
+		}
+		keyStr = encodeKey(store, key)
+		err = store.Store(map[string]string{serverKeyConfig: keyStr})
+		if err != nil {
+			return err
+		}
+	}
+
+	key, err := decodeKey(keyStr)
+	if err != nil {
+		return err
+	}
+	KeyP256 = key
+
+	if _, ok := store.(dbKeyStore); !ok {
+		if stale, err := database.Instance().GetConfig(serverKeyConfig, ""); err == nil && stale != "" {
+			slog.Warn("a signing key is still stored in the database, run export-key to scrub it")
+		}
+	}
+	return loadPreviousKey(store)
+}
+
+func loadPreviousKey(store keyStore) error {
+	keyStr, err := store.Load(previousServerKeyConfig)
+	if err != nil || keyStr == "" {
+		return err
+	}
+	rotatedAtStr, err := store.Load(keyRotatedAtConfig)
+	if err != nil {
+		return err
+	}
+	rotatedAt, _ := strconv.ParseInt(rotatedAtStr, 10, 64)
+	if time.Since(time.UnixMilli(rotatedAt)) > config.KeyTransitionWindow {
+		slog.Info("transition window of the previous signing key is over, dropping the key")
+		return store.Store(map[string]string{previousServerKeyConfig: ""})
+	}
+	key, err := decodeKey(keyStr)
+	if err != nil {
+		return err
+	}
+	PreviousKeyP256 = key
+	return nil
+}
+
+// RotateKey replaces the signing key with a new one, or with the previous one if revert is set,
+// and publishes it as the atproto_label verification method of the labeler.
+//
+// The replaced key is kept for KEY_TRANSITION_WINDOW. Labels in the label log get re-signed
+// by the server the next time it starts.
+func RotateKey(ctx context.Context, revert bool) error {
+	store := currentKeyStore()
+	if _, ok := store.(envKeyStore); ok {
+		return store.Store(nil)
+	}
+	var key *crypto.PrivateKeyP256
+	if revert {
+		if PreviousKeyP256 == nil {
+			return fmt.Errorf("no previous signing key to revert to")
+		}
+		key = PreviousKeyP256
+	} else {
+		// A pending key is left behind if we failed after updating the DID document,
+		// in which case it might already be published.
+		keyStr, err := store.Load(pendingServerKeyConfig)
+		if err != nil {
+			return err
+		}
+		if keyStr == "" {
+			key, err = crypto.GeneratePrivateKeyP256()
+			if err != nil {
+				return err
+			}
+			if err := store.Store(map[string]string{pendingServerKeyConfig: encodeKey(store, key)}); err != nil {
+				return err
+			}
+		} else if key, err = decodeKey(keyStr); err != nil {
+			return err
+		}
+	}
+
+	pubKey, err := key.PublicKey()
+	if err != nil {
+		return err
+	}
+	err = updatePlcIdentity(ctx, func(services, verificationMethods map[string]any) {
+		verificationMethods["atproto_label"] = pubKey.DIDKey()
+		labelerServices(services)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = store.Store(map[string]string{
+		serverKeyConfig:         encodeKey(store, key),
+		previousServerKeyConfig: encodeKey(store, KeyP256),
+		pendingServerKeyConfig:  "",
+		keyRotatedAtConfig:      strconv.FormatInt(time.Now().UnixMilli(), 10),
+	})
+	if err != nil {
+		return err
+	}
+	PreviousKeyP256, KeyP256 = KeyP256, key
+	slog.Info("signing key rotated, restart the server to re-sign published labels", "key", pubKey.DIDKey())
+	return nil
+}
+
+// ExportKey moves the keys stored in the database to a key file,
+// and scrubs them from the database
+func ExportKey(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("key file %s already exists", path)
+	}
+	db := database.Instance()
+	src := dbKeyStore{db: db}
+	dst := fileKeyStore{path: path}
+	values := make(map[string]string, len(serverKeyConfigs))
+	for _, name := range serverKeyConfigs {
+		value, err := src.Load(name)
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			continue
+		}
+		if name != keyRotatedAtConfig {
+			key, err := decodeKey(value)
+			if err != nil {
+				return err
+			}
+			value = encodeKey(dst, key)
+		}
+		values[name] = value
+	}
+	if values[serverKeyConfig] == "" {
+		return fmt.Errorf("no signing key is stored in the database")
+	}
+	if err := dst.Store(values); err != nil {
+		return err
+	}
+	if err := db.ScrubConfig(serverKeyConfigs...); err != nil {
+		return err
+	}
+	slog.Info("signing key exported, set SIGNING_KEY_FILE to use it", "path", path)
+	return nil
+}
@@ -0,0 +1,282 @@
+package at_utils
+
+import (
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/database"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+func TestDecodeKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.ParsePrivateBytesP256(ecKey.D.FillBytes(make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := x509.MarshalECPrivateKey(p384Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k256, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodePem := func(kind string, der []byte) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}))
+	}
+
+	valid := map[string]string{
+		"multibase":     key.Multibase(),
+		"base64":        base64.StdEncoding.EncodeToString(key.Bytes()),
+		"SEC 1 PEM":     encodePem("EC PRIVATE KEY", sec1),
+		"PKCS #8 PEM":   encodePem("PRIVATE KEY", pkcs8),
+		"PEM with text": "generated for the labeler\n" + encodePem("EC PRIVATE KEY", sec1),
+	}
+	for name, keyStr := range valid {
+		t.Run(name, func(t *testing.T) {
+			decoded, err := decodeKey(keyStr)
+			if err != nil {
+				t.Fatalf("failed to decode key: %v", err)
+			}
+			if !bytes.Equal(decoded.Bytes(), key.Bytes()) {
+				t.Error("decoded a different key")
+			}
+		})
+	}
+
+	invalid := map[string]string{
+		"garbage":          "not a key",
+		"P-384 PEM":        encodePem("EC PRIVATE KEY", p384),
+		"Ed25519 PEM":      encodePem("PRIVATE KEY", ed),
+		"public key PEM":   encodePem("PUBLIC KEY", sec1),
+		"corrupted PEM":    encodePem("EC PRIVATE KEY", sec1[:len(sec1)/2]),
+		"K-256 multibase":  k256.Multibase(),
+		"short base64 key": base64.StdEncoding.EncodeToString(key.Bytes()[:16]),
+	}
+	for name, keyStr := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := decodeKey(keyStr); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestFileKeyStore(t *testing.T) {
+	dir := t.TempDir()
+	store := fileKeyStore{path: filepath.Join(dir, "signing.key")}
+
+	value, err := store.Load(serverKeyConfig)
+	if err != nil || value != "" {
+		t.Fatalf("got %q, %v from a missing key file", value, err)
+	}
+
+	// a world-readable file left behind is replaced rather than kept accessible
+	if err := os.WriteFile(store.pathOf(previousServerKeyConfig), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = store.Store(map[string]string{
+		serverKeyConfig:         "zcurrent",
+		previousServerKeyConfig: "zprevious",
+	})
+	if err != nil {
+		t.Fatalf("failed to store keys: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d files, expected no temporary files left", len(entries))
+	}
+	for name, expected := range map[string]string{serverKeyConfig: "zcurrent", previousServerKeyConfig: "zprevious"} {
+		stat, err := os.Stat(store.pathOf(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode().Perm() != 0o600 {
+			t.Errorf("%s has mode %v, expected 0600", name, stat.Mode().Perm())
+		}
+		value, err := store.Load(name)
+		if err != nil || value != expected {
+			t.Errorf("loaded %q, %v for %s, expected %q", value, err, name, expected)
+		}
+	}
+
+	if err := store.Store(map[string]string{previousServerKeyConfig: ""}); err != nil {
+		t.Fatalf("failed to drop key: %v", err)
+	}
+	if _, err := os.Stat(store.pathOf(previousServerKeyConfig)); !os.IsNotExist(err) {
+		t.Errorf("dropped key file still exists: %v", err)
+	}
+
+	if err := os.Chmod(store.path, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(serverKeyConfig); err == nil || !strings.Contains(err.Error(), "chmod 600") {
+		t.Errorf("got %v, expected key files accessible by others to be rejected", err)
+	}
+}
+
+// plcServer accepts PLC operations, recording the published label keys,
+// and fails the submissions while failing is set
+type plcServer struct {
+	published []string
+	failing   bool
+}
+
+func (s *plcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/xrpc/") {
+	case "com.atproto.identity.getRecommendedDidCredentials":
+		w.Write([]byte(`{"verificationMethods":{},"services":{}}`))
+	case "com.atproto.identity.signPlcOperation":
+		var input struct {
+			VerificationMethods map[string]string `json:"verificationMethods"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.published = append(s.published, input.VerificationMethods["atproto_label"])
+		w.Write([]byte(`{"operation":{}}`))
+	case "com.atproto.identity.submitPlcOperation":
+		if s.failing {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"InvalidRequest","message":"Invalid PLC operation"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func didKey(t *testing.T, key *crypto.PrivateKeyP256) string {
+	t.Helper()
+	pub, err := key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub.DIDKey()
+}
+
+func TestRotateKey(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := database.OpenDatabase(logger, filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	plc := &plcServer{}
+	server := httptest.NewServer(plc)
+	client, token := Client, config.PlcToken
+	signingKey, signingKeyFile := config.SigningKey, config.SigningKeyFile
+	key, previousKey := KeyP256, PreviousKeyP256
+	t.Cleanup(func() {
+		server.Close()
+		database.Close()
+		Client, config.PlcToken = client, token
+		config.SigningKey, config.SigningKeyFile = signingKey, signingKeyFile
+		KeyP256, PreviousKeyP256 = key, previousKey
+	})
+	Client = &xrpc.Client{Host: server.URL}
+	config.PlcToken = "token"
+	config.SigningKey, config.SigningKeyFile = "", ""
+	KeyP256, PreviousKeyP256 = nil, nil
+	if err := InitKeys(); err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	initial := KeyP256
+	ctx := context.Background()
+
+	if err := RotateKey(ctx, true); err == nil {
+		t.Error("reverted without a previous key")
+	}
+
+	plc.failing = true
+	if err := RotateKey(ctx, false); err == nil {
+		t.Fatal("rotated although the PLC operation failed")
+	}
+	if KeyP256 != initial {
+		t.Error("signing key replaced although the PLC operation failed")
+	}
+	if len(plc.published) != 1 {
+		t.Fatalf("got %d PLC operations, expected 1", len(plc.published))
+	}
+	pending := plc.published[0]
+
+	// the pending key might have been published, so it is the one rotated to
+	plc.failing = false
+	if err := RotateKey(ctx, false); err != nil {
+		t.Fatalf("failed to rotate key: %v", err)
+	}
+	if plc.published[1] != pending || didKey(t, KeyP256) != pending {
+		t.Error("rotated to another key than the pending one")
+	}
+	if PreviousKeyP256 != initial {
+		t.Error("replaced key not kept as the previous key")
+	}
+	rotated := KeyP256
+
+	if err := RotateKey(ctx, true); err != nil {
+		t.Fatalf("failed to revert key: %v", err)
+	}
+	if KeyP256 != initial || PreviousKeyP256 != rotated {
+		t.Error("revert did not swap the current and previous keys")
+	}
+	if plc.published[2] != didKey(t, initial) {
+		t.Error("reverted key not published")
+	}
+
+	// the keys are reloaded as stored after a restart
+	KeyP256, PreviousKeyP256 = nil, nil
+	if err := InitKeys(); err != nil {
+		t.Fatalf("failed to load keys: %v", err)
+	}
+	if !bytes.Equal(KeyP256.Bytes(), initial.Bytes()) || !bytes.Equal(PreviousKeyP256.Bytes(), rotated.Bytes()) {
+		t.Error("stored keys differ from the keys in use")
+	}
+	if value, err := (dbKeyStore{db: database.Instance()}).Load(pendingServerKeyConfig); err != nil || value != "" {
+		t.Errorf("pending key left behind: %q, %v", value, err)
+	}
+}
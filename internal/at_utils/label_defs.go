@@ -0,0 +1,130 @@
+package at_utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// Global label values are defined by Bluesky and need no definitions
+var globalLabelValues = []string{
+	"!hide",
+	"!warn",
+	LabelPornString,
+	LabelSexualString,
+	LabelNudityString,
+	LabelGraphicMediaString,
+}
+
+func IsGlobalLabelValue(val string) bool {
+	return slices.Contains(globalLabelValues, val)
+}
+
+// Used when LABEL_DEFINITIONS is not set
+func defaultLabelDefinitions() []*atproto.LabelDefs_LabelValueDefinition {
+	trueValue := true
+	hide := "hide"
+	return []*atproto.LabelDefs_LabelValueDefinition{
+		{
+			Identifier:     LabelOffenderString,
+			AdultOnly:      &trueValue,
+			Blurs:          "content",
+			DefaultSetting: &hide,
+			Severity:       "alert",
+			Locales: []*atproto.LabelDefs_LabelValueDefinitionStrings{
+				{
+					Name:        "Incorrigible",
+					Lang:        "en",
+					Description: "Users who seldom label their not-suitable-for-whatever contents.",
+				},
+			},
+		},
+	}
+}
+
+// LoadLabelDefinitions reads label value definitions from a JSON file, which
+// is an array of com.atproto.label.defs#labelValueDefinition objects.
+//
+// The built-in definitions are returned if path is empty.
+func LoadLabelDefinitions(path string) ([]*atproto.LabelDefs_LabelValueDefinition, error) {
+	if path == "" {
+		return defaultLabelDefinitions(), nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var definitions []*atproto.LabelDefs_LabelValueDefinition
+	if err := json.Unmarshal(content, &definitions); err != nil {
+		return nil, fmt.Errorf("invalid label definitions %s: %w", path, err)
+	}
+	seen := make(map[string]bool, len(definitions))
+	for i, definition := range definitions {
+		if definition == nil {
+			return nil, fmt.Errorf("label definition #%d is null", i)
+		}
+		if err := validateLabelDefinition(definition); err != nil {
+			return nil, fmt.Errorf("label definition %q: %w", definition.Identifier, err)
+		}
+		if seen[definition.Identifier] {
+			return nil, fmt.Errorf("label definition %q is duplicated", definition.Identifier)
+		}
+		seen[definition.Identifier] = true
+	}
+	return definitions, nil
+}
+
+var labelIdentifierRegexp = regexp.MustCompile(`^[a-z-]+$`)
+
+// validateLabelDefinition checks the definition against the lexicon
+// (com.atproto.label.defs#labelValueDefinition)
+func validateLabelDefinition(definition *atproto.LabelDefs_LabelValueDefinition) error {
+	if len(definition.Identifier) > 100 || utf8.RuneCountInString(definition.Identifier) > 100 {
+		return fmt.Errorf("identifier is too long")
+	}
+	if !labelIdentifierRegexp.MatchString(definition.Identifier) {
+		return fmt.Errorf("identifier must only contain lowercase ascii letters and '-'")
+	}
+	if IsGlobalLabelValue(definition.Identifier) {
+		return fmt.Errorf("identifier is a global label value")
+	}
+	if !slices.Contains([]string{"inform", "alert", "none"}, definition.Severity) {
+		return fmt.Errorf("severity must be one of inform, alert or none")
+	}
+	if !slices.Contains([]string{"content", "media", "none"}, definition.Blurs) {
+		return fmt.Errorf("blurs must be one of content, media or none")
+	}
+	if definition.DefaultSetting != nil &&
+		!slices.Contains([]string{"ignore", "warn", "hide"}, *definition.DefaultSetting) {
+		return fmt.Errorf("defaultSetting must be one of ignore, warn or hide")
+	}
+	if len(definition.Locales) == 0 {
+		return fmt.Errorf("at least one locale is required")
+	}
+	langs := make(map[string]bool, len(definition.Locales))
+	for _, locale := range definition.Locales {
+		if locale == nil {
+			return fmt.Errorf("locale is null")
+		}
+		if _, err := syntax.ParseLanguage(locale.Lang); err != nil {
+			return fmt.Errorf("locale %q: %w", locale.Lang, err)
+		}
+		if langs[locale.Lang] {
+			return fmt.Errorf("locale %q is duplicated", locale.Lang)
+		}
+		langs[locale.Lang] = true
+		if locale.Name == "" || len(locale.Name) > 640 || utf8.RuneCountInString(locale.Name) > 64 {
+			return fmt.Errorf("locale %q: name must be 1 to 64 characters long", locale.Lang)
+		}
+		if locale.Description == "" || len(locale.Description) > 100000 || utf8.RuneCountInString(locale.Description) > 10000 {
+			return fmt.Errorf("locale %q: description must be 1 to 10000 characters long", locale.Lang)
+		}
+	}
+	return nil
+}
@@ -3,10 +3,13 @@ package at_utils
 import (
 	"bluesky-oneshot-labeler/internal/config"
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -49,7 +52,9 @@ func requestPlcToken(ctx context.Context) (string, error) {
 	return strings.TrimSpace(line), nil
 }
 
-func PublishLabelerInfo(ctx context.Context) error {
+// updatePlcIdentity updates the DID document of the labeler account through a PLC operation,
+// starting from the credentials recommended by the PDS
+func updatePlcIdentity(ctx context.Context, update func(services, verificationMethods map[string]any)) error {
 	// // Unfortunately, this API does not yet support the returned credentials and throws parsing errors.
 	// credentials, err := atproto.IdentityGetRecommendedDidCredentials(context.Background(), Client)
 
@@ -60,42 +65,6 @@ func PublishLabelerInfo(ctx context.Context) error {
 		return err
 	}
 
-	pubKey, err := KeyP256.PublicKey()
-	if err != nil {
-		return err
-	}
-	pubKeyStr := pubKey.DIDKey()
-
-	ident, err := BaseDirectory.ResolveDID(ctx, UserDid)
-	if err != nil {
-		return err
-	}
-
-	keyExists := false
-	for _, vm := range ident.VerificationMethod {
-		if vm.PublicKeyMultibase == strings.TrimPrefix(pubKeyStr, "did:key:") {
-			keyExists = true
-			break
-		}
-		splits := strings.Split(vm.ID, "#")
-		if len(splits) == 2 && splits[1] == "atproto_label" {
-			return fmt.Errorf("verificationMethods[atproto_label] already exists: %s", vm.PublicKeyMultibase)
-		}
-	}
-	serviceExists := 0
-	for _, service := range ident.Service {
-		if service.Type == "AtprotoLabeler" && service.ServiceEndpoint == "https://"+config.Host {
-			serviceExists |= 0b01
-		}
-		if service.Type == "BskyFeedGenerator" && service.ServiceEndpoint == "https://"+config.Host {
-			serviceExists |= 0b10
-		}
-	}
-	if keyExists && serviceExists == 0b11 {
-		slog.Info("Labeler info already published")
-		return nil
-	}
-
 	var alsoKnownAs []any
 	if value, ok := credentials["alsoKnownAs"]; ok {
 		if alsoKnownAs, ok = value.([]any); !ok {
@@ -121,15 +90,7 @@ func PublishLabelerInfo(ctx context.Context) error {
 		}
 	}
 
-	verificationMethods["atproto_label"] = pubKeyStr
-	services["atproto_labeler"] = map[string]any{
-		"type":     "AtprotoLabeler",
-		"endpoint": "https://" + config.Host,
-	}
-	services["bsky_fg"] = map[string]any{
-		"type":     "BskyFeedGenerator",
-		"endpoint": "https://" + config.Host,
-	}
+	update(services, verificationMethods)
 
 	plcToken, err := requestPlcToken(ctx)
 	if err != nil {
@@ -150,7 +111,64 @@ func PublishLabelerInfo(ctx context.Context) error {
 		return err
 	}
 	submitApi := "com.atproto.identity.submitPlcOperation"
-	if err := Client.Do(ctx, xrpc.Procedure, "application/json", submitApi, nil, signed, nil); err != nil {
+	return Client.Do(ctx, xrpc.Procedure, "application/json", submitApi, nil, signed, nil)
+}
+
+// labelerServices sets up the services provided by us
+func labelerServices(services map[string]any) {
+	services["atproto_labeler"] = map[string]any{
+		"type":     "AtprotoLabeler",
+		"endpoint": "https://" + config.Host,
+	}
+	services["bsky_fg"] = map[string]any{
+		"type":     "BskyFeedGenerator",
+		"endpoint": "https://" + config.Host,
+	}
+}
+
+func PublishLabelerInfo(ctx context.Context) error {
+	pubKey, err := KeyP256.PublicKey()
+	if err != nil {
+		return err
+	}
+	pubKeyStr := pubKey.DIDKey()
+
+	ident, err := BaseDirectory.ResolveDID(ctx, UserDid)
+	if err != nil {
+		return err
+	}
+
+	keyExists := false
+	for _, vm := range ident.VerificationMethod {
+		splits := strings.Split(vm.ID, "#")
+		if len(splits) != 2 || splits[1] != "atproto_label" {
+			continue
+		}
+		if vm.PublicKeyMultibase == strings.TrimPrefix(pubKeyStr, "did:key:") {
+			keyExists = true
+		} else {
+			slog.Warn("replacing existing atproto_label key", "previous", vm.PublicKeyMultibase)
+		}
+	}
+	serviceExists := 0
+	for _, service := range ident.Service {
+		if service.Type == "AtprotoLabeler" && service.ServiceEndpoint == "https://"+config.Host {
+			serviceExists |= 0b01
+		}
+		if service.Type == "BskyFeedGenerator" && service.ServiceEndpoint == "https://"+config.Host {
+			serviceExists |= 0b10
+		}
+	}
+	if keyExists && serviceExists == 0b11 {
+		slog.Info("Labeler info already published")
+		return nil
+	}
+
+	err = updatePlcIdentity(ctx, func(services, verificationMethods map[string]any) {
+		verificationMethods["atproto_label"] = pubKeyStr
+		labelerServices(services)
+	})
+	if err != nil {
 		return err
 	}
 	return atproto.IdentityUpdateHandle(ctx, Client, &atproto.IdentityUpdateHandle_Input{
@@ -158,63 +176,59 @@ func PublishLabelerInfo(ctx context.Context) error {
 	})
 }
 
-func PublishLabelInfo(ctx context.Context) error {
-	labels := []string{
-		LabelPornString,
-		LabelSexualString,
-		LabelNudityString,
-		LabelGraphicMediaString,
-		LabelOffenderString,
-		LabelOthersString,
+// PublishLabelInfo publishes the label value definitions along with the label values we emit.
+//
+// Each emitted value must be either a global label value or defined in LABEL_DEFINITIONS.
+// Nothing is updated if the published record already matches.
+func PublishLabelInfo(ctx context.Context, emitted []string) error {
+	definitions, err := LoadLabelDefinitions(config.LabelDefinitionsFile)
+	if err != nil {
+		return err
 	}
-	labelPointers := make([]*string, len(labels))
-	for i, label := range labels {
-		labelPointers[i] = &label
+	defined := make(map[string]bool, len(definitions))
+	usedDefinitions := make([]*atproto.LabelDefs_LabelValueDefinition, 0, len(definitions))
+	for _, definition := range definitions {
+		defined[definition.Identifier] = true
+		if slices.Contains(emitted, definition.Identifier) {
+			usedDefinitions = append(usedDefinitions, definition)
+		} else {
+			slog.Warn("label definition is not used by any emitted label, skipping", "identifier", definition.Identifier)
+		}
 	}
-	trueValue := true
-
-	hide := "hide"
-	warn := "warn"
-	service := bsky.LabelerService{
-		CreatedAt: time.Now().UTC().Format(time.RFC3339),
-		Policies: &bsky.LabelerDefs_LabelerPolicies{
-			LabelValueDefinitions: []*atproto.LabelDefs_LabelValueDefinition{
-				{
-					Identifier:     LabelOffenderString,
-					AdultOnly:      &trueValue,
-					Blurs:          "content",
-					DefaultSetting: &hide,
-					Severity:       "alert",
-					Locales: []*atproto.LabelDefs_LabelValueDefinitionStrings{
-						{
-							Name:        "Incorrigible",
-							Lang:        "en",
-							Description: "Users who seldom labels their not-suitable-for-whatever contents.",
-						},
-					},
-				},
-				{
-					Identifier:     LabelOthersString,
-					Blurs:          "none",
-					DefaultSetting: &warn,
-					Severity:       "inform",
-					Locales: []*atproto.LabelDefs_LabelValueDefinitionStrings{
-						{
-							Name:        "Others",
-							Lang:        "en",
-							Description: "Users who has posted contents flagged by the upstream moderation servichas posted contents flagged by the upstream moderation service.",
-						},
-					},
-				},
-			},
-			LabelValues: labelPointers,
-		},
+	labelValues := make([]*string, len(emitted))
+	for i, val := range emitted {
+		if !defined[val] && !IsGlobalLabelValue(val) {
+			return fmt.Errorf("emitted label value %q is neither global nor defined", val)
+		}
+		labelValues[i] = &val
+	}
+	policies := &bsky.LabelerDefs_LabelerPolicies{
+		LabelValueDefinitions: usedDefinitions,
+		LabelValues:           labelValues,
 	}
 
-	prevRecord, err := labelInfoExists(ctx)
+	prevCid, prevRecord, err := labelInfoExists(ctx)
 	if err != nil {
 		return err
 	}
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	if prevRecord != nil {
+		same, err := jsonEqual(prevRecord.Policies, policies)
+		if err != nil {
+			return err
+		}
+		if same {
+			slog.Info("Label info already published")
+			return nil
+		}
+		createdAt = prevRecord.CreatedAt
+	}
+	service := bsky.LabelerService{
+		CreatedAt: createdAt,
+		Policies:  policies,
+	}
+
+	trueValue := true
 	if prevRecord == nil {
 		self := "self"
 		_, err = atproto.RepoCreateRecord(ctx, Client, &atproto.RepoCreateRecord_Input{
@@ -228,7 +242,7 @@ func PublishLabelInfo(ctx context.Context) error {
 		})
 	} else {
 		_, err = atproto.RepoPutRecord(ctx, Client, &atproto.RepoPutRecord_Input{
-			SwapRecord: prevRecord,
+			SwapRecord: prevCid,
 			Collection: "app.bsky.labeler.service",
 			Rkey:       "self",
 			Repo:       UserDid.String(),
@@ -242,6 +256,18 @@ func PublishLabelInfo(ctx context.Context) error {
 	return err
 }
 
+func jsonEqual(a, b any) (bool, error) {
+	aJson, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bJson, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aJson, bJson), nil
+}
+
 func IsRecordNotFound(err error) bool {
 	if inner, ok := err.(*xrpc.Error); ok {
 		if xrpcErr, ok := inner.Wrapped.(*xrpc.XRPCError); ok && xrpcErr.ErrStr == "RecordNotFound" {
@@ -251,22 +277,31 @@ func IsRecordNotFound(err error) bool {
 	return false
 }
 
-func labelInfoExists(ctx context.Context) (*string, error) {
-	params := map[string]interface{}{
-		"repo":       UserDid.String(),
-		"collection": "app.bsky.labeler.service",
-		"rkey":       "self",
+func IsExpiredToken(err error) bool {
+	if inner, ok := err.(*xrpc.Error); ok {
+		if xrpcErr, ok := inner.Wrapped.(*xrpc.XRPCError); ok && xrpcErr.ErrStr == "ExpiredToken" {
+			return true
+		}
 	}
-	recordApi := "com.atproto.repo.getRecord"
-	labelerDetails := bsky.LabelerDefs_LabelerViewDetailed{}
-	if err := Client.Do(ctx, xrpc.Query, "", recordApi, params, nil, &labelerDetails); err != nil {
+	return false
+}
+
+func labelInfoExists(ctx context.Context) (*string, *bsky.LabelerService, error) {
+	output, err := atproto.RepoGetRecord(ctx, Client, "", "app.bsky.labeler.service", UserDid.String(), "self")
+	if err != nil {
 		if !IsRecordNotFound(err) {
-			return nil, err
+			return nil, nil, err
 		}
-		return nil, nil
+		return nil, nil, nil
 	}
-
-	return &labelerDetails.Cid, nil
+	if output.Value == nil {
+		return output.Cid, nil, fmt.Errorf("labeler record has no value")
+	}
+	record, ok := output.Value.Val.(*bsky.LabelerService)
+	if !ok {
+		return output.Cid, nil, fmt.Errorf("unexpected labeler record type: %T", output.Value.Val)
+	}
+	return output.Cid, record, nil
 }
 
 func PublishFeedInfo(ctx context.Context) error {
@@ -3,12 +3,21 @@ package config
 import (
 	"log"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 )
 
+func getEnvDefault(s string, defaultValue string) string {
+	if v := os.Getenv(s); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
 func getEnvInt(s string) int {
 	v := os.Getenv(s)
 	if v == "" {
@@ -22,6 +31,18 @@ func getEnvInt(s string) int {
 	return i
 }
 
+func getEnvIntDefault(s string, defaultValue int) int {
+	v := os.Getenv(s)
+	if v == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		log.Fatalf("Environment variable %s is not a valid non-negative integer: %v", s, err)
+	}
+	return i
+}
+
 func getEnvFloat(s string) float64 {
 	v := os.Getenv(s)
 	if v == "" {
@@ -35,6 +56,42 @@ func getEnvFloat(s string) float64 {
 	return f
 }
 
+func getEnvFloatDefault(s string, defaultValue float64) float64 {
+	v := os.Getenv(s)
+	if v == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		log.Fatalf("Environment variable %s is not a valid non-negative float: %v", s, err)
+	}
+	return f
+}
+
+func getEnvBool(s string) bool {
+	v := os.Getenv(s)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Environment variable %s is not a valid boolean: %v", s, err)
+	}
+	return b
+}
+
+// getEnvChoice reads one of the allowed values, defaulting to the first one
+func getEnvChoice(s string, allowed ...string) string {
+	v := strings.TrimSpace(os.Getenv(s))
+	if v == "" {
+		return allowed[0]
+	}
+	if !slices.Contains(allowed, v) {
+		log.Fatalf("Environment variable %s must be one of %v", s, allowed)
+	}
+	return v
+}
+
 func getEnvList(s string) []string {
 	list := strings.Split(os.Getenv(s), ",")
 	for i := range list {
@@ -43,12 +100,81 @@ func getEnvList(s string) []string {
 	return list
 }
 
+func getEnvDuration(s string, defaultValue time.Duration) time.Duration {
+	v := os.Getenv(s)
+	if v == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Environment variable %s is not a valid duration: %v", s, err)
+	}
+	return d
+}
+
+// getEnvDurations parses a list of durations in the form of "<key>=<duration>,..."
+func getEnvDurations(s string) map[string]time.Duration {
+	durations := make(map[string]time.Duration)
+	for _, item := range getEnvList(s) {
+		if item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			log.Fatalf("Environment variable %s has an entry without a duration: %s", s, item)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			log.Fatalf("Environment variable %s has an invalid duration for %s: %v", s, key, err)
+		}
+		durations[strings.TrimSpace(key)] = d
+	}
+	return durations
+}
+
+// Upstream is an upstream labeler along with how much we trust it
+type Upstream struct {
+	// Identifier is either a handle or a DID
+	Identifier string
+	Weight     float64
+}
+
+// getEnvUpstreams parses a list of upstream labelers in the form of
+// "<handle or did>[=<weight>],...", falling back to UPSTREAM_USER.
+func getEnvUpstreams(s string) []Upstream {
+	if os.Getenv(s) == "" {
+		return []Upstream{{Identifier: os.Getenv("UPSTREAM_USER"), Weight: 1}}
+	}
+	var upstreams []Upstream
+	for _, item := range getEnvList(s) {
+		if item == "" {
+			continue
+		}
+		upstream := Upstream{Identifier: item, Weight: 1}
+		if i := strings.LastIndex(item, "="); i != -1 {
+			weight, err := strconv.ParseFloat(strings.TrimSpace(item[i+1:]), 64)
+			if err != nil || weight < 0 {
+				log.Fatalf("Environment variable %s has an invalid weight for %s: %v", s, item, err)
+			}
+			upstream.Identifier = strings.TrimSpace(item[:i])
+			upstream.Weight = weight
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams
+}
+
 var (
 	Username = os.Getenv("USERNAME")
 	UserDid  = os.Getenv("USER_DID")
 	Password = os.Getenv("PASSWORD")
 
 	UpstreamUser = os.Getenv("UPSTREAM_USER")
+	Upstreams    = getEnvUpstreams("UPSTREAM_USERS")
+
+	LabelMappingFile = os.Getenv("LABEL_MAPPING")
+
+	UpstreamSignaturePolicy = getEnvChoice("UPSTREAM_SIGNATURE_POLICY", "reject", "warn", "skip")
 
 	DatabaseFile = os.Getenv("DATABASE_FILE")
 	SessionFile  = os.Getenv("SESSION_FILE")
@@ -67,8 +193,53 @@ var (
 	FeedName   = os.Getenv("FEED_NAME")
 	FeedAvatar = os.Getenv("FEED_AVATAR")
 	FeedDesc   = os.Getenv("FEED_DESCRIPTION")
+	// FeedIncludeReplies keeps replies in the feed, unless they reply to blocked users
+	FeedIncludeReplies = getEnvBool("FEED_INCLUDE_REPLIES")
+	// FeedKeepMentions keeps posts mentioning blocked users, which are dropped otherwise
+	FeedKeepMentions = getEnvBool("FEED_KEEP_MENTIONS")
 
 	ExternalBlockList = os.Getenv("EXTERNAL_BLOCK_LIST")
+	// BlockModLists are the AT-URIs of moderation lists whose members are blocked from the feed
+	BlockModLists = getEnvList("BLOCK_MODLISTS")
+	// TrustedCurators are users (handles or DIDs) whose blocks count as votes to block from the feed
+	TrustedCurators = getEnvList("TRUSTED_CURATORS")
+	// CuratorBlockThreshold is the number of curators who must block a user
+	CuratorBlockThreshold = getEnvIntDefault("CURATOR_BLOCK_THRESHOLD", 2)
+
+	// GraphPropagation collects follows of blocked users and ranks their neighbors with personalized PageRank
+	GraphPropagation  = getEnvBool("GRAPH_PROPAGATION")
+	GraphRankInterval = getEnvDuration("GRAPH_RANK_INTERVAL", 6*time.Hour)
+	GraphDamping      = getEnvFloatDefault("GRAPH_DAMPING", 0.7)
+	// GraphReviewThreshold and GraphBlockThreshold are scores relative to the average user,
+	// above which users are queued for review or blocked (0 to disable)
+	GraphReviewThreshold = getEnvFloatDefault("GRAPH_REVIEW_THRESHOLD", 5)
+	GraphBlockThreshold  = getEnvFloatDefault("GRAPH_BLOCK_THRESHOLD", 0)
+	// GraphMaxCandidates is the max number of users queued or blocked each round
+	GraphMaxCandidates = getEnvIntDefault("GRAPH_MAX_CANDIDATES", 50)
+
+	PublishLabels = getEnvBool("PUBLISH_LABELS")
+	LabelExpiry   = getEnvDurations("LABEL_EXPIRY")
+
+	LabelDefinitionsFile = os.Getenv("LABEL_DEFINITIONS")
+
+	SigningKey          = os.Getenv("SIGNING_KEY")
+	SigningKeyFile      = os.Getenv("SIGNING_KEY_FILE")
+	KeyTransitionWindow = getEnvDuration("KEY_TRANSITION_WINDOW", 72*time.Hour)
+
+	// ExportModList mirrors blocked users into a moderation list owned by the labeler account
+	ExportModList     = getEnvBool("EXPORT_MODLIST")
+	ExportModListCsv  = getEnvBool("EXPORT_MODLIST_CSV")
+	ExportModListName = getEnvDefault("EXPORT_MODLIST_NAME", "Oneshot block list")
+	ExportModListDesc = os.Getenv("EXPORT_MODLIST_DESCRIPTION")
+	// ExportModListRateLimit is the max number of list items created or deleted per hour
+	ExportModListRateLimit = getEnvIntDefault("EXPORT_MODLIST_RATE_LIMIT", 1000)
+	ExportModListInterval  = getEnvDuration("EXPORT_MODLIST_INTERVAL", 10*time.Minute)
 
 	ModeratorHandles = getEnvList("MODERATOR_HANDLES")
+	AdminToken       = os.Getenv("ADMIN_TOKEN")
+
+	// ReportRateLimit is the max number of reports per hour from each non-moderator
+	ReportRateLimit = getEnvIntDefault("REPORT_RATE_LIMIT", 10)
+	// ReportEscalationThreshold is the number of distinct reporters that escalates reports on an account
+	ReportEscalationThreshold = getEnvIntDefault("REPORT_ESCALATION_THRESHOLD", 3)
 )
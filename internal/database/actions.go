@@ -0,0 +1,78 @@
+package database
+
+import (
+	"time"
+)
+
+// ModerationAction is an audit record of something a moderator did
+type ModerationAction struct {
+	Id int64
+	// Actor is the DID of the moderator, or the interface used for admin actions, e.g. "admin-api"
+	Actor   string
+	Action  string
+	Subject string
+	Reason  string
+	// Cts is the time of the action, in unix milliseconds
+	Cts int64
+	// Outcome is "ok" or what went wrong
+	Outcome string
+}
+
+func (s *Service) prepareActionStatements() error {
+	stmt, err := s.wdb.Prepare(
+		`INSERT INTO moderation_action (actor, action, subject, reason, cts, outcome)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id`,
+	)
+	if err != nil {
+		return err
+	}
+	s.insertActionStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		`SELECT id, actor, action, subject, reason, cts, outcome FROM moderation_action
+		WHERE id < ? AND (? = '' OR actor = ?) AND (? = '' OR subject = ?)
+		ORDER BY id DESC
+		LIMIT ?`,
+	)
+	if err != nil {
+		return err
+	}
+	s.queryActionsStmt = stmt
+
+	return nil
+}
+
+// RecordAction appends to the audit trail, setting the id and the time of the action
+func (s *Service) RecordAction(action *ModerationAction) error {
+	if action.Cts == 0 {
+		action.Cts = time.Now().UnixMilli()
+	}
+	return s.insertActionStmt.QueryRow(
+		action.Actor,
+		action.Action,
+		action.Subject,
+		action.Reason,
+		action.Cts,
+		action.Outcome,
+	).Scan(&action.Id)
+}
+
+// QueryActions lists actions before the cursor id, the latest first.
+// Empty actor or subject matches all.
+func (s *Service) QueryActions(actor, subject string, cursor int64, limit int) ([]ModerationAction, error) {
+	rows, err := s.queryActionsStmt.Query(cursor, actor, actor, subject, subject, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var actions []ModerationAction
+	for rows.Next() {
+		var a ModerationAction
+		if err := rows.Scan(&a.Id, &a.Actor, &a.Action, &a.Subject, &a.Reason, &a.Cts, &a.Outcome); err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"bluesky-oneshot-labeler/internal/config"
+	"context"
 	"database/sql"
 	_ "embed"
 	"log/slog"
@@ -19,15 +20,69 @@ type Service struct {
 	log *slog.Logger
 
 	insertUserStmt       *sql.Stmt
+	getUserDidStmt       *sql.Stmt
+	upsertUpstreamStmt   *sql.Stmt
 	incrementCounterStmt *sql.Stmt
+	decrementCounterStmt *sql.Stmt
+	getCounterStmt       *sql.Stmt
 	labeledCountSumStmt  *sql.Stmt
 
 	profileLabelPenaltyStmt *sql.Stmt
+	resetCountersStmt       *sql.Stmt
+
+	upstreamLabelExistsStmt   *sql.Stmt
+	insertUpstreamLabelStmt   *sql.Stmt
+	setUpstreamLabelDeltaStmt *sql.Stmt
+	deleteUpstreamLabelStmt   *sql.Stmt
+	deleteExpiredLabelsStmt   *sql.Stmt
+	hasAccountLabelStmt       *sql.Stmt
+	resetLabelDeltasStmt      *sql.Stmt
 
 	lastBlockIdStmt   *sql.Stmt
 	userBlockedStmt   *sql.Stmt
 	getBlockSinceStmt *sql.Stmt
 	insertBlockStmt   *sql.Stmt
+	deleteBlockStmt   *sql.Stmt
+
+	appendLabelStmt    *sql.Stmt
+	lastLabelSeqStmt   *sql.Stmt
+	getLabelsSinceStmt *sql.Stmt
+	getLatestLabelStmt *sql.Stmt
+
+	insertAllowedUserStmt *sql.Stmt
+	userAllowedStmt       *sql.Stmt
+	getAllowedUsersStmt   *sql.Stmt
+	insertPinnedPostStmt  *sql.Stmt
+	deletePinnedPostStmt  *sql.Stmt
+	getPinnedPostsStmt    *sql.Stmt
+	insertMutedWordStmt   *sql.Stmt
+	getMutedWordsStmt     *sql.Stmt
+
+	insertReportStmt         *sql.Stmt
+	countRecentReportsStmt   *sql.Stmt
+	countReportersStmt       *sql.Stmt
+	updateReportsStmt        *sql.Stmt
+	getOpenReportsStmt       *sql.Stmt
+	getOpenReportIdStmt      *sql.Stmt
+	getReportsByReporterStmt *sql.Stmt
+	getReportStmt            *sql.Stmt
+	hasReportedStmt          *sql.Stmt
+
+	upsertModeratorStmt  *sql.Stmt
+	deleteModeratorStmt  *sql.Stmt
+	getModeratorRoleStmt *sql.Stmt
+	getModeratorsStmt    *sql.Stmt
+
+	insertActionStmt *sql.Stmt
+	queryActionsStmt *sql.Stmt
+
+	insertFollowStmt   *sql.Stmt
+	followExistsStmt   *sql.Stmt
+	deleteFollowStmt   *sql.Stmt
+	getFollowEdgesStmt *sql.Stmt
+	insertBackfillStmt *sql.Stmt
+	getBackfillsStmt   *sql.Stmt
+	deleteBackfillStmt *sql.Stmt
 
 	insertFeedItemStmt    *sql.Stmt
 	getFeedItemsStmt      *sql.Stmt
@@ -41,7 +96,12 @@ var dbInstance *Service
 var databaseFile = config.DatabaseFile
 
 func InitDatabase(logger *slog.Logger) error {
-	url := databaseFile
+	return OpenDatabase(logger, databaseFile)
+}
+
+// OpenDatabase opens the database at the path, or an in-memory one if the path is empty,
+// as the instance
+func OpenDatabase(logger *slog.Logger, url string) error {
 	if url == "" {
 		url = ":memory:"
 	}
@@ -103,6 +163,30 @@ func InitDatabase(logger *slog.Logger) error {
 	if err != nil {
 		return err
 	}
+	err = dbInstance.prepareEmittedLabelStatements()
+	if err != nil {
+		return err
+	}
+	err = dbInstance.prepareModerationStatements()
+	if err != nil {
+		return err
+	}
+	err = dbInstance.prepareReportStatements()
+	if err != nil {
+		return err
+	}
+	err = dbInstance.prepareModeratorStatements()
+	if err != nil {
+		return err
+	}
+	err = dbInstance.prepareActionStatements()
+	if err != nil {
+		return err
+	}
+	err = dbInstance.prepareGraphStatements()
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -127,7 +211,7 @@ func Instance() *Service {
 //go:embed schema.sql
 var schemaSql string
 
-const dbVersion = 3
+const dbVersion = 14
 
 func (s *Service) init() error {
 	for _, line := range strings.Split(schemaSql, ";") {
@@ -207,6 +291,180 @@ func (s *Service) upgrade() error {
 		if _, err := s.wdb.Exec("VACUUM"); err != nil {
 			return err
 		}
+		fallthrough
+	case 3:
+		if err := try(4,
+			`CREATE TABLE upstream_label (
+				id integer PRIMARY KEY AUTOINCREMENT,
+				uid integer not null,
+				uri text not null,
+				val text not null,
+				kind integer not null,
+				delta integer not null,
+				exp integer
+			)`,
+			`CREATE UNIQUE INDEX upstream_label_uri_val ON upstream_label (uri, val)`,
+			`CREATE INDEX upstream_label_uid ON upstream_label (uid)`,
+			`CREATE INDEX upstream_label_exp ON upstream_label (exp) WHERE exp IS NOT NULL`,
+			// Block ids are used as cursors, so they must not be reused after unblocking
+			`CREATE TABLE blocked_user_new (id integer PRIMARY KEY AUTOINCREMENT, uid integer not null)`,
+			`INSERT INTO blocked_user_new (id, uid) SELECT id, uid FROM blocked_user`,
+			`DROP TABLE blocked_user`,
+			`ALTER TABLE blocked_user_new RENAME TO blocked_user`,
+			`CREATE UNIQUE INDEX blocked_user_uid_id ON blocked_user (uid)`,
+		); err != nil {
+			return err
+		}
+		fallthrough
+	case 4:
+		// Existing stats all come from the single upstream, which gets src = 0
+		if err := try(5,
+			`CREATE TABLE upstream (
+				id integer PRIMARY KEY AUTOINCREMENT,
+				did text not null,
+				weight real not null
+			)`,
+			`CREATE UNIQUE INDEX upstream_did ON upstream (did)`,
+			`ALTER TABLE upstream_stats ADD src integer not null default 0`,
+			`DROP INDEX block_list_uid_kind`,
+			`CREATE UNIQUE INDEX upstream_stats_uid_kind_src ON upstream_stats (uid, kind, src)`,
+			`ALTER TABLE upstream_label ADD src integer not null default 0`,
+			`DROP INDEX upstream_label_uri_val`,
+			`CREATE UNIQUE INDEX upstream_label_src_uri_val ON upstream_label (src, uri, val)`,
+		); err != nil {
+			return err
+		}
+		fallthrough
+	case 5:
+		if err := try(6,
+			`ALTER TABLE blocked_user ADD cts integer not null default 0`,
+			`UPDATE blocked_user SET cts = CAST(unixepoch('subsec') * 1000 AS integer)`,
+		); err != nil {
+			return err
+		}
+		fallthrough
+	case 6:
+		if err := try(7,
+			`CREATE TABLE label (
+			seq integer PRIMARY KEY AUTOINCREMENT,
+			src text not null,
+			uri text not null,
+			cid text,
+			val text not null,
+			neg integer not null default 0,
+			cts integer not null,
+			exp integer,
+			sig blob not null
+		)`,
+			`CREATE INDEX label_uri_val_seq ON label (uri, val, seq)`,
+			// Block ids used to be the subscribeLabels cursors, so sequence numbers start after them
+			// and cursors up to the last block id are told apart as legacy ones
+			`INSERT INTO sqlite_sequence (name, seq) SELECT 'label', seq FROM sqlite_sequence WHERE name = 'blocked_user'`,
+			`INSERT INTO config (key, value) SELECT 'legacy-label-cursor', seq FROM sqlite_sequence WHERE name = 'blocked_user'`,
+		); err != nil {
+			return err
+		}
+		fallthrough
+	case 7:
+		if err := try(8,
+			`CREATE INDEX label_exp ON label (exp) WHERE exp IS NOT NULL`,
+		); err != nil {
+			return err
+		}
+		fallthrough
+	case 8:
+		if err := try(9,
+			`CREATE TABLE allowed_user (
+				uid integer PRIMARY KEY,
+				cts integer not null
+			)`,
+			`CREATE TABLE pinned_post (
+				id integer PRIMARY KEY AUTOINCREMENT,
+				uri text not null,
+				cts integer not null
+			)`,
+			`CREATE UNIQUE INDEX pinned_post_uri ON pinned_post (uri)`,
+			`CREATE TABLE muted_word (
+				id integer PRIMARY KEY AUTOINCREMENT,
+				kind integer not null,
+				value text not null,
+				cts integer not null
+			)`,
+			`CREATE UNIQUE INDEX muted_word_kind_value ON muted_word (kind, value)`,
+		); err != nil {
+			return err
+		}
+		fallthrough
+	case 9:
+		if err := try(10,
+			`CREATE TABLE report (
+				id integer PRIMARY KEY AUTOINCREMENT,
+				uid integer not null,
+				subject text not null,
+				reporter integer not null,
+				reason_type text not null,
+				reason text not null,
+				cts integer not null,
+				status integer not null default 0
+			)`,
+			`CREATE UNIQUE INDEX report_reporter_subject ON report (reporter, subject) WHERE status < 2`,
+			`CREATE INDEX report_uid ON report (uid)`,
+			`CREATE INDEX report_reporter_cts ON report (reporter, cts)`,
+		); err != nil {
+			return err
+		}
+		fallthrough
+	case 10:
+		if err := try(11,
+			`CREATE TABLE moderator (
+				uid integer PRIMARY KEY,
+				role integer not null,
+				cts integer not null
+			)`,
+		); err != nil {
+			return err
+		}
+		fallthrough
+	case 11:
+		if err := try(12,
+			`CREATE TABLE moderation_action (
+				id integer PRIMARY KEY AUTOINCREMENT,
+				actor text not null,
+				action text not null,
+				subject text not null,
+				reason text not null,
+				cts integer not null,
+				outcome text not null
+			)`,
+			`CREATE INDEX moderation_action_actor ON moderation_action (actor)`,
+			`CREATE INDEX moderation_action_subject ON moderation_action (subject)`,
+		); err != nil {
+			return err
+		}
+		fallthrough
+	case 12:
+		if err := try(13,
+			`CREATE TABLE follow_edge (
+				src integer not null,
+				rkey text not null,
+				dst integer not null,
+				cts integer not null,
+				PRIMARY KEY (src, rkey)
+			) WITHOUT ROWID`,
+			`CREATE INDEX follow_edge_dst ON follow_edge (dst)`,
+		); err != nil {
+			return err
+		}
+		fallthrough
+	case 13:
+		if err := try(14,
+			`CREATE TABLE follow_backfill (
+				uid integer PRIMARY KEY,
+				cts integer not null
+			)`,
+		); err != nil {
+			return err
+		}
 		s.log.Info("Upgraded database to version", "version", dbVersion)
 		// no-fallthrough
 	case dbVersion:
@@ -237,6 +495,58 @@ func (s *Service) SetConfig(key string, value string) error {
 	return err
 }
 
+// SetConfigs sets multiple config values at once, deleting those set to empty strings.
+//
+// Values are not logged, so it is also meant for secrets.
+func (s *Service) SetConfigs(values map[string]string) error {
+	tx, err := s.wdb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for key, value := range values {
+		s.log.Debug("set config", "key", key)
+		if value == "" {
+			_, err = tx.Exec("DELETE FROM config WHERE key = ?", key)
+		} else {
+			_, err = tx.Exec(
+				"INSERT INTO config (key, value) VALUES (?, ?)"+
+					" ON CONFLICT (key) DO UPDATE SET value = ?",
+				key, value, value,
+			)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ScrubConfig deletes the config values and makes sure that they are overwritten on disk
+func (s *Service) ScrubConfig(keys ...string) error {
+	ctx := context.Background()
+	conn, err := s.wdb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA secure_delete = ON"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA secure_delete = OFF")
+	for _, key := range keys {
+		if _, err := conn.ExecContext(ctx, "DELETE FROM config WHERE key = ?", key); err != nil {
+			return err
+		}
+	}
+	if _, err := conn.ExecContext(ctx, "VACUUM"); err != nil {
+		return err
+	}
+	// older copies of the pages might still be in the WAL
+	_, err = conn.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
 func (s *Service) GetConfigInt(key string, defaultValue int64) (int64, error) {
 	valueStr, err := s.GetConfig(key, "")
 	if err != nil {
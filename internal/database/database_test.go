@@ -0,0 +1,23 @@
+package database
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDatabase opens a fresh database in a temporary directory as the instance
+func openTestDatabase(t *testing.T) *Service {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := OpenDatabase(logger, filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := Close(); err != nil {
+			t.Errorf("failed to close database: %v", err)
+		}
+	})
+	return Instance()
+}
@@ -0,0 +1,213 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+func (s *Service) prepareEmittedLabelStatements() error {
+	stmt, err := s.wdb.Prepare(
+		"INSERT INTO label (src, uri, cid, val, neg, cts, exp, sig)" +
+			" VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING seq",
+	)
+	if err != nil {
+		return err
+	}
+	s.appendLabelStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT coalesce(max(seq), 0) FROM label",
+	)
+	if err != nil {
+		return err
+	}
+	s.lastLabelSeqStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT " + labelColumns + " FROM label WHERE seq > ? AND seq <= ? ORDER BY seq LIMIT ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.getLabelsSinceStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT neg FROM label WHERE uri = ? AND val = ? ORDER BY seq DESC LIMIT 1",
+	)
+	if err != nil {
+		return err
+	}
+	s.getLatestLabelStmt = stmt
+
+	return nil
+}
+
+const labelColumns = "seq, src, uri, cid, val, neg, cts, exp, sig"
+
+// Label is a label emitted by us, stored along with its signature
+// so that it can be replayed to subscribers as is
+type Label struct {
+	Seq int64
+	Src string
+	Uri string
+	Cid string
+	Val string
+	Neg bool
+	// Cts is the creation time in unix milliseconds
+	Cts int64
+	// Exp is the expiration time in unix milliseconds, or 0 if it never expires
+	Exp int64
+	Sig []byte
+}
+
+func scanLabels(rows *sql.Rows) ([]Label, error) {
+	defer rows.Close()
+	var labels []Label
+	for rows.Next() {
+		var label Label
+		var cid sql.NullString
+		var exp sql.NullInt64
+		if err := rows.Scan(
+			&label.Seq, &label.Src, &label.Uri, &cid, &label.Val,
+			&label.Neg, &label.Cts, &exp, &label.Sig,
+		); err != nil {
+			return nil, err
+		}
+		label.Cid = cid.String
+		label.Exp = exp.Int64
+		labels = append(labels, label)
+	}
+	return labels, rows.Err()
+}
+
+// AppendLabel appends a signed label to the log, filling in its sequence number
+func (s *Service) AppendLabel(label *Label) error {
+	cid := sql.NullString{String: label.Cid, Valid: label.Cid != ""}
+	exp := sql.NullInt64{Int64: label.Exp, Valid: label.Exp != 0}
+	return s.appendLabelStmt.QueryRow(
+		label.Src, label.Uri, cid, label.Val, label.Neg, label.Cts, exp, label.Sig,
+	).Scan(&label.Seq)
+}
+
+func (s *Service) LastLabelSeq() (int64, error) {
+	var seq int64
+	err := s.lastLabelSeqStmt.QueryRow().Scan(&seq)
+	return seq, err
+}
+
+func (s *Service) GetLabelsSince(from, to int64, limit int) ([]Label, error) {
+	rows, err := s.getLabelsSinceStmt.Query(from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanLabels(rows)
+}
+
+// IsLabelActive checks if the latest label of the value on the uri exists and is not a negation
+func (s *Service) IsLabelActive(uri string, val string) (bool, error) {
+	var neg bool
+	err := s.getLatestLabelStmt.QueryRow(uri, val).Scan(&neg)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return !neg, err
+}
+
+// QueryLabels finds active labels whose uri matches any of the patterns,
+// which are either exact matches or prefixes ending with "*".
+//
+// A label is active if it is the latest one for its uri and value and is not a negation.
+func (s *Service) QueryLabels(patterns []string, cursor int64, limit int) ([]Label, error) {
+	conditions := make([]string, 0, len(patterns))
+	args := []any{cursor}
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			conditions = nil
+			args = args[:1]
+			break
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			prefix = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)
+			conditions = append(conditions, `l.uri LIKE ? ESCAPE '\'`)
+			args = append(args, prefix+"%")
+		} else {
+			conditions = append(conditions, "l.uri = ?")
+			args = append(args, pattern)
+		}
+	}
+	query := "SELECT " + labelColumns + " FROM label l WHERE seq > ? AND neg = 0" +
+		" AND NOT EXISTS (SELECT 1 FROM label n WHERE n.uri = l.uri AND n.val = l.val AND n.seq > l.seq)"
+	if len(conditions) != 0 {
+		query += " AND (" + strings.Join(conditions, " OR ") + ")"
+	}
+	query += " ORDER BY seq LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.rdb.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanLabels(rows)
+}
+
+// GetUnlabeledBlocks returns blocked users whose latest label of the value is missing or negated
+func (s *Service) GetUnlabeledBlocks(val string) ([]BlockedUser, error) {
+	rows, err := s.rdb.Query(
+		`SELECT b.id, u.did, b.cts FROM blocked_user b JOIN user u ON u.uid = b.uid
+		WHERE coalesce((
+			SELECT l.neg FROM label l WHERE l.uri = 'did:' || u.did AND l.val = ? ORDER BY l.seq DESC LIMIT 1
+		), 1) = 1
+		ORDER BY b.id`,
+		val,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanBlockedUsers(rows)
+}
+
+// GetStaleLabels returns uris of active account labels of the value whose users are no longer blocked
+func (s *Service) GetStaleLabels(val string) ([]string, error) {
+	rows, err := s.rdb.Query(
+		`SELECT l.uri FROM label l
+		WHERE l.val = ? AND l.neg = 0 AND l.uri LIKE 'did:%'
+		AND NOT EXISTS (SELECT 1 FROM label n WHERE n.uri = l.uri AND n.val = l.val AND n.seq > l.seq)
+		AND NOT EXISTS (
+			SELECT 1 FROM blocked_user b JOIN user u ON u.uid = b.uid WHERE u.did = substr(l.uri, 5)
+		)
+		ORDER BY l.seq`,
+		val,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uris []string
+	for rows.Next() {
+		var uri string
+		if err := rows.Scan(&uri); err != nil {
+			return nil, err
+		}
+		uris = append(uris, uri)
+	}
+	return uris, rows.Err()
+}
+
+// GetExpiringLabels returns active account labels of the value that expire before the time,
+// as long as their users are still blocked
+func (s *Service) GetExpiringLabels(val string, before time.Time) ([]Label, error) {
+	rows, err := s.rdb.Query(
+		"SELECT "+labelColumns+" FROM label l"+
+			" WHERE l.exp IS NOT NULL AND l.exp <= ? AND l.val = ? AND l.neg = 0 AND l.uri LIKE 'did:%'"+
+			" AND NOT EXISTS (SELECT 1 FROM label n WHERE n.uri = l.uri AND n.val = l.val AND n.seq > l.seq)"+
+			" AND EXISTS ("+
+			"  SELECT 1 FROM blocked_user b JOIN user u ON u.uid = b.uid WHERE u.did = substr(l.uri, 5)"+
+			" ) ORDER BY l.exp",
+		before.UnixMilli(), val,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanLabels(rows)
+}
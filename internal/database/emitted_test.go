@@ -0,0 +1,155 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// appendLabels appends labels with dummy signatures, returning their sequence numbers
+func appendLabels(t *testing.T, db *Service, labels ...Label) []int64 {
+	t.Helper()
+	seqs := make([]int64, len(labels))
+	for i := range labels {
+		label := labels[i]
+		label.Src = "did:plc:labeler"
+		label.Cts = time.Now().UnixMilli()
+		label.Sig = []byte("sig")
+		if err := db.AppendLabel(&label); err != nil {
+			t.Fatal(err)
+		}
+		seqs[i] = label.Seq
+	}
+	return seqs
+}
+
+func TestQueryLabels(t *testing.T) {
+	db := openTestDatabase(t)
+	appendLabels(t, db,
+		Label{Uri: "did:plc:aaa", Val: "offender"},
+		Label{Uri: "did:plc:bbb", Val: "offender"},
+		Label{Uri: "at://did:plc:aaa/app.bsky.feed.post/1", Cid: "cid", Val: "porn"},
+		Label{Uri: "did:plc:bbb", Val: "offender", Neg: true},
+		Label{Uri: "did:plc:a_c", Val: "offender"},
+		// supersedes the first one
+		Label{Uri: "did:plc:aaa", Val: "offender"},
+	)
+
+	tests := []struct {
+		name     string
+		patterns []string
+		cursor   int64
+		limit    int
+		seqs     []int64
+	}{
+		{name: "all", patterns: []string{"*"}, seqs: []int64{3, 5, 6}},
+		{name: "star wins", patterns: []string{"did:plc:none", "*"}, seqs: []int64{3, 5, 6}},
+		{name: "exact", patterns: []string{"did:plc:aaa"}, seqs: []int64{6}},
+		{name: "negated", patterns: []string{"did:plc:bbb"}},
+		{name: "several", patterns: []string{"did:plc:aaa", "did:plc:bbb"}, seqs: []int64{6}},
+		{name: "prefix", patterns: []string{"at://did:plc:aaa/*"}, seqs: []int64{3}},
+		{name: "underscore is literal", patterns: []string{"did:plc:a_*"}, seqs: []int64{5}},
+		{name: "percent is literal", patterns: []string{"did:plc:a%*"}},
+		{name: "star inside is literal", patterns: []string{"did:*:aaa"}},
+		{name: "cursor", patterns: []string{"*"}, cursor: 3, seqs: []int64{5, 6}},
+		{name: "limit", patterns: []string{"*"}, limit: 2, seqs: []int64{3, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limit := test.limit
+			if limit == 0 {
+				limit = 50
+			}
+			labels, err := db.QueryLabels(test.patterns, test.cursor, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var seqs []int64
+			for _, label := range labels {
+				seqs = append(seqs, label.Seq)
+			}
+			if !reflect.DeepEqual(seqs, test.seqs) {
+				t.Errorf("got labels %v, expected %v", seqs, test.seqs)
+			}
+		})
+	}
+
+	labels, err := db.QueryLabels([]string{"at://*"}, 0, 50)
+	if err != nil || len(labels) != 1 {
+		t.Fatalf("QueryLabels = %v, %v", labels, err)
+	}
+	label := labels[0]
+	if label.Cid != "cid" || label.Val != "porn" || label.Src != "did:plc:labeler" || string(label.Sig) != "sig" || label.Exp != 0 {
+		t.Errorf("label not read back as appended: %+v", label)
+	}
+}
+
+func TestLabelReconciliation(t *testing.T) {
+	db := openTestDatabase(t)
+	block := func(did string) {
+		t.Helper()
+		uid, err := db.GetUserId(did)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := db.InsertBlock(uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendLabels(t, db,
+		Label{Uri: "did:plc:aaa", Val: "offender"},
+		Label{Uri: "did:plc:bbb", Val: "offender"},
+		Label{Uri: "did:plc:bbb", Val: "offender", Neg: true},
+		Label{Uri: "did:plc:ccc", Val: "offender"},
+		Label{Uri: "at://did:plc:ddd/app.bsky.feed.post/1", Val: "offender"},
+		Label{Uri: "did:plc:ddd", Val: "other"},
+	)
+	block("did:plc:aaa")
+	block("did:plc:eee")
+	block("did:plc:bbb")
+
+	stale, err := db.GetStaleLabels("offender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stale, []string{"did:plc:ccc"}) {
+		t.Errorf("got stale labels %v, expected [did:plc:ccc]", stale)
+	}
+
+	unlabeled, err := db.GetUnlabeledBlocks("offender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dids []string
+	for _, block := range unlabeled {
+		dids = append(dids, block.CompactDid)
+	}
+	if !reflect.DeepEqual(dids, []string{"plc:eee", "plc:bbb"}) {
+		t.Errorf("got unlabeled blocks %v, expected [plc:eee plc:bbb]", dids)
+	}
+}
+
+func TestGetLabelsSince(t *testing.T) {
+	db := openTestDatabase(t)
+	appendLabels(t, db,
+		Label{Uri: "did:plc:aaa", Val: "offender"},
+		Label{Uri: "did:plc:aaa", Val: "offender", Neg: true},
+		Label{Uri: "did:plc:bbb", Val: "offender", Exp: 1234},
+	)
+	if seq, err := db.LastLabelSeq(); err != nil || seq != 3 {
+		t.Fatalf("LastLabelSeq = %d, %v, expected 3", seq, err)
+	}
+	labels, err := db.GetLabelsSince(1, 3, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 2 || labels[0].Seq != 2 || !labels[0].Neg || labels[1].Exp != 1234 {
+		t.Errorf("got labels %+v", labels)
+	}
+	if active, err := db.IsLabelActive("did:plc:aaa", "offender"); err != nil || active {
+		t.Errorf("IsLabelActive = %v, %v for a negated label", active, err)
+	}
+	if active, err := db.IsLabelActive("did:plc:bbb", "offender"); err != nil || !active {
+		t.Errorf("IsLabelActive = %v, %v, expected true", active, err)
+	}
+}
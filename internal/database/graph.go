@@ -0,0 +1,167 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// FollowEdge is the follow record Rkey of Src, which follows Dst, as DIDs without the "did:" prefix
+type FollowEdge struct {
+	Src  string
+	Rkey string
+	Dst  string
+}
+
+func (s *Service) prepareGraphStatements() error {
+	stmt, err := s.wdb.Prepare(
+		"INSERT INTO follow_edge (src, rkey, dst, cts) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING",
+	)
+	if err != nil {
+		return err
+	}
+	s.insertFollowStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT 1 FROM follow_edge WHERE src = (SELECT uid FROM user WHERE did = ?) AND rkey = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.followExistsStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"DELETE FROM follow_edge WHERE src = (SELECT uid FROM user WHERE did = ?) AND rkey = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.deleteFollowStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		`SELECT s.did, f.rkey, d.did FROM follow_edge f
+		JOIN user s ON s.uid = f.src
+		JOIN user d ON d.uid = f.dst`,
+	)
+	if err != nil {
+		return err
+	}
+	s.getFollowEdgesStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"INSERT INTO follow_backfill (uid, cts) VALUES (?, ?) ON CONFLICT DO NOTHING",
+	)
+	if err != nil {
+		return err
+	}
+	s.insertBackfillStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT u.did FROM follow_backfill b JOIN user u ON u.uid = b.uid",
+	)
+	if err != nil {
+		return err
+	}
+	s.getBackfillsStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"DELETE FROM follow_backfill WHERE uid = (SELECT uid FROM user WHERE did = ?)",
+	)
+	if err != nil {
+		return err
+	}
+	s.deleteBackfillStmt = stmt
+
+	return nil
+}
+
+// InsertFollow records the follow record rkey of src, which follows dst
+func (s *Service) InsertFollow(src int64, rkey string, dst int64) error {
+	_, err := s.insertFollowStmt.Exec(src, rkey, dst, time.Now().UnixMilli())
+	return err
+}
+
+// DeleteFollow removes the follow record rkey of the user, which takes a DID without "did:",
+// returning false if we do not have it
+func (s *Service) DeleteFollow(did string, rkey string) (bool, error) {
+	// most deleted follows are not ours, so check without taking the write lock first
+	var exists int
+	err := s.followExistsStmt.QueryRow(did, rkey).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	result, err := s.deleteFollowStmt.Exec(did, rkey)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected != 0, err
+}
+
+// GetFollowEdges returns all follows we have
+func (s *Service) GetFollowEdges() ([]FollowEdge, error) {
+	rows, err := s.getFollowEdgesStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var edges []FollowEdge
+	for rows.Next() {
+		var edge FollowEdge
+		if err := rows.Scan(&edge.Src, &edge.Rkey, &edge.Dst); err != nil {
+			return nil, err
+		}
+		edges = append(edges, edge)
+	}
+	return edges, rows.Err()
+}
+
+// DeleteFollows removes the follows, along with the backfill marks of the users,
+// which take DIDs without "did:"
+func (s *Service) DeleteFollows(edges []FollowEdge, users []string) error {
+	tx, err := s.wdb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	deleteFollow := tx.Stmt(s.deleteFollowStmt)
+	for _, edge := range edges {
+		if _, err := deleteFollow.Exec(edge.Src, edge.Rkey); err != nil {
+			return err
+		}
+	}
+	deleteBackfill := tx.Stmt(s.deleteBackfillStmt)
+	for _, did := range users {
+		if _, err := deleteBackfill.Exec(did); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// MarkBackfilled records that the follows of the user have been fetched
+func (s *Service) MarkBackfilled(uid int64) error {
+	_, err := s.insertBackfillStmt.Exec(uid, time.Now().UnixMilli())
+	return err
+}
+
+// GetBackfilled returns the users whose follows have been fetched, as DIDs without "did:"
+func (s *Service) GetBackfilled() (map[string]struct{}, error) {
+	rows, err := s.getBackfillsStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make(map[string]struct{})
+	for rows.Next() {
+		var did string
+		if err := rows.Scan(&did); err != nil {
+			return nil, err
+		}
+		users[did] = struct{}{}
+	}
+	return users, rows.Err()
+}
@@ -3,7 +3,9 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 )
 
 func (s *Service) prepareLabelStatements() error {
@@ -16,10 +18,28 @@ func (s *Service) prepareLabelStatements() error {
 	}
 	s.insertUserStmt = stmt
 
+	stmt, err = s.rdb.Prepare(
+		"SELECT did FROM user WHERE uid = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.getUserDidStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		`INSERT INTO upstream (did, weight) VALUES (?, ?)
+		ON CONFLICT (did) DO UPDATE SET weight = excluded.weight
+		RETURNING id`,
+	)
+	if err != nil {
+		return err
+	}
+	s.upsertUpstreamStmt = stmt
+
 	stmt, err = s.wdb.Prepare(
-		`INSERT INTO upstream_stats (uid, kind, count)
-			VALUES (?, ?, 1)
-		ON CONFLICT (uid, kind) DO UPDATE
+		`INSERT INTO upstream_stats (uid, kind, src, count)
+			VALUES (?, ?, ?, 1)
+		ON CONFLICT (uid, kind, src) DO UPDATE
 			SET count = count + 1
 		RETURNING count
 		`,
@@ -30,9 +50,9 @@ func (s *Service) prepareLabelStatements() error {
 	s.incrementCounterStmt = stmt
 
 	stmt, err = s.wdb.Prepare(
-		`INSERT INTO upstream_stats (uid, kind, count)
-			VALUES (?, ?, 10)
-		ON CONFLICT (uid, kind) DO UPDATE
+		`INSERT INTO upstream_stats (uid, kind, src, count)
+			VALUES (?, ?, ?, 10)
+		ON CONFLICT (uid, kind, src) DO UPDATE
 			SET count = count * 2 + 1
 		RETURNING count
 		`,
@@ -42,8 +62,99 @@ func (s *Service) prepareLabelStatements() error {
 	}
 	s.profileLabelPenaltyStmt = stmt
 
+	stmt, err = s.wdb.Prepare(
+		"UPDATE upstream_stats SET count = max(count - ?, 0) WHERE uid = ? AND kind = ? AND src = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.decrementCounterStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"SELECT count FROM upstream_stats WHERE uid = ? AND kind = ? AND src = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.getCounterStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"DELETE FROM upstream_stats WHERE uid = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.resetCountersStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"SELECT count(*) FROM upstream_label WHERE src = ? AND uri = ? AND val = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.upstreamLabelExistsStmt = stmt
+
+	// labels issued again come with a new expiration, or none
+	stmt, err = s.wdb.Prepare(
+		`INSERT INTO upstream_label (uid, src, uri, val, kind, delta, exp)
+			VALUES (?, ?, ?, ?, ?, 0, ?)
+		ON CONFLICT (src, uri, val) DO UPDATE SET exp = excluded.exp
+		RETURNING id
+		`,
+	)
+	if err != nil {
+		return err
+	}
+	s.insertUpstreamLabelStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"UPDATE upstream_label SET delta = ? WHERE id = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.setUpstreamLabelDeltaStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"UPDATE upstream_label SET delta = 0 WHERE uid = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.resetLabelDeltasStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"DELETE FROM upstream_label WHERE src = ? AND uri = ? AND val = ? RETURNING uid, kind, delta",
+	)
+	if err != nil {
+		return err
+	}
+	s.deleteUpstreamLabelStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		`DELETE FROM upstream_label WHERE id IN (
+			SELECT id FROM upstream_label WHERE exp <= ? LIMIT ?
+		) RETURNING uid, kind, delta, src`,
+	)
+	if err != nil {
+		return err
+	}
+	s.deleteExpiredLabelsStmt = stmt
+
 	stmt, err = s.rdb.Prepare(
-		"SELECT sum(count) FROM upstream_stats WHERE uid = ? GROUP BY uid",
+		`SELECT count(*) FROM upstream_label l
+			LEFT JOIN upstream u ON u.id = l.src
+		WHERE l.uid = ? AND l.uri LIKE 'did:%' AND coalesce(u.weight, 1) >= 1`,
+	)
+	if err != nil {
+		return err
+	}
+	s.hasAccountLabelStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		`SELECT CAST(sum(s.count * coalesce(u.weight, 1)) AS integer) FROM upstream_stats s
+			LEFT JOIN upstream u ON u.id = s.src
+		WHERE s.uid = ? GROUP BY s.uid`,
 	)
 	if err != nil {
 		return err
@@ -67,7 +178,7 @@ func (s *Service) prepareLabelStatements() error {
 	s.lastBlockIdStmt = stmt
 
 	stmt, err = s.rdb.Prepare(
-		"SELECT b.id, u.did FROM blocked_user b JOIN user u ON u.uid = b.uid WHERE b.id > ? AND b.id <= ?",
+		"SELECT b.id, u.did, b.cts FROM blocked_user b JOIN user u ON u.uid = b.uid WHERE b.id > ? AND b.id <= ?",
 	)
 	if err != nil {
 		return err
@@ -75,13 +186,21 @@ func (s *Service) prepareLabelStatements() error {
 	s.getBlockSinceStmt = stmt
 
 	stmt, err = s.wdb.Prepare(
-		"INSERT INTO blocked_user (uid) VALUES (?) ON CONFLICT (uid) DO UPDATE SET uid = uid RETURNING id",
+		"INSERT INTO blocked_user (uid, cts) VALUES (?, ?) ON CONFLICT (uid) DO NOTHING RETURNING id, cts",
 	)
 	if err != nil {
 		return err
 	}
 	s.insertBlockStmt = stmt
 
+	stmt, err = s.wdb.Prepare(
+		"DELETE FROM blocked_user WHERE uid = ? RETURNING id",
+	)
+	if err != nil {
+		return err
+	}
+	s.deleteBlockStmt = stmt
+
 	return nil
 }
 
@@ -95,16 +214,225 @@ func (s *Service) GetUserId(did string) (int64, error) {
 	return id, err
 }
 
-func (s *Service) IncrementCounter(uid int64, kind int) (int64, error) {
-	var count int64
-	err := s.incrementCounterStmt.QueryRow(uid, kind).Scan(&count)
-	return count, err
+func (s *Service) GetUserDid(uid int64) (string, error) {
+	var did string
+	err := s.getUserDidStmt.QueryRow(uid).Scan(&did)
+	return "did:" + did, err
+}
+
+// GetUpstreamId registers an upstream labeler and its trust weight
+func (s *Service) GetUpstreamId(did string, weight float64) (int64, error) {
+	var id int64
+	err := s.upsertUpstreamStmt.QueryRow(did, weight).Scan(&id)
+	return id, err
 }
 
-func (s *Service) MultiplyCounter(uid int64, kind int) (int64, error) {
+// HasLegacyUpstream tells if there are stats from before multiple upstreams were supported
+func (s *Service) HasLegacyUpstream() (bool, error) {
+	var exists bool
+	err := s.rdb.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM upstream_stats WHERE src = 0)" +
+			" OR EXISTS (SELECT 1 FROM upstream_label WHERE src = 0)",
+	).Scan(&exists)
+	return exists, err
+}
+
+// AdoptLegacyUpstream assigns stats from before multiple upstreams were
+// supported (which have src = 0) to the given upstream.
+func (s *Service) AdoptLegacyUpstream(src int64) error {
+	tx, err := s.wdb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Rows the upstream already has were counted over again from scratch, so they are kept instead.
+	for _, table := range []string{"upstream_stats", "upstream_label"} {
+		if _, err := tx.Exec("UPDATE OR IGNORE "+table+" SET src = ? WHERE src = 0", src); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM " + table + " WHERE src = 0"); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type CounterMode int
+
+const (
+	// CounterNone records the label without touching the counters
+	CounterNone CounterMode = iota
+	// CounterIncrement adds one to the counter
+	CounterIncrement
+	// CounterMultiply doubles the counter (used as a penalty for profile labels)
+	CounterMultiply
+)
+
+// UpstreamLabel is a label from the upstream that we have counted.
+//
+// We keep track of them so that negations and expirations can undo the counting.
+type UpstreamLabel struct {
+	Uid int64
+	// Src is the id of the upstream labeler, see GetUpstreamId
+	Src  int64
+	Uri  string
+	Val  string
+	Kind int
+	// Exp is the expiration time in unix milliseconds, or 0 if the label never expires
+	Exp int64
+}
+
+// CountUpstreamLabel records the label and updates the counter accordingly.
+//
+// It returns the updated counter and whether the label is new. Labels that
+// have already been counted are not counted twice, but take the expiration
+// of the label issued again.
+func (s *Service) CountUpstreamLabel(label *UpstreamLabel, mode CounterMode) (int64, bool, error) {
+	tx, err := s.wdb.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var exists int64
+	err = tx.Stmt(s.upstreamLabelExistsStmt).QueryRow(label.Src, label.Uri, label.Val).Scan(&exists)
+	if err != nil {
+		return 0, false, err
+	}
+	var exp any
+	if label.Exp != 0 {
+		exp = label.Exp
+	}
+	var id int64
+	err = tx.Stmt(s.insertUpstreamLabelStmt).
+		QueryRow(label.Uid, label.Src, label.Uri, label.Val, label.Kind, exp).
+		Scan(&id)
+	if err != nil {
+		return 0, false, err
+	}
+	if exists != 0 {
+		return 0, false, tx.Commit()
+	}
+
+	var stmt *sql.Stmt
+	switch mode {
+	case CounterIncrement:
+		stmt = s.incrementCounterStmt
+	case CounterMultiply:
+		stmt = s.profileLabelPenaltyStmt
+	default:
+		return 0, true, tx.Commit()
+	}
+
+	var before, count int64
+	err = tx.Stmt(s.getCounterStmt).QueryRow(label.Uid, label.Kind, label.Src).Scan(&before)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, false, err
+	}
+	if err := tx.Stmt(stmt).QueryRow(label.Uid, label.Kind, label.Src).Scan(&count); err != nil {
+		return 0, false, err
+	}
+	if _, err := tx.Stmt(s.setUpstreamLabelDeltaStmt).Exec(count-before, id); err != nil {
+		return 0, false, err
+	}
+	return count, true, tx.Commit()
+}
+
+// RetractUpstreamLabel undoes the counting of a previous label.
+//
+// It returns the uid of the labeled user, or 0 if the label was never counted.
+func (s *Service) RetractUpstreamLabel(src int64, uri string, val string) (int64, error) {
+	tx, err := s.wdb.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var uid, kind, delta int64
+	err = tx.Stmt(s.deleteUpstreamLabelStmt).QueryRow(src, uri, val).Scan(&uid, &kind, &delta)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if delta != 0 {
+		if _, err := tx.Stmt(s.decrementCounterStmt).Exec(delta, uid, kind, src); err != nil {
+			return 0, err
+		}
+	}
+	return uid, tx.Commit()
+}
+
+// RetractExpiredUpstreamLabels undoes the counting of at most limit expired labels.
+//
+// It returns the uids of the affected users.
+func (s *Service) RetractExpiredUpstreamLabels(now time.Time, limit int) ([]int64, error) {
+	tx, err := s.wdb.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	type retracted struct{ uid, kind, delta, src int64 }
+	var labels []retracted
+	err = func() error {
+		rows, err := tx.Stmt(s.deleteExpiredLabelsStmt).Query(now.UnixMilli(), limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var label retracted
+			if err := rows.Scan(&label.uid, &label.kind, &label.delta, &label.src); err != nil {
+				return err
+			}
+			labels = append(labels, label)
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	uids := make([]int64, 0, len(labels))
+	for _, label := range labels {
+		if label.delta != 0 {
+			if _, err := tx.Stmt(s.decrementCounterStmt).Exec(label.delta, label.uid, label.kind, label.src); err != nil {
+				return nil, err
+			}
+		}
+		if !slices.Contains(uids, label.uid) {
+			uids = append(uids, label.uid)
+		}
+	}
+	return uids, tx.Commit()
+}
+
+// ResetUpstreamCounts zeroes the counters of the user, e.g., once moderators unblock them,
+// so that only labels issued afterwards count.
+//
+// The labels counted so far are kept, so that they are not counted again when reissued,
+// but retracting them no longer undoes anything.
+func (s *Service) ResetUpstreamCounts(uid int64) error {
+	tx, err := s.wdb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Stmt(s.resetCountersStmt).Exec(uid); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(s.resetLabelDeltasStmt).Exec(uid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// HasAccountLabel checks if the user has an account-wise label from a fully trusted upstream
+func (s *Service) HasAccountLabel(uid int64) (bool, error) {
 	var count int64
-	err := s.profileLabelPenaltyStmt.QueryRow(uid, kind).Scan(&count)
-	return count, err
+	err := s.hasAccountLabelStmt.QueryRow(uid).Scan(&count)
+	return count > 0, err
 }
 
 func (s *Service) TotalCounts(uid int64) (int64, error) {
@@ -131,28 +459,51 @@ func (s *Service) IsUserBlocked(did string) (bool, error) {
 	return count > 0, err
 }
 
-func (s *Service) GetBlocksSince(from, to int64) ([]string, int64, error) {
+type BlockedUser struct {
+	Id         int64
+	CompactDid string
+	// Cts is the time the user was blocked, in unix milliseconds
+	Cts int64
+}
+
+func scanBlockedUsers(rows *sql.Rows) ([]BlockedUser, error) {
+	defer rows.Close()
+	var blocks []BlockedUser
+	for rows.Next() {
+		var block BlockedUser
+		if err := rows.Scan(&block.Id, &block.CompactDid, &block.Cts); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, rows.Err()
+}
+
+func (s *Service) GetBlocksSince(from, to int64) ([]BlockedUser, error) {
 	rows, err := s.getBlockSinceStmt.Query(from, to)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	defer rows.Close()
+	return scanBlockedUsers(rows)
+}
 
-	var dids []string
-	var id int64
-	for rows.Next() {
-		var did string
-		err := rows.Scan(&id, &did)
-		if err != nil {
-			return nil, 0, err
-		}
-		dids = append(dids, did)
+// InsertBlock blocks the user, returning the block id and the time the user was blocked.
+// The block id is 0 if the user was already blocked.
+func (s *Service) InsertBlock(uid int64) (int64, int64, error) {
+	var blockId, cts int64
+	err := s.insertBlockStmt.QueryRow(uid, time.Now().UnixMilli()).Scan(&blockId, &cts)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
 	}
-	return dids, id, rows.Err()
+	return blockId, cts, err
 }
 
-func (s *Service) InsertBlock(uid int64) (int64, error) {
+// DeleteBlock removes the user from the block list, returning false if the user was not blocked
+func (s *Service) DeleteBlock(uid int64) (bool, error) {
 	var blockId int64
-	err := s.insertBlockStmt.QueryRow(uid).Scan(&blockId)
-	return blockId, err
+	err := s.deleteBlockStmt.QueryRow(uid).Scan(&blockId)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
 }
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenewedUpstreamLabelOutlivesFormerExpiry(t *testing.T) {
+	db := openTestDatabase(t)
+	uid, err := db.GetUserId("did:plc:aaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := db.GetUpstreamId("did:plc:upstream", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	label := &UpstreamLabel{
+		Uid: uid,
+		Src: src,
+		Uri: "at://did:plc:aaa/app.bsky.feed.post/1",
+		Val: "spam",
+		Exp: now.Add(time.Minute).UnixMilli(),
+	}
+
+	count, counted, err := db.CountUpstreamLabel(label, CounterIncrement)
+	if err != nil || !counted || count != 1 {
+		t.Fatalf("CountUpstreamLabel = %d, %v, %v, expected 1, true", count, counted, err)
+	}
+	renewed := *label
+	renewed.Exp = now.Add(time.Hour).UnixMilli()
+	if _, counted, err := db.CountUpstreamLabel(&renewed, CounterIncrement); err != nil || counted {
+		t.Fatalf("renewing counted the label again: %v, %v", counted, err)
+	}
+
+	retracted, err := db.RetractExpiredUpstreamLabels(now.Add(2*time.Minute), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retracted) != 0 {
+		t.Errorf("renewed label retracted at its former expiry: %v", retracted)
+	}
+	if total, err := db.TotalCounts(uid); err != nil || total != 1 {
+		t.Errorf("TotalCounts = %d, %v, expected 1", total, err)
+	}
+
+	retracted, err = db.RetractExpiredUpstreamLabels(now.Add(2*time.Hour), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retracted) != 1 || retracted[0] != uid {
+		t.Errorf("got retracted users %v, expected [%d]", retracted, uid)
+	}
+	if total, err := db.TotalCounts(uid); err != nil || total != 0 {
+		t.Errorf("TotalCounts = %d, %v, expected 0", total, err)
+	}
+}
+
+func TestRenewedUpstreamLabelWithoutExpiry(t *testing.T) {
+	db := openTestDatabase(t)
+	uid, err := db.GetUserId("did:plc:aaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	label := &UpstreamLabel{
+		Uid: uid,
+		Src: 1,
+		Uri: "did:plc:aaa",
+		Val: "spam",
+		Exp: now.Add(time.Minute).UnixMilli(),
+	}
+	if _, _, err := db.CountUpstreamLabel(label, CounterIncrement); err != nil {
+		t.Fatal(err)
+	}
+	renewed := *label
+	renewed.Exp = 0
+	if _, _, err := db.CountUpstreamLabel(&renewed, CounterIncrement); err != nil {
+		t.Fatal(err)
+	}
+	retracted, err := db.RetractExpiredUpstreamLabels(now.Add(24*time.Hour), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retracted) != 0 {
+		t.Errorf("label renewed without expiry retracted: %v", retracted)
+	}
+	if total, err := db.TotalCounts(uid); err != nil || total != 1 {
+		t.Errorf("TotalCounts = %d, %v, expected 1", total, err)
+	}
+}
+
+func TestAdoptLegacyUpstream(t *testing.T) {
+	db := openTestDatabase(t)
+	alice, err := db.GetUserId("did:plc:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.GetUserId("did:plc:bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := db.GetUpstreamId("did:plc:upstream", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func(uid, src int64, uri string) {
+		t.Helper()
+		label := &UpstreamLabel{Uid: uid, Src: src, Uri: uri, Val: "spam"}
+		if _, _, err := db.CountUpstreamLabel(label, CounterIncrement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if legacy, err := db.HasLegacyUpstream(); err != nil || legacy {
+		t.Fatalf("HasLegacyUpstream = %v, %v on a new database", legacy, err)
+	}
+	// counted before multiple upstreams were supported
+	count(alice, 0, "at://did:plc:alice/app.bsky.feed.post/1")
+	count(bob, 0, "at://did:plc:bob/app.bsky.feed.post/1")
+	// counted over again by the upstream since
+	count(bob, src, "at://did:plc:bob/app.bsky.feed.post/1")
+	if legacy, err := db.HasLegacyUpstream(); err != nil || !legacy {
+		t.Fatalf("HasLegacyUpstream = %v, %v, expected true", legacy, err)
+	}
+
+	if err := db.AdoptLegacyUpstream(src); err != nil {
+		t.Fatalf("AdoptLegacyUpstream failed: %v", err)
+	}
+	if legacy, err := db.HasLegacyUpstream(); err != nil || legacy {
+		t.Errorf("HasLegacyUpstream = %v, %v after adoption", legacy, err)
+	}
+	for uid, expected := range map[int64]int64{alice: 1, bob: 1} {
+		if total, err := db.TotalCounts(uid); err != nil || total != expected {
+			t.Errorf("TotalCounts(%d) = %d, %v, expected %d", uid, total, err, expected)
+		}
+	}
+
+	// adopted labels are retracted through the upstream
+	uid, err := db.RetractUpstreamLabel(src, "at://did:plc:alice/app.bsky.feed.post/1", "spam")
+	if err != nil || uid != alice {
+		t.Errorf("RetractUpstreamLabel = %d, %v, expected %d", uid, err, alice)
+	}
+	if total, err := db.TotalCounts(alice); err != nil || total != 0 {
+		t.Errorf("TotalCounts = %d, %v after retraction, expected 0", total, err)
+	}
+}
+
+func TestResetUpstreamCounts(t *testing.T) {
+	db := openTestDatabase(t)
+	uid, err := db.GetUserId("did:plc:aaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.GetUserId("did:plc:bbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := db.GetUpstreamId("did:plc:upstream", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func(uid int64, uri string, mode CounterMode) (int64, bool) {
+		t.Helper()
+		count, counted, err := db.CountUpstreamLabel(&UpstreamLabel{Uid: uid, Src: src, Uri: uri, Val: "spam"}, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count, counted
+	}
+	total := func(uid int64) int64 {
+		t.Helper()
+		total, err := db.TotalCounts(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+	count(uid, "at://did:plc:aaa/app.bsky.feed.post/1", CounterIncrement)
+	count(uid, "at://did:plc:aaa/app.bsky.feed.post/2", CounterIncrement)
+	count(uid, "at://did:plc:aaa/app.bsky.actor.profile/self", CounterMultiply)
+	count(other, "at://did:plc:bbb/app.bsky.feed.post/1", CounterIncrement)
+
+	if err := db.ResetUpstreamCounts(uid); err != nil {
+		t.Fatal(err)
+	}
+	if got := total(uid); got != 0 {
+		t.Errorf("TotalCounts = %d after the reset, expected 0", got)
+	}
+	if got := total(other); got != 1 {
+		t.Errorf("TotalCounts = %d for another user, expected 1", got)
+	}
+
+	if _, counted := count(uid, "at://did:plc:aaa/app.bsky.feed.post/1", CounterIncrement); counted {
+		t.Error("label counted before the reset counted again")
+	}
+	if got, counted := count(uid, "at://did:plc:aaa/app.bsky.feed.post/3", CounterIncrement); !counted || got != 1 {
+		t.Errorf("new label counted as %d, %v, expected 1", got, counted)
+	}
+	if _, err := db.RetractUpstreamLabel(src, "at://did:plc:aaa/app.bsky.feed.post/2", "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if got := total(uid); got != 1 {
+		t.Errorf("TotalCounts = %d after retracting a label counted before the reset, expected 1", got)
+	}
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"time"
+)
+
+func (s *Service) prepareModerationStatements() error {
+	stmt, err := s.wdb.Prepare(
+		"INSERT INTO allowed_user (uid, cts) VALUES (?, ?) ON CONFLICT (uid) DO NOTHING",
+	)
+	if err != nil {
+		return err
+	}
+	s.insertAllowedUserStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT count(*) FROM allowed_user JOIN user ON user.uid = allowed_user.uid WHERE user.did = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.userAllowedStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT user.did FROM allowed_user JOIN user ON user.uid = allowed_user.uid",
+	)
+	if err != nil {
+		return err
+	}
+	s.getAllowedUsersStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"INSERT INTO pinned_post (uri, cts) VALUES (?, ?) ON CONFLICT (uri) DO NOTHING",
+	)
+	if err != nil {
+		return err
+	}
+	s.insertPinnedPostStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"DELETE FROM pinned_post WHERE uri = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.deletePinnedPostStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT uri FROM pinned_post ORDER BY id DESC",
+	)
+	if err != nil {
+		return err
+	}
+	s.getPinnedPostsStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"INSERT INTO muted_word (kind, value, cts) VALUES (?, ?, ?) ON CONFLICT (kind, value) DO NOTHING",
+	)
+	if err != nil {
+		return err
+	}
+	s.insertMutedWordStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT kind, value FROM muted_word",
+	)
+	if err != nil {
+		return err
+	}
+	s.getMutedWordsStmt = stmt
+
+	return nil
+}
+
+// AllowUser exempts the user from the internal block list
+func (s *Service) AllowUser(uid int64) error {
+	_, err := s.insertAllowedUserStmt.Exec(uid, time.Now().UnixMilli())
+	return err
+}
+
+func (s *Service) IsUserAllowed(did string) (bool, error) {
+	var count int64
+	err := s.userAllowedStmt.QueryRow(did).Scan(&count)
+	return count > 0, err
+}
+
+// GetAllowedUsers returns the DIDs (without "did:") of users exempted by moderators
+func (s *Service) GetAllowedUsers() ([]string, error) {
+	rows, err := s.getAllowedUsersStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var dids []string
+	for rows.Next() {
+		var did string
+		if err := rows.Scan(&did); err != nil {
+			return nil, err
+		}
+		dids = append(dids, did)
+	}
+	return dids, rows.Err()
+}
+
+// PinPost pins a post (in the compact "did/rkey" form) to the top of the feed
+func (s *Service) PinPost(uri string) error {
+	_, err := s.insertPinnedPostStmt.Exec(uri, time.Now().UnixMilli())
+	return err
+}
+
+func (s *Service) UnpinPost(uri string) error {
+	_, err := s.deletePinnedPostStmt.Exec(uri)
+	return err
+}
+
+// GetPinnedPosts returns pinned posts in the compact "did/rkey" form, the latest first
+func (s *Service) GetPinnedPosts() ([]string, error) {
+	rows, err := s.getPinnedPostsStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uris []string
+	for rows.Next() {
+		var uri string
+		if err := rows.Scan(&uri); err != nil {
+			return nil, err
+		}
+		uris = append(uris, uri)
+	}
+	return uris, rows.Err()
+}
+
+type MutedWordKind int
+
+const (
+	MutedTag MutedWordKind = iota
+	MutedKeyword
+)
+
+type MutedWord struct {
+	Kind  MutedWordKind
+	Value string
+}
+
+func (s *Service) MuteWord(kind MutedWordKind, value string) error {
+	_, err := s.insertMutedWordStmt.Exec(kind, value, time.Now().UnixMilli())
+	return err
+}
+
+func (s *Service) GetMutedWords() ([]MutedWord, error) {
+	rows, err := s.getMutedWordsStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var words []MutedWord
+	for rows.Next() {
+		var word MutedWord
+		if err := rows.Scan(&word.Kind, &word.Value); err != nil {
+			return nil, err
+		}
+		words = append(words, word)
+	}
+	return words, rows.Err()
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ModeratorRole decides which report commands a moderator may run,
+// with each role allowed to do everything lower roles can
+type ModeratorRole int
+
+const (
+	// RoleReviewer reviews the report queue and removes posts from the feed
+	RoleReviewer ModeratorRole = iota + 1
+	// RoleModerator also manages the block list, pinned posts and muted words
+	RoleModerator
+	// RoleAdmin also exempts users from automatic blocking
+	RoleAdmin
+)
+
+func (r ModeratorRole) String() string {
+	switch r {
+	case RoleReviewer:
+		return "reviewer"
+	case RoleModerator:
+		return "moderator"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+func ParseModeratorRole(s string) (ModeratorRole, error) {
+	switch s {
+	case "reviewer":
+		return RoleReviewer, nil
+	case "moderator":
+		return RoleModerator, nil
+	case "admin":
+		return RoleAdmin, nil
+	default:
+		return 0, fmt.Errorf("unknown role %q, expecting one of: admin, moderator, reviewer", s)
+	}
+}
+
+type Moderator struct {
+	Did  string
+	Role ModeratorRole
+	// Cts is the time the moderator was added, in unix milliseconds
+	Cts int64
+}
+
+func (s *Service) prepareModeratorStatements() error {
+	stmt, err := s.wdb.Prepare(
+		`INSERT INTO moderator (uid, role, cts) VALUES (?, ?, ?)
+		ON CONFLICT (uid) DO UPDATE SET role = excluded.role`,
+	)
+	if err != nil {
+		return err
+	}
+	s.upsertModeratorStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"DELETE FROM moderator WHERE uid = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.deleteModeratorStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT role FROM moderator JOIN user ON user.uid = moderator.uid WHERE user.did = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.getModeratorRoleStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		`SELECT 'did:' || user.did, role, cts FROM moderator
+		JOIN user ON user.uid = moderator.uid
+		ORDER BY role DESC, cts ASC`,
+	)
+	if err != nil {
+		return err
+	}
+	s.getModeratorsStmt = stmt
+
+	return nil
+}
+
+// SetModerator adds a moderator or changes their role
+func (s *Service) SetModerator(uid int64, role ModeratorRole) error {
+	_, err := s.upsertModeratorStmt.Exec(uid, role, time.Now().UnixMilli())
+	return err
+}
+
+func (s *Service) RemoveModerator(uid int64) (bool, error) {
+	result, err := s.deleteModeratorStmt.Exec(uid)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// GetModeratorRole returns the role of the user, or 0 if they are not a moderator
+func (s *Service) GetModeratorRole(did string) (ModeratorRole, error) {
+	var role ModeratorRole
+	err := s.getModeratorRoleStmt.QueryRow(did).Scan(&role)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return role, err
+}
+
+func (s *Service) GetModerators() ([]Moderator, error) {
+	rows, err := s.getModeratorsStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var moderators []Moderator
+	for rows.Next() {
+		var m Moderator
+		if err := rows.Scan(&m.Did, &m.Role, &m.Cts); err != nil {
+			return nil, err
+		}
+		moderators = append(moderators, m)
+	}
+	return moderators, rows.Err()
+}
@@ -0,0 +1,258 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+type ReportStatus int
+
+const (
+	ReportPending ReportStatus = iota
+	// ReportEscalated marks pending reports on accounts flagged by enough distinct reporters
+	ReportEscalated
+	ReportAccepted
+	ReportRejected
+	// ReportFailed marks moderator reports whose command failed
+	ReportFailed
+)
+
+func (s ReportStatus) String() string {
+	switch s {
+	case ReportPending:
+		return "pending"
+	case ReportEscalated:
+		return "escalated"
+	case ReportAccepted:
+		return "accepted"
+	case ReportRejected:
+		return "rejected"
+	case ReportFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+type Report struct {
+	Id int64
+	// Uid is the reported account
+	Uid int64
+	// Subject is the reported uri, either a DID or an at:// uri
+	Subject    string
+	Reporter   int64
+	ReasonType string
+	Reason     string
+	// Cts is the time the report was received, in unix milliseconds
+	Cts    int64
+	Status ReportStatus
+}
+
+// ReportView is a report with DIDs resolved, for listing
+type ReportView struct {
+	Report
+	ReporterDid string
+}
+
+func (s *Service) prepareReportStatements() error {
+	stmt, err := s.wdb.Prepare(
+		`INSERT INTO report (uid, subject, reporter, reason_type, reason, cts, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (reporter, subject) WHERE status < 2 DO NOTHING
+		RETURNING id`,
+	)
+	if err != nil {
+		return err
+	}
+	s.insertReportStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT count(*) FROM report WHERE reporter = ? AND cts >= ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.countRecentReportsStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT count(DISTINCT reporter) FROM report WHERE uid = ? AND reporter != ? AND status < 2",
+	)
+	if err != nil {
+		return err
+	}
+	s.countReportersStmt = stmt
+
+	stmt, err = s.wdb.Prepare(
+		"UPDATE report SET status = ? WHERE uid = ? AND status < 2",
+	)
+	if err != nil {
+		return err
+	}
+	s.updateReportsStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		`SELECT report.id, report.uid, subject, reporter, reason_type, reason, cts, status, 'did:' || user.did
+		FROM report JOIN user ON user.uid = report.reporter
+		WHERE status < 2
+		ORDER BY status DESC, report.id ASC
+		LIMIT ?`,
+	)
+	if err != nil {
+		return err
+	}
+	s.getOpenReportsStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT id FROM report WHERE reporter = ? AND subject = ? AND status < 2",
+	)
+	if err != nil {
+		return err
+	}
+	s.getOpenReportIdStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		`SELECT id, uid, subject, reporter, reason_type, reason, cts, status FROM report
+		WHERE reporter = ? AND id < ?
+		ORDER BY id DESC
+		LIMIT ?`,
+	)
+	if err != nil {
+		return err
+	}
+	s.getReportsByReporterStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		`SELECT id, uid, subject, reporter, reason_type, reason, cts, status FROM report
+		WHERE id = ? AND reporter = ?`,
+	)
+	if err != nil {
+		return err
+	}
+	s.getReportStmt = stmt
+
+	stmt, err = s.rdb.Prepare(
+		"SELECT count(*) FROM report WHERE reporter = ? AND subject = ?",
+	)
+	if err != nil {
+		return err
+	}
+	s.hasReportedStmt = stmt
+
+	return nil
+}
+
+// InsertReport queues a report, returning its id,
+// or 0 if the reporter already has an open report on the same subject
+func (s *Service) InsertReport(report *Report) (int64, error) {
+	var id int64
+	err := s.insertReportStmt.QueryRow(
+		report.Uid,
+		report.Subject,
+		report.Reporter,
+		report.ReasonType,
+		report.Reason,
+		report.Cts,
+		report.Status,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// GetOpenReportId returns the id of the open report of the reporter on the subject, or 0 if none
+func (s *Service) GetOpenReportId(reporter int64, subject string) (int64, error) {
+	var id int64
+	err := s.getOpenReportIdStmt.QueryRow(reporter, subject).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// GetReportsByReporter lists reports sent by the reporter before the cursor id, the latest first
+func (s *Service) GetReportsByReporter(reporter int64, cursor int64, limit int) ([]Report, error) {
+	rows, err := s.getReportsByReporterStmt.Query(reporter, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reports []Report
+	for rows.Next() {
+		var r Report
+		if err := rows.Scan(
+			&r.Id, &r.Uid, &r.Subject, &r.Reporter, &r.ReasonType, &r.Reason, &r.Cts, &r.Status,
+		); err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+// GetReport returns the report of the given id if it is sent by the reporter, or nil
+func (s *Service) GetReport(reporter int64, id int64) (*Report, error) {
+	var r Report
+	err := s.getReportStmt.QueryRow(id, reporter).Scan(
+		&r.Id, &r.Uid, &r.Subject, &r.Reporter, &r.ReasonType, &r.Reason, &r.Cts, &r.Status,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// HasReported tells if the reporter has ever reported the subject, whatever came of it
+func (s *Service) HasReported(reporter int64, subject string) (bool, error) {
+	var count int64
+	err := s.hasReportedStmt.QueryRow(reporter, subject).Scan(&count)
+	return count > 0, err
+}
+
+// CountRecentReports counts the reports sent by the reporter since the given time
+func (s *Service) CountRecentReports(reporter int64, since time.Time) (int64, error) {
+	var count int64
+	err := s.countRecentReportsStmt.QueryRow(reporter, since.UnixMilli()).Scan(&count)
+	return count, err
+}
+
+// CountReporters counts the distinct reporters with open reports on the account,
+// leaving out the except reporter (0 for none)
+func (s *Service) CountReporters(uid int64, except int64) (int64, error) {
+	var count int64
+	err := s.countReportersStmt.QueryRow(uid, except).Scan(&count)
+	return count, err
+}
+
+// UpdateReports sets the status of all open reports on the account,
+// returning how many were updated
+func (s *Service) UpdateReports(uid int64, status ReportStatus) (int64, error) {
+	result, err := s.updateReportsStmt.Exec(status, uid)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetOpenReports lists pending reports, escalated ones first
+func (s *Service) GetOpenReports(limit int) ([]ReportView, error) {
+	rows, err := s.getOpenReportsStmt.Query(limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reports []ReportView
+	for rows.Next() {
+		var r ReportView
+		if err := rows.Scan(
+			&r.Id, &r.Uid, &r.Subject, &r.Reporter, &r.ReasonType, &r.Reason, &r.Cts, &r.Status, &r.ReporterDid,
+		); err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCountReporters(t *testing.T) {
+	db := openTestDatabase(t)
+	uid := func(did string) int64 {
+		t.Helper()
+		id, err := db.GetUserId(did)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	offender, labeler := uid("did:plc:offender"), uid("did:plc:labeler")
+	report := func(reporter int64, subject string, status ReportStatus) {
+		t.Helper()
+		_, err := db.InsertReport(&Report{
+			Uid:      offender,
+			Subject:  subject,
+			Reporter: reporter,
+			Cts:      time.Now().UnixMilli(),
+			Status:   status,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	report(labeler, "did:plc:offender", ReportPending)
+	report(uid("did:plc:alice"), "did:plc:offender", ReportPending)
+	report(uid("did:plc:alice"), "at://did:plc:offender/app.bsky.feed.post/1", ReportEscalated)
+	report(uid("did:plc:bob"), "did:plc:offender", ReportRejected)
+
+	for _, test := range []struct {
+		except int64
+		count  int64
+	}{
+		{except: 0, count: 2},
+		{except: labeler, count: 1},
+	} {
+		count, err := db.CountReporters(offender, test.except)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != test.count {
+			t.Errorf("got %d reporters except %d, expected %d", count, test.except, test.count)
+		}
+	}
+}
@@ -7,22 +7,139 @@ CREATE TABLE user (
 
 CREATE UNIQUE INDEX user_did ON user (did);
 
+CREATE TABLE upstream (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  did text not null,
+  weight real not null
+);
+
+CREATE UNIQUE INDEX upstream_did ON upstream (did);
+
 CREATE TABLE upstream_stats (
   id integer PRIMARY KEY AUTOINCREMENT,
   uid integer not null,
   kind integer not null,
-  count integer not null
+  count integer not null,
+  src integer not null default 0
+);
+
+CREATE UNIQUE INDEX upstream_stats_uid_kind_src ON upstream_stats (uid, kind, src);
+
+CREATE TABLE upstream_label (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  uid integer not null,
+  uri text not null,
+  val text not null,
+  kind integer not null,
+  delta integer not null,
+  exp integer,
+  src integer not null default 0
 );
 
-CREATE UNIQUE INDEX block_list_uid_kind ON upstream_stats (uid, kind);
+CREATE UNIQUE INDEX upstream_label_src_uri_val ON upstream_label (src, uri, val);
+
+CREATE INDEX upstream_label_uid ON upstream_label (uid);
+
+CREATE INDEX upstream_label_exp ON upstream_label (exp) WHERE exp IS NOT NULL;
 
 CREATE TABLE blocked_user (
-  id integer PRIMARY KEY,
-  uid integer not null
+  id integer PRIMARY KEY AUTOINCREMENT,
+  uid integer not null,
+  cts integer not null default 0
 );
 
 CREATE UNIQUE INDEX blocked_user_uid_id ON blocked_user (uid);
 
+CREATE TABLE label (
+  seq integer PRIMARY KEY AUTOINCREMENT,
+  src text not null,
+  uri text not null,
+  cid text,
+  val text not null,
+  neg integer not null default 0,
+  cts integer not null,
+  exp integer,
+  sig blob not null
+);
+
+CREATE INDEX label_uri_val_seq ON label (uri, val, seq);
+
+CREATE INDEX label_exp ON label (exp) WHERE exp IS NOT NULL;
+
+CREATE TABLE allowed_user (
+  uid integer PRIMARY KEY,
+  cts integer not null
+);
+
+CREATE TABLE pinned_post (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  uri text not null,
+  cts integer not null
+);
+
+CREATE UNIQUE INDEX pinned_post_uri ON pinned_post (uri);
+
+CREATE TABLE muted_word (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  kind integer not null,
+  value text not null,
+  cts integer not null
+);
+
+CREATE UNIQUE INDEX muted_word_kind_value ON muted_word (kind, value);
+
+CREATE TABLE report (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  uid integer not null,
+  subject text not null,
+  reporter integer not null,
+  reason_type text not null,
+  reason text not null,
+  cts integer not null,
+  status integer not null default 0
+);
+
+CREATE UNIQUE INDEX report_reporter_subject ON report (reporter, subject) WHERE status < 2;
+
+CREATE INDEX report_uid ON report (uid);
+
+CREATE INDEX report_reporter_cts ON report (reporter, cts);
+
+CREATE TABLE moderator (
+  uid integer PRIMARY KEY,
+  role integer not null,
+  cts integer not null
+);
+
+CREATE TABLE moderation_action (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  actor text not null,
+  action text not null,
+  subject text not null,
+  reason text not null,
+  cts integer not null,
+  outcome text not null
+);
+
+CREATE INDEX moderation_action_actor ON moderation_action (actor);
+
+CREATE INDEX moderation_action_subject ON moderation_action (subject);
+
+CREATE TABLE follow_edge (
+  src integer not null,
+  rkey text not null,
+  dst integer not null,
+  cts integer not null,
+  PRIMARY KEY (src, rkey)
+) WITHOUT ROWID;
+
+CREATE INDEX follow_edge_dst ON follow_edge (dst);
+
+CREATE TABLE follow_backfill (
+  uid integer PRIMARY KEY,
+  cts integer not null
+);
+
 CREATE TABLE feed_list (
   id integer PRIMARY KEY AUTOINCREMENT,
   uri text not null,
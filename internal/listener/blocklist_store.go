@@ -0,0 +1,431 @@
+package listener
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// BlockListEntry is a row of the external block list,
+// in the "did,reason_type,reason" layout shared with the Python clusterer
+type BlockListEntry struct {
+	// Did is empty for handles not yet resolved
+	Did string
+	// Handle is set if the row names the user by handle instead of DID
+	Handle     string
+	ReasonType string
+	Reason     string
+	// Line is where the entry is in the file, or 0 if not yet written
+	Line int
+	// raw is the line as read, which is written back as is unless the entry changes.
+	// Lines that are not entries (comments, the header and malformed lines) only have raw set.
+	raw string
+}
+
+// key is the first column of the row, or empty if the line is not an entry
+func (e *BlockListEntry) key() string {
+	if e.Handle != "" {
+		return e.Handle
+	}
+	return e.Did
+}
+
+// BlockListLineError is a malformed line in the block list, which is skipped
+type BlockListLineError struct {
+	Line int
+	Err  error
+}
+
+func (e *BlockListLineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *BlockListLineError) Unwrap() error {
+	return e.Err
+}
+
+// merge folds a duplicate entry into e like the clusterer does, skipping reasons we already have
+func (e *BlockListEntry) merge(reasonType, reason string) {
+	before := *e
+	defer func() {
+		if e.ReasonType != before.ReasonType || e.Reason != before.Reason {
+			e.raw = ""
+		}
+	}()
+	if reason != "" {
+		if e.ReasonType != "" && reasonType != "" && reasonType != e.ReasonType {
+			reason = "(" + reasonType + ")" + reason
+		}
+		// skip the parts we already have
+		known := strings.Split(e.Reason, ",")
+		for _, part := range strings.Split(reason, ",") {
+			if part == "" || slices.Contains(known, part) {
+				continue
+			}
+			known = append(known, part)
+			if e.Reason != "" {
+				e.Reason += ","
+			}
+			e.Reason += part
+		}
+	}
+	if e.ReasonType == "" {
+		e.ReasonType = reasonType
+	}
+}
+
+func (e *BlockListEntry) record() []string {
+	if e.ReasonType == "" && e.Reason == "" {
+		return []string{e.key()}
+	}
+	return []string{e.key(), e.ReasonType, e.Reason}
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// blockListStore keeps the external block list in memory, deduplicated,
+// and writes it back as a whole by atomically replacing the file
+type blockListStore struct {
+	path string
+
+	lock    sync.Mutex
+	entries []*BlockListEntry
+	index   map[string]*BlockListEntry
+	// problems are the malformed lines found in the last load
+	problems []error
+	// stamp is the file as of our last load or write, to tell our own writes from external ones
+	stamp fileStamp
+}
+
+func newBlockListStore(path string) *blockListStore {
+	return &blockListStore{
+		path:  path,
+		index: make(map[string]*BlockListEntry),
+	}
+}
+
+// reload re-reads the file unless it is what we last loaded or wrote,
+// returning false if nothing changed
+func (s *blockListStore) reload() (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stamp, err := statFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	if stamp == s.stamp {
+		return false, nil
+	}
+	return true, s.load()
+}
+
+func (s *blockListStore) load() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stamp, err := statFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	entries, index, problems, err := readBlockList(f)
+	if err != nil {
+		return err
+	}
+	s.entries = entries
+	s.index = index
+	s.problems = problems
+	s.stamp = stamp
+	return nil
+}
+
+// readBlockList parses the block list line by line, merging duplicates. Malformed lines are
+// returned as BlockListLineError and kept as they are, along with comments (lines starting
+// with "#") and a leading "did,..." header row.
+func readBlockList(r io.Reader) ([]*BlockListEntry, map[string]*BlockListEntry, []error, error) {
+	var entries []*BlockListEntry
+	var problems []error
+	index := make(map[string]*BlockListEntry)
+	first := true
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		// ScanLines drops the "\r" of CRLF already
+		text := scanner.Text()
+		if line == 1 {
+			text = strings.TrimPrefix(text, "\uFEFF")
+		}
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "#") {
+			entries = append(entries, &BlockListEntry{Line: line, raw: text})
+			continue
+		}
+
+		id, _, _ := strings.Cut(text, ",")
+		isHeader := first && strings.EqualFold(strings.Trim(strings.TrimSpace(id), `"`), "did")
+		first = false
+		if isHeader {
+			entries = append(entries, &BlockListEntry{Line: line, raw: text})
+			continue
+		}
+		entry, err := parseBlockListLine(text)
+		if err != nil {
+			problems = append(problems, &BlockListLineError{Line: line, Err: err})
+			entries = append(entries, &BlockListEntry{Line: line, raw: text})
+			continue
+		}
+		entry.Line = line
+		entry.raw = text
+		if existing, ok := index[entry.key()]; ok {
+			existing.merge(entry.ReasonType, entry.Reason)
+			continue
+		}
+		entries = append(entries, entry)
+		index[entry.key()] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	return entries, index, problems, nil
+}
+
+// parseBlockListLine parses a line as CSV with lenient quotes, falling back to
+// taking the text up to the first comma as the DID or handle like we used to
+func parseBlockListLine(text string) (*BlockListEntry, error) {
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	if row, err := reader.Read(); err == nil && len(row) != 0 {
+		if entry, err := parseBlockListRow(row); err == nil {
+			return entry, nil
+		}
+	}
+	row := strings.Split(text, ",")
+	row[0] = strings.Trim(strings.TrimSpace(row[0]), `"`)
+	return parseBlockListRow(row)
+}
+
+// parseBlockListRow parses a row of "did or handle[,reason_type,reason]"
+func parseBlockListRow(row []string) (*BlockListEntry, error) {
+	id := strings.TrimSpace(row[0])
+	if id == "" {
+		return nil, fmt.Errorf("no DID or handle")
+	}
+	entry := &BlockListEntry{}
+	if strings.HasPrefix(id, "did:") {
+		did, err := syntax.ParseDID(id)
+		if err != nil {
+			return nil, err
+		}
+		entry.Did = did.String()
+	} else {
+		handle, err := syntax.ParseHandle(strings.TrimPrefix(id, "@"))
+		if err != nil {
+			return nil, fmt.Errorf("neither a DID nor a handle: %q", id)
+		}
+		entry.Handle = handle.Normalize().String()
+	}
+
+	if len(row) == 3 {
+		entry.ReasonType, entry.Reason = row[1], row[2]
+	} else if len(row) > 1 {
+		var parts []string
+		for _, part := range row[1:] {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		entry.Reason = strings.Join(parts, ",")
+	}
+	return entry, nil
+}
+
+// save writes the entries to a temporary file and renames it over the block list.
+//
+// Lines that are not entries are written back as they are, and so are
+// the lines of entries that have not changed.
+func (s *blockListStore) save() error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(s.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	buffered := bufio.NewWriter(tmp)
+	writer := csv.NewWriter(buffered)
+	for _, entry := range s.entries {
+		if entry.raw != "" {
+			writer.Flush()
+			if _, err := buffered.WriteString(entry.raw + "\n"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writer.Write(entry.record()); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	stamp, err := statFile(s.path)
+	if err != nil {
+		return err
+	}
+	s.stamp = stamp
+	return nil
+}
+
+// sync picks up external changes before we modify the file
+func (s *blockListStore) sync() error {
+	stamp, err := statFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.entries = nil
+		s.index = make(map[string]*BlockListEntry)
+		s.problems = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stamp != s.stamp {
+		return s.load()
+	}
+	return nil
+}
+
+// add appends or merges entries, returning how many were new
+func (s *blockListStore) add(entries ...BlockListEntry) (int, error) {
+	if s.path == "" {
+		return 0, fmt.Errorf("EXTERNAL_BLOCK_LIST is not set")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.sync(); err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, entry := range entries {
+		if existing, ok := s.index[entry.key()]; ok {
+			existing.merge(entry.ReasonType, entry.Reason)
+			continue
+		}
+		e := entry
+		e.Line = 0
+		e.raw = ""
+		s.entries = append(s.entries, &e)
+		s.index[e.key()] = &e
+		added++
+	}
+	return added, s.save()
+}
+
+// remove drops the entry of the DID, returning false if it is not in the list
+func (s *blockListStore) remove(did string) (bool, error) {
+	if s.path == "" {
+		return false, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.sync(); err != nil {
+		return false, err
+	}
+
+	if _, ok := s.index[did]; !ok {
+		return false, nil
+	}
+	delete(s.index, did)
+	for i, entry := range s.entries {
+		if entry.key() == did {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			break
+		}
+	}
+	return true, s.save()
+}
+
+// snapshot copies the entries and the problems of the last load
+func (s *blockListStore) snapshot() ([]BlockListEntry, []error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entries := make([]BlockListEntry, 0, len(s.index))
+	for _, entry := range s.entries {
+		if entry.key() != "" {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, slices.Clone(s.problems)
+}
+
+// ImportBlockList merges the entries of a CSV file into the block list file,
+// returning how many users were new
+func ImportBlockList(blockListPath, csvPath string) (int, error) {
+	f, err := os.Open(csvPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	entries, _, problems, err := readBlockList(f)
+	if err != nil {
+		return 0, err
+	}
+	if len(problems) != 0 {
+		return 0, errors.Join(problems...)
+	}
+	var imported []BlockListEntry
+	for _, entry := range entries {
+		if entry.key() != "" {
+			imported = append(imported, *entry)
+		}
+	}
+	return newBlockListStore(blockListPath).add(imported...)
+}
@@ -0,0 +1,188 @@
+package listener
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadBlockList(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		entries  []BlockListEntry
+		problems []int
+	}{
+		{
+			name:    "plain",
+			input:   "did:plc:aaa\ndid:plc:bbb,spam,bot\n",
+			entries: []BlockListEntry{{Did: "did:plc:aaa", Line: 1}, {Did: "did:plc:bbb", ReasonType: "spam", Reason: "bot", Line: 2}},
+		},
+		{
+			name:    "BOM and header",
+			input:   "\uFEFFdid,reason_type,reason\ndid:plc:aaa,spam,bot\n",
+			entries: []BlockListEntry{{Did: "did:plc:aaa", ReasonType: "spam", Reason: "bot", Line: 2}},
+		},
+		{
+			name:    "BOM without header",
+			input:   "\uFEFFdid:plc:aaa\n",
+			entries: []BlockListEntry{{Did: "did:plc:aaa", Line: 1}},
+		},
+		{
+			name:    "CRLF",
+			input:   "did:plc:aaa,spam,bot\r\ndid:plc:bbb\r\n",
+			entries: []BlockListEntry{{Did: "did:plc:aaa", ReasonType: "spam", Reason: "bot", Line: 1}, {Did: "did:plc:bbb", Line: 2}},
+		},
+		{
+			name:    "comments and blank lines",
+			input:   "# blocked by hand\n\n  # indented\ndid:plc:aaa\n",
+			entries: []BlockListEntry{{Did: "did:plc:aaa", Line: 4}},
+		},
+		{
+			name:  "handles",
+			input: "@Alice.BSKY.social,spam,bot\nbob.example.com\n",
+			entries: []BlockListEntry{
+				{Handle: "alice.bsky.social", ReasonType: "spam", Reason: "bot", Line: 1},
+				{Handle: "bob.example.com", Line: 2},
+			},
+		},
+		{
+			name:    "quoted fields",
+			input:   `"did:plc:aaa","spam","a, b"` + "\n",
+			entries: []BlockListEntry{{Did: "did:plc:aaa", ReasonType: "spam", Reason: "a, b", Line: 1}},
+		},
+		{
+			name:  "bare quotes",
+			input: "did:plc:aaa,spam,he said \"hi\"\n\"did:plc:bbb,spam,\"unterminated\n",
+			entries: []BlockListEntry{
+				{Did: "did:plc:aaa", ReasonType: "spam", Reason: `he said "hi"`, Line: 1},
+				{Did: "did:plc:bbb", ReasonType: "spam", Reason: `"unterminated`, Line: 2},
+			},
+		},
+		{
+			name:    "extra fields",
+			input:   "did:plc:aaa,a,,b,c\n",
+			entries: []BlockListEntry{{Did: "did:plc:aaa", Reason: "a,b,c", Line: 1}},
+		},
+		{
+			name:     "malformed lines",
+			input:    "did:plc:aaa\nnot a did!\n\ndid:\n,spam\ndid:plc:bbb\n",
+			entries:  []BlockListEntry{{Did: "did:plc:aaa", Line: 1}, {Did: "did:plc:bbb", Line: 6}},
+			problems: []int{2, 4, 5},
+		},
+		{
+			name:    "duplicates",
+			input:   "did:plc:aaa,spam,a\ndid:plc:bbb\ndid:plc:aaa,spam,b\n",
+			entries: []BlockListEntry{{Did: "did:plc:aaa", ReasonType: "spam", Reason: "a,b", Line: 1}, {Did: "did:plc:bbb", Line: 2}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows, _, problems, err := readBlockList(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatalf("readBlockList failed: %v", err)
+			}
+			var entries []BlockListEntry
+			for _, row := range rows {
+				if row.key() != "" {
+					entry := *row
+					entry.raw = ""
+					entries = append(entries, entry)
+				}
+			}
+			if !reflect.DeepEqual(entries, test.entries) {
+				t.Errorf("got entries %+v, expected %+v", entries, test.entries)
+			}
+			var lines []int
+			for _, problem := range problems {
+				var lineErr *BlockListLineError
+				if !errors.As(problem, &lineErr) {
+					t.Fatalf("unexpected problem %v", problem)
+				}
+				lines = append(lines, lineErr.Line)
+			}
+			if !reflect.DeepEqual(lines, test.problems) {
+				t.Errorf("got problems on lines %v, expected %v", lines, test.problems)
+			}
+		})
+	}
+}
+
+func TestParseBlockListRow(t *testing.T) {
+	tests := []struct {
+		row     []string
+		entry   *BlockListEntry
+		wantErr bool
+	}{
+		{row: []string{"did:plc:aaa"}, entry: &BlockListEntry{Did: "did:plc:aaa"}},
+		{row: []string{" did:web:example.com "}, entry: &BlockListEntry{Did: "did:web:example.com"}},
+		{row: []string{"did:plc:aaa", "spam", "bot"}, entry: &BlockListEntry{Did: "did:plc:aaa", ReasonType: "spam", Reason: "bot"}},
+		{row: []string{"did:plc:aaa", "note"}, entry: &BlockListEntry{Did: "did:plc:aaa", Reason: "note"}},
+		{row: []string{"did:plc:aaa", "a", "", "b"}, entry: &BlockListEntry{Did: "did:plc:aaa", Reason: "a,b"}},
+		{row: []string{"@Alice.BSKY.social"}, entry: &BlockListEntry{Handle: "alice.bsky.social"}},
+		{row: []string{""}, wantErr: true},
+		{row: []string{"did:"}, wantErr: true},
+		{row: []string{"not a did"}, wantErr: true},
+		{row: []string{"did:plc:aaa bbb"}, wantErr: true},
+	}
+	for _, test := range tests {
+		entry, err := parseBlockListRow(test.row)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseBlockListRow(%q) = %+v, expected an error", test.row, entry)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBlockListRow(%q) failed: %v", test.row, err)
+			continue
+		}
+		if !reflect.DeepEqual(entry, test.entry) {
+			t.Errorf("parseBlockListRow(%q) = %+v, expected %+v", test.row, entry, test.entry)
+		}
+	}
+}
+
+func TestBlockListStoreKeepsLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.csv")
+	original := "did,reason_type,reason\n" +
+		"# blocked by hand\n" +
+		"did:plc:aaa , spam,he said \"hi\"\n" +
+		"not a did!\n" +
+		"did:plc:bbb,spam,a\n"
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newBlockListStore(path)
+	if _, err := store.add(
+		BlockListEntry{Did: "did:plc:bbb", ReasonType: "spam", Reason: "b"},
+		BlockListEntry{Did: "did:plc:ccc"},
+	); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if _, err := store.remove("did:plc:zzz"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "did,reason_type,reason\n" +
+		"# blocked by hand\n" +
+		"did:plc:aaa , spam,he said \"hi\"\n" +
+		"not a did!\n" +
+		"did:plc:bbb,spam,\"a,b\"\n" +
+		"did:plc:ccc\n"
+	if string(content) != expected {
+		t.Errorf("got\n%s\nexpected\n%s", content, expected)
+	}
+
+	entries, problems := store.snapshot()
+	if len(entries) != 3 || len(problems) != 1 {
+		t.Errorf("got %d entries and %d problems, expected 3 and 1", len(entries), len(problems))
+	}
+}
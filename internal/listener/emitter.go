@@ -0,0 +1,365 @@
+package listener
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/database"
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/util/labels"
+)
+
+// LabelEmitter signs the labels we issue, appends them to the label log
+// and streams them to subscribers.
+//
+// The sequence numbers of the log are used as subscribeLabels cursors.
+type LabelEmitter struct {
+	db   *database.Service
+	subs []*labelSubscriber
+	// lock is held exclusively when emitting so that subscribers
+	// receive labels in the order of their sequence numbers
+	lock sync.RWMutex
+	last atomic.Int64
+	log  *slog.Logger
+	// legacyCursor is the last block id handed out as a cursor before the label log existed
+	legacyCursor int64
+}
+
+type labelSubscriber struct {
+	out    chan *database.Label
+	lagged chan bool
+	since  int64
+}
+
+func NewLabelEmitter(logger *slog.Logger) (*LabelEmitter, error) {
+	db := database.Instance()
+	latest, err := db.LastLabelSeq()
+	if err != nil {
+		return nil, err
+	}
+	legacyCursor, err := db.GetConfigInt("legacy-label-cursor", 0)
+	if err != nil {
+		return nil, err
+	}
+	emitter := &LabelEmitter{
+		db:           db,
+		log:          logger,
+		legacyCursor: legacyCursor,
+	}
+	emitter.last.Store(latest)
+	if !config.PublishLabels {
+		// the log is left as is until labels are published
+		return emitter, nil
+	}
+	if err := emitter.resign(); err != nil {
+		return nil, err
+	}
+	if err := emitter.reconcile(); err != nil {
+		return nil, err
+	}
+	return emitter, nil
+}
+
+// resign re-emits active labels with the current key if the signing key has been rotated
+func (e *LabelEmitter) resign() error {
+	pubKey, err := at_utils.KeyP256.PublicKey()
+	if err != nil {
+		return err
+	}
+	current := pubKey.DIDKey()
+	signedBy, err := e.db.GetConfig("label-signing-key", "")
+	if err != nil {
+		return err
+	}
+	if signedBy == current {
+		return nil
+	}
+
+	if signedBy != "" {
+		e.log.Info("signing key rotated, re-signing active labels", "previous", signedBy, "current", current)
+		latest := e.Latest()
+		now := time.Now().UnixMilli()
+		cursor := int64(0)
+		count := 0
+		for cursor < latest {
+			active, err := e.db.QueryLabels([]string{"*"}, cursor, labelCatchUpBatch)
+			if err != nil {
+				return err
+			}
+			if len(active) == 0 {
+				break
+			}
+			for _, label := range active {
+				cursor = label.Seq
+				if cursor > latest {
+					// re-signed ones
+					break
+				}
+				if label.Exp != 0 && label.Exp < now {
+					continue
+				}
+				_, err := e.emit(&database.Label{
+					Uri: label.Uri,
+					Cid: label.Cid,
+					Val: label.Val,
+					Cts: label.Cts,
+					Exp: label.Exp,
+				}, false)
+				if err != nil {
+					return err
+				}
+				count++
+			}
+		}
+		e.log.Info("active labels re-signed", "count", count)
+	}
+	return e.db.SetConfig("label-signing-key", current)
+}
+
+// reconcile labels blocked users that are not labeled yet, including those
+// blocked before the label log existed, and negates labels of users that
+// are no longer blocked.
+func (e *LabelEmitter) reconcile() error {
+	blocks, err := e.db.GetUnlabeledBlocks(at_utils.LabelOffenderString)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if _, err := e.Emit("did:"+block.CompactDid, at_utils.LabelOffenderString, false, block.Cts); err != nil {
+			return err
+		}
+	}
+
+	stale, err := e.db.GetStaleLabels(at_utils.LabelOffenderString)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	for _, uri := range stale {
+		if _, err := e.Emit(uri, at_utils.LabelOffenderString, true, now); err != nil {
+			return err
+		}
+	}
+
+	if len(blocks) != 0 || len(stale) != 0 {
+		e.log.Info("label log reconciled", "labeled", len(blocks), "negated", len(stale))
+	}
+	return nil
+}
+
+// Emit signs a label (or a negation) and appends it to the label log.
+//
+// Labels of values with a configured expiry expire that long after they are emitted.
+func (e *LabelEmitter) Emit(uri string, val string, neg bool, cts int64) (*database.Label, error) {
+	return e.emit(&database.Label{
+		Uri: uri,
+		Val: val,
+		Neg: neg,
+		Cts: cts,
+	}, false)
+}
+
+// EmitPostLabel labels a post, skipping it if the post is already labeled with the value
+func (e *LabelEmitter) EmitPostLabel(uri string, cid string, val string) {
+	label, err := e.emit(&database.Label{
+		Uri: uri,
+		Cid: cid,
+		Val: val,
+		Cts: time.Now().UnixMilli(),
+	}, true)
+	if err != nil {
+		e.log.Error("failed to emit post label", "uri", uri, "val", val, "err", err)
+	} else if label != nil {
+		e.log.Debug("post labeled", "uri", uri, "val", val)
+	}
+}
+
+// emit returns nil without emitting anything if dedupe is set and the label is already active.
+//
+// The expiry of the label is left as is if already set.
+func (e *LabelEmitter) emit(label *database.Label, dedupe bool) (*database.Label, error) {
+	label.Src = at_utils.UserDid.String()
+	if expiry, ok := config.LabelExpiry[label.Val]; ok && !label.Neg && label.Exp == 0 {
+		label.Exp = time.Now().Add(expiry).UnixMilli()
+	}
+	signed, err := at_utils.SignLabel(unsignedLabel(label))
+	if err != nil {
+		return nil, err
+	}
+	label.Sig = signed.Sig
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if dedupe {
+		active, err := e.db.IsLabelActive(label.Uri, label.Val)
+		if err != nil || active {
+			return nil, err
+		}
+	}
+	if err := e.db.AppendLabel(label); err != nil {
+		return nil, err
+	}
+	e.last.Store(label.Seq)
+	for _, sub := range e.subs {
+		sub.send(label)
+	}
+	return label, nil
+}
+
+// TranslateCursor maps a cursor from before the label log existed, which is a block id,
+// to the start of the log. Replaying the whole log sends labels the consumer already has
+// again, which is harmless, instead of skipping some.
+func (e *LabelEmitter) TranslateCursor(cursor int64) int64 {
+	if cursor > 0 && cursor <= e.legacyCursor {
+		e.log.Info("replaying the label log for a legacy cursor", "cursor", cursor)
+		return 0
+	}
+	return cursor
+}
+
+// Latest returns the sequence number of the latest label
+func (e *LabelEmitter) Latest() int64 {
+	return e.last.Load()
+}
+
+func unsignedLabel(label *database.Label) *labels.UnsignedLabel {
+	unsigned := &labels.UnsignedLabel{
+		Cts: time.UnixMilli(label.Cts).UTC().Format(syntax.AtprotoDatetimeLayout),
+		Src: label.Src,
+		// TODO: What on earth? `did:` is not a valid URI and the spec requires one,
+		//   and yet Bluesky AppView expects it to be there?
+		Uri: label.Uri,
+		Val: label.Val,
+		Ver: &at_utils.AtProtoVersion,
+	}
+	if label.Cid != "" {
+		unsigned.Cid = &label.Cid
+	}
+	if label.Neg {
+		neg := true
+		unsigned.Neg = &neg
+	}
+	if label.Exp != 0 {
+		exp := time.UnixMilli(label.Exp).UTC().Format(syntax.AtprotoDatetimeLayout)
+		unsigned.Exp = &exp
+	}
+	return unsigned
+}
+
+// LabelToLexicon converts a label from the log back to what we have signed
+func LabelToLexicon(label *database.Label) *atproto.LabelDefs_Label {
+	unsigned := unsignedLabel(label)
+	return &atproto.LabelDefs_Label{
+		Sig: label.Sig,
+		Cid: unsigned.Cid,
+		Cts: unsigned.Cts,
+		Exp: unsigned.Exp,
+		Neg: unsigned.Neg,
+		Src: unsigned.Src,
+		Uri: unsigned.Uri,
+		Val: unsigned.Val,
+		Ver: unsigned.Ver,
+	}
+}
+
+func (e *LabelEmitter) subscribe() *labelSubscriber {
+	sub := &labelSubscriber{
+		out:    make(chan *database.Label, 10),
+		lagged: make(chan bool, 1),
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.subs = append(e.subs, sub)
+	sub.since = e.last.Load()
+	return sub
+}
+
+func (e *LabelEmitter) unsubscribe(sub *labelSubscriber) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for i, s := range e.subs {
+		if s == sub {
+			e.subs[i] = e.subs[len(e.subs)-1]
+			e.subs = e.subs[:len(e.subs)-1]
+			break
+		}
+	}
+}
+
+func (sub *labelSubscriber) send(label *database.Label) {
+	select {
+	case sub.out <- label:
+	default:
+		select {
+		case sub.lagged <- true:
+		default:
+		}
+	}
+}
+
+const labelCatchUpBatch = 1000
+
+// ForAllLabelsSince replays labels after the cursor from the log and then
+// streams new labels, until the context is done or fn returns an error
+func (e *LabelEmitter) ForAllLabelsSince(ctx context.Context, since int64, fn func(label *database.Label) error) error {
+	for {
+		sub := e.subscribe()
+		if latest := sub.since; latest > since {
+			e.unsubscribe(sub)
+			for since < latest {
+				batch, err := e.db.GetLabelsSince(since, latest, labelCatchUpBatch)
+				if err != nil {
+					return err
+				}
+				if len(batch) == 0 {
+					break
+				}
+				for i := range batch {
+					if err := fn(&batch[i]); err != nil {
+						return err
+					}
+				}
+				since = batch[len(batch)-1].Seq
+				if err := ctx.Err(); err != nil {
+					return nil
+				}
+			}
+			since = latest
+			continue
+		}
+
+		lagged, err := e.forAllLive(ctx, sub, &since, fn)
+		e.unsubscribe(sub)
+		if !lagged {
+			return err
+		}
+		e.log.Debug("label subscriber lagged behind, catching up again", "since", since)
+	}
+}
+
+func (e *LabelEmitter) forAllLive(
+	ctx context.Context,
+	sub *labelSubscriber,
+	since *int64,
+	fn func(label *database.Label) error,
+) (bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case <-sub.lagged:
+			return true, nil
+		case label := <-sub.out:
+			if err := fn(label); err != nil {
+				return false, err
+			}
+			*since = label.Seq
+		}
+	}
+}
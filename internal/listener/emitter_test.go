@@ -0,0 +1,96 @@
+package listener
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/database"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// publishLabels turns on publishing with a fresh signing key for the test
+func publishLabels(t *testing.T) {
+	t.Helper()
+	key, err := crypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish, previousKey, previousDid := config.PublishLabels, at_utils.KeyP256, at_utils.UserDid
+	t.Cleanup(func() {
+		config.PublishLabels, at_utils.KeyP256, at_utils.UserDid = publish, previousKey, previousDid
+	})
+	config.PublishLabels = true
+	at_utils.KeyP256 = key
+	at_utils.UserDid = syntax.DID("did:plc:labeler")
+}
+
+func TestTranslateCursor(t *testing.T) {
+	emitter := &LabelEmitter{log: discardLogger(), legacyCursor: 5}
+	for cursor, expected := range map[int64]int64{0: 0, 1: 0, 5: 0, 6: 6, 100: 100} {
+		if got := emitter.TranslateCursor(cursor); got != expected {
+			t.Errorf("TranslateCursor(%d) = %d, expected %d", cursor, got, expected)
+		}
+	}
+
+	// without legacy cursors, all cursors are sequence numbers
+	emitter.legacyCursor = 0
+	if got := emitter.TranslateCursor(3); got != 3 {
+		t.Errorf("TranslateCursor(3) = %d without legacy cursors", got)
+	}
+}
+
+func TestEmitterReplaysThenStreams(t *testing.T) {
+	openTestDatabase(t)
+	publishLabels(t)
+	emitter, err := NewLabelEmitter(discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	emit := func(did string, neg bool) {
+		t.Helper()
+		if _, err := emitter.Emit(did, at_utils.LabelOffenderString, neg, time.Now().UnixMilli()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	emit("did:plc:aaa", false)
+	emit("did:plc:bbb", false)
+	emit("did:plc:aaa", true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stop := errors.New("stop")
+	var seqs []int64
+	replayed := make(chan bool)
+	result := make(chan error, 1)
+	go func() {
+		result <- emitter.ForAllLabelsSince(ctx, 1, func(label *database.Label) error {
+			seqs = append(seqs, label.Seq)
+			if label.Seq == 3 {
+				replayed <- true
+			}
+			if label.Seq == 4 {
+				return stop
+			}
+			return nil
+		})
+	}()
+	select {
+	case <-replayed:
+	case <-ctx.Done():
+		t.Fatal("labels not replayed")
+	}
+	// streamed live, or replayed if not subscribed yet
+	emit("did:plc:ccc", false)
+	if err := <-result; !errors.Is(err, stop) {
+		t.Errorf("got %v, expected the error of the callback", err)
+	}
+	if !reflect.DeepEqual(seqs, []int64{2, 3, 4}) {
+		t.Errorf("got labels %v, expected [2 3 4]", seqs)
+	}
+}
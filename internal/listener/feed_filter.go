@@ -1,13 +1,17 @@
 package listener
 
 import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/database"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"regexp"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode"
 
@@ -177,6 +181,60 @@ func ContainsAnyText(texts ...string) feedFilter {
 	}
 }
 
+type mutedWords struct {
+	tags     map[string]struct{}
+	keywords []string
+}
+
+var muted atomic.Pointer[mutedWords]
+
+// ReloadMutedWords loads tags and keywords muted by moderators for IsNotMuted
+func ReloadMutedWords(db *database.Service) error {
+	words, err := db.GetMutedWords()
+	if err != nil {
+		return err
+	}
+	m := &mutedWords{
+		tags: make(map[string]struct{}),
+	}
+	for _, word := range words {
+		value := normalizeText(word.Value)
+		switch word.Kind {
+		case database.MutedTag:
+			m.tags[value] = struct{}{}
+		case database.MutedKeyword:
+			m.keywords = append(m.keywords, value)
+		}
+	}
+	muted.Store(m)
+	return nil
+}
+
+// IsNotMuted filters out posts with tags or keywords muted through moderator reports.
+// Tags must be extracted first with ExtractTags.
+func IsNotMuted(post *bsky.FeedPost, _ *models.Event) bool {
+	m := muted.Load()
+	if m == nil {
+		return true
+	}
+	if len(m.tags) != 0 {
+		for _, t := range post.Tags {
+			if _, ok := m.tags[normalizeText(t)]; ok {
+				return false
+			}
+		}
+	}
+	if len(m.keywords) != 0 {
+		text := normalizeText(post.Text)
+		for _, keyword := range m.keywords {
+			if strings.Contains(text, keyword) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func RateLimit(burst int, every time.Duration) feedFilter {
 	recentUsers, _ := lru.New[string, *rate.Limiter](1024)
 	return func(post *bsky.FeedPost, event *models.Event) bool {
@@ -204,10 +262,11 @@ type nsfwVitResult struct {
 func NsfwVitFilter(upstream string, nsfwThreshold, minDiff float64, maxConns int) costlyfeedFilter {
 	nsfwLogger := slog.Default().WithGroup("nsfw-vit")
 	limit := semaphore.NewWeighted(int64(maxConns))
-	return func(ctx context.Context, post *bsky.FeedPost, did string) bool {
+	return func(ctx context.Context, post *bsky.FeedPost, event *models.Event) bool {
 		if post.Embed == nil || post.Embed.EmbedImages == nil {
 			return true
 		}
+		did := event.Did
 		images := post.Embed.EmbedImages.Images
 		imageUrls := make([]string, len(images))
 		for i, img := range post.Embed.EmbedImages.Images {
@@ -258,6 +317,59 @@ func NsfwVitFilter(upstream string, nsfwThreshold, minDiff float64, maxConns int
 	}
 }
 
+// postLabeler emits post labels, set up by the label listener when labels are published
+var postLabeler func(uri string, cid string, val string)
+
+func labelPost(event *models.Event, val string) {
+	labeler := postLabeler
+	if labeler == nil || event.Commit == nil {
+		return
+	}
+	uri := "at://" + event.Did + "/" + event.Commit.Collection + "/" + event.Commit.RKey
+	labeler(uri, event.Commit.CID, val)
+}
+
+// postLabelValues are the values used by LabelDropped, registered when the filters are set up
+var postLabelValues = make(map[string]bool)
+
+// EmittedLabelValues returns all label values that we may emit, sorted
+func EmittedLabelValues() []string {
+	values := []string{at_utils.LabelOffenderString}
+	for val := range postLabelValues {
+		if val != at_utils.LabelOffenderString {
+			values = append(values, val)
+		}
+	}
+	slices.Sort(values)
+	return values
+}
+
+// LabelDropped labels posts dropped by the filter with val.
+//
+// Only posts that have passed the filters before it get labeled.
+func LabelDropped(val string, filter feedFilter) feedFilter {
+	postLabelValues[val] = true
+	return func(post *bsky.FeedPost, event *models.Event) bool {
+		if filter(post, event) {
+			return true
+		}
+		labelPost(event, val)
+		return false
+	}
+}
+
+// LabelDroppedCostly is LabelDropped for costly filters
+func LabelDroppedCostly(val string, filter costlyfeedFilter) costlyfeedFilter {
+	postLabelValues[val] = true
+	return func(ctx context.Context, post *bsky.FeedPost, event *models.Event) bool {
+		if filter(ctx, post, event) {
+			return true
+		}
+		labelPost(event, val)
+		return false
+	}
+}
+
 func (l *JetstreamListener) ShouldKeepFeedItem(post *bsky.FeedPost, event *models.Event) bool {
 	for _, filter := range feedFilters {
 		if !filter(post, event) {
@@ -267,9 +379,9 @@ func (l *JetstreamListener) ShouldKeepFeedItem(post *bsky.FeedPost, event *model
 	return true
 }
 
-func (l *JetstreamListener) ShouldKeepFeedItemCostly(ctx context.Context, post *bsky.FeedPost, did string) bool {
+func (l *JetstreamListener) ShouldKeepFeedItemCostly(ctx context.Context, post *bsky.FeedPost, event *models.Event) bool {
 	for _, filter := range costlyFeedFilters {
-		if !filter(ctx, post, did) {
+		if !filter(ctx, post, event) {
 			return false
 		}
 	}
@@ -1,31 +1,76 @@
 package listener
 
 import (
-	"bufio"
+	"bluesky-oneshot-labeler/internal/at_utils"
 	"context"
 	"log/slog"
-	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/bits-and-blooms/bloom/v3"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/fsnotify/fsnotify"
 )
 
 type BlockListInSync struct {
 	filter atomic.Value
 	list   atomic.Value
+	// propagated holds the users (without "did:") blocked by graph propagation
+	propagated atomic.Value
 
-	log      *slog.Logger
-	csvPath  string
+	log     *slog.Logger
+	csvPath string
+	// target is the file csvPath links to, or csvPath itself
+	target   string
+	store    *blockListStore
 	watcher  *fsnotify.Watcher
 	notifier func()
+	// loaded is closed once the file has been read
+	loaded chan struct{}
+
+	// handles caches the resolution of handles in the list
+	handles   sync.Map // string -> *handleResolution
+	resolving atomic.Bool
+}
+
+type handleResolution struct {
+	// Did is empty if the handle failed to resolve
+	Did string
+	At  time.Time
+}
+
+const (
+	handleCacheTtl      = 24 * time.Hour
+	handleRetryInterval = time.Hour
+	// blockListDebounce lets a burst of events, e.g. an editor saving, settle before reloading
+	blockListDebounce = 500 * time.Millisecond
+	// blockListPollInterval is how often the block list is checked when it cannot be watched
+	blockListPollInterval = 30 * time.Second
+)
+
+// resolvedDid returns the cached DID of a handle, or "" if not (yet) resolved
+func (b *BlockListInSync) resolvedDid(handle string) (did string, fresh bool) {
+	value, ok := b.handles.Load(handle)
+	if !ok {
+		return "", false
+	}
+	resolution := value.(*handleResolution)
+	ttl := handleCacheTtl
+	if resolution.Did == "" {
+		ttl = handleRetryInterval
+	}
+	return resolution.Did, time.Since(resolution.At) < ttl
 }
 
 func NewBlockListInSync(csvPath string, logger *slog.Logger) (*BlockListInSync, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		return nil, err
+		// Run falls back to polling
+		logger.Warn("failed to create blocklist watcher", "err", err)
+		watcher = nil
 	}
 
 	list := &BlockListInSync{
@@ -33,11 +78,14 @@ func NewBlockListInSync(csvPath string, logger *slog.Logger) (*BlockListInSync,
 		list:     atomic.Value{},
 		log:      logger,
 		csvPath:  csvPath,
+		store:    newBlockListStore(csvPath),
 		watcher:  watcher,
 		notifier: func() {},
+		loaded:   make(chan struct{}),
 	}
 	list.filter.Store(bloom.NewWithEstimates(100, 0.01))
 	list.list.Store(make(map[string]struct{}))
+	list.propagated.Store(make(map[string]struct{}))
 	return list, nil
 }
 
@@ -45,6 +93,11 @@ func (b *BlockListInSync) SetNotifier(notifier func()) {
 	b.notifier = notifier
 }
 
+// Loaded is closed once the block list has been read, if there is one
+func (b *BlockListInSync) Loaded() <-chan struct{} {
+	return b.loaded
+}
+
 func (b *BlockListInSync) Contains(did string) bool {
 	// b.filter is CoW, so we don't need to lock it.
 	if !b.filter.Load().(*bloom.BloomFilter).TestString(did) {
@@ -54,52 +107,179 @@ func (b *BlockListInSync) Contains(did string) bool {
 	return ok
 }
 
+// Propagated tells if the user is in the block list through graph propagation
+func (b *BlockListInSync) Propagated(did string) bool {
+	_, ok := b.propagated.Load().(map[string]struct{})[did]
+	return ok
+}
+
 func (b *BlockListInSync) update() error {
-	reader, err := os.Open(b.csvPath)
-	if err != nil {
+	changed, err := b.store.reload()
+	if err != nil || !changed {
 		return err
 	}
-	defer reader.Close()
+	b.rebuild()
+	return nil
+}
 
-	var count uint
-	list := make(map[string]struct{})
+// rebuild swaps in the filter and the list built from the store,
+// resolving handles in the background
+func (b *BlockListInSync) rebuild() {
+	entries, problems := b.store.snapshot()
+	for _, problem := range problems {
+		b.log.Warn("skipping malformed blocklist line", "err", problem)
+	}
 
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		line := scanner.Text()
-		i := strings.Index(line, ",")
-		var did string
-		if i == -1 {
-			did = line
+	list := make(map[string]struct{}, len(entries))
+	propagated := make(map[string]struct{})
+	var unresolved []string
+	for _, entry := range entries {
+		did := entry.Did
+		if entry.Handle != "" {
+			var fresh bool
+			did, fresh = b.resolvedDid(entry.Handle)
+			if !fresh {
+				unresolved = append(unresolved, entry.Handle)
+			}
+		}
+		if did != "" {
+			list[strings.TrimPrefix(did, "did:")] = struct{}{}
+			if entry.ReasonType == graphReasonType {
+				propagated[strings.TrimPrefix(did, "did:")] = struct{}{}
+			}
+		}
+	}
+	filter := bloom.NewWithEstimates(uint(len(list)), 0.01)
+	for did := range list {
+		filter.AddString(did)
+	}
+
+	b.filter.Store(filter)
+	b.list.Store(list)
+	b.propagated.Store(propagated)
+	b.log.Info("blocklist updated", "count", len(list), "unresolved", len(unresolved))
+	b.notifier()
+
+	if len(unresolved) != 0 && b.resolving.CompareAndSwap(false, true) {
+		go b.resolveHandles(unresolved)
+	}
+}
+
+// resolveHandles resolves handles one by one and rebuilds the list if any resolves to a new DID
+func (b *BlockListInSync) resolveHandles(handles []string) {
+	defer b.resolving.Store(false)
+	changed := false
+	for _, handle := range handles {
+		previous, _ := b.resolvedDid(handle)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		did, err := at_utils.IdentityDirectory.LookupHandle(ctx, syntax.Handle(handle))
+		cancel()
+		resolution := &handleResolution{At: time.Now()}
+		if err != nil {
+			b.log.Warn("failed to resolve handle in blocklist", "handle", handle, "err", err)
 		} else {
-			did = line[:i]
+			resolution.Did = did.DID.String()
+		}
+		b.handles.Store(handle, resolution)
+		if resolution.Did != previous {
+			changed = true
 		}
-		did = strings.TrimSpace(did)
-		did = strings.Trim(did, `"`)
-		if !strings.HasPrefix(did, "did:") {
+	}
+	if changed {
+		b.rebuild()
+	}
+}
+
+// refreshHandles rebuilds the list if any handle in it is due for resolving again
+func (b *BlockListInSync) refreshHandles() {
+	entries, _ := b.store.snapshot()
+	for _, entry := range entries {
+		if entry.Handle == "" {
 			continue
 		}
-		did = strings.TrimPrefix(did, "did:")
-		list[did] = struct{}{}
-		count++
+		if _, fresh := b.resolvedDid(entry.Handle); !fresh {
+			b.rebuild()
+			return
+		}
+	}
+}
+
+// Entries returns the entries in the block list with handles resolved, if possible,
+// along with the malformed lines that were skipped
+func (b *BlockListInSync) Entries() ([]BlockListEntry, []error) {
+	entries, problems := b.store.snapshot()
+	for i := range entries {
+		if entries[i].Handle != "" {
+			entries[i].Did, _ = b.resolvedDid(entries[i].Handle)
+		}
 	}
+	return entries, problems
+}
 
-	if err := scanner.Err(); err != nil {
+// Add adds entries to the block list file, merging the reasons of users already in it
+func (b *BlockListInSync) Add(entries ...BlockListEntry) error {
+	added, err := b.store.add(entries...)
+	if err != nil {
 		return err
 	}
+	if added != 0 {
+		b.rebuild()
+	}
+	return nil
+}
 
-	filter := bloom.NewWithEstimates(count, 0.01)
-	for did := range list {
-		filter.AddString(did)
+// Remove removes a user (with the "did:" prefix) from the block list file,
+// along with the rows naming them by handle
+func (b *BlockListInSync) Remove(did string) (bool, error) {
+	keys := []string{did}
+	entries, _ := b.Entries()
+	for _, entry := range entries {
+		if entry.Handle != "" && entry.Did == did {
+			keys = append(keys, entry.Handle)
+		}
+	}
+	removed := false
+	for _, key := range keys {
+		ok, err := b.store.remove(key)
+		if err != nil {
+			return removed, err
+		}
+		removed = removed || ok
+	}
+	if !removed {
+		return false, nil
 	}
+	b.rebuild()
+	return true, nil
+}
 
-	b.filter.Store(filter)
-	b.list.Store(list)
-	b.log.Info("blocklist updated", "count", count)
-	b.notifier()
+// watch watches the directory of the block list, and of the file it links to if any,
+// since editors, mv and ConfigMap updates replace the file instead of writing to it
+func (b *BlockListInSync) watch() error {
+	dirs := []string{filepath.Dir(b.csvPath)}
+	b.target = b.csvPath
+	if target, err := filepath.EvalSymlinks(b.csvPath); err == nil {
+		b.target = target
+		dirs = append(dirs, filepath.Dir(target))
+	}
+	for _, dir := range dirs {
+		if err := b.watcher.Add(dir); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// affects tells if an event in the watched directories may have changed the block list
+func (b *BlockListInSync) affects(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Base(event.Name)
+	// ConfigMaps swap the "..data" symlink the file links through
+	return name == filepath.Base(b.csvPath) || event.Name == b.target || strings.HasPrefix(name, "..")
+}
+
 func (b *BlockListInSync) Run(ctx context.Context) chan bool {
 	ctx, cancel := context.WithCancelCause(ctx)
 	done := make(chan bool)
@@ -107,6 +287,7 @@ func (b *BlockListInSync) Run(ctx context.Context) chan bool {
 		defer b.Close(done)
 
 		if b.csvPath == "" {
+			close(b.loaded)
 			<-ctx.Done()
 			return
 		}
@@ -117,36 +298,73 @@ func (b *BlockListInSync) Run(ctx context.Context) chan bool {
 			cancel(err)
 			return
 		}
+		close(b.loaded)
+
+		// only ticks if the block list cannot be watched
+		poll := time.NewTicker(blockListPollInterval)
+		defer poll.Stop()
+		poll.Stop()
+		var events <-chan fsnotify.Event
+		var errs <-chan error
+		if b.watcher != nil {
+			err = b.watch()
+		}
+		if b.watcher == nil || err != nil {
+			b.log.Warn("cannot watch blocklist, polling it instead", "err", err, "interval", blockListPollInterval)
+			poll.Reset(blockListPollInterval)
+		} else {
+			events, errs = b.watcher.Events, b.watcher.Errors
+		}
+
+		refresh := time.NewTicker(handleRetryInterval)
+		defer refresh.Stop()
+		var settled <-chan time.Time
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case event, ok := <-b.watcher.Events:
+			case event, ok := <-events:
 				if !ok {
-					b.log.Error("watcher closed")
-					cancel(context.Canceled)
-					return
+					b.log.Warn("blocklist watcher closed, polling it instead", "interval", blockListPollInterval)
+					events, errs = nil, nil
+					poll.Reset(blockListPollInterval)
+					continue
+				}
+				if b.affects(event) {
+					settled = time.After(blockListDebounce)
+				}
+			case err, ok := <-errs:
+				if ok {
+					b.log.Warn("blocklist watcher error", "err", err)
 				}
-				if event.Has(fsnotify.Write) {
-					err := b.update()
-					if err != nil {
-						b.log.Error("failed to update blocklist", "err", err)
-					}
+			case <-settled:
+				settled = nil
+				// own writes are skipped by the store
+				if err := b.update(); err != nil {
+					b.log.Error("failed to update blocklist", "err", err)
 				}
+				// the link may point somewhere else now
+				if err := b.watch(); err != nil {
+					b.log.Warn("failed to watch blocklist", "err", err)
+				}
+			case <-poll.C:
+				if err := b.update(); err != nil {
+					b.log.Error("failed to update blocklist", "err", err)
+				}
+			case <-refresh.C:
+				b.refreshHandles()
 			}
 		}
 	}()
-	err := b.watcher.Add(b.csvPath)
-	if err != nil {
-		b.log.Error("failed to watch blocklist", "err", err)
-		cancel(err)
-	}
 	return done
 }
 
 func (b *BlockListInSync) Close(done chan bool) {
 	b.log.Info("blocklist sync stopped")
 	done <- true
+	if b.watcher == nil {
+		return
+	}
 	if err := b.watcher.Close(); err != nil {
 		b.log.Error("failed to close watcher", "err", err)
 	}
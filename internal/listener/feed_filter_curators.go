@@ -0,0 +1,196 @@
+package listener
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+const blockCollection = "app.bsky.graph.block"
+
+// CuratorBlocksInSync keeps the blocks of trusted curators, backfilled with
+// com.atproto.repo.listRecords from their PDSes and then updated from Jetstream block events.
+//
+// Users blocked by at least threshold curators are blocked from the feed.
+type CuratorBlocksInSync struct {
+	log       *slog.Logger
+	curators  map[string]*identity.Identity
+	threshold int
+	notifier  func()
+	// blocks are grouped by curator DID
+	blocks *recordIndex
+}
+
+func NewCuratorBlocksInSync(ctx context.Context, identifiers []string, threshold int, logger *slog.Logger) (*CuratorBlocksInSync, error) {
+	curators := make(map[string]*identity.Identity)
+	for _, id := range identifiers {
+		if id == "" {
+			continue
+		}
+		ident, err := at_utils.LookupIdentifier(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve curator %q: %w", id, err)
+		}
+		curators[ident.DID.String()] = ident
+	}
+	if len(curators) != 0 {
+		if threshold < 1 {
+			return nil, fmt.Errorf("curator block threshold must be at least 1")
+		}
+		if threshold > len(curators) {
+			logger.Warn("curator block threshold is more than the number of curators", "threshold", threshold, "curators", len(curators))
+		}
+	}
+	return &CuratorBlocksInSync{
+		log:       logger,
+		curators:  curators,
+		threshold: threshold,
+		notifier:  func() {},
+		blocks:    newRecordIndex(),
+	}, nil
+}
+
+func (c *CuratorBlocksInSync) SetNotifier(notifier func()) {
+	c.notifier = notifier
+}
+
+// Enabled tells if any curator is trusted
+func (c *CuratorBlocksInSync) Enabled() bool {
+	return len(c.curators) != 0
+}
+
+func (c *CuratorBlocksInSync) Contains(did string) bool {
+	return c.Enabled() && c.blocks.groupCount(did) >= c.threshold
+}
+
+// Stats returns the state of the blocks of each curator, keyed by their DIDs
+func (c *CuratorBlocksInSync) Stats() map[string]*RecordGroupStats {
+	curators := make([]string, 0, len(c.curators))
+	for did := range c.curators {
+		curators = append(curators, did)
+	}
+	return c.blocks.stats(curators)
+}
+
+// HandleEvent applies a block commit if it is made by one of the curators
+func (c *CuratorBlocksInSync) HandleEvent(event *models.Event) error {
+	if _, ok := c.curators[event.Did]; !ok {
+		return nil
+	}
+	commit := event.Commit
+	key := recordKey(event.Did, commit.RKey)
+	switch commit.Operation {
+	case "create":
+		var record bsky.GraphBlock
+		if err := json.Unmarshal(commit.Record, &record); err != nil {
+			return err
+		}
+		subject, err := syntax.ParseDID(record.Subject)
+		if err != nil {
+			return err
+		}
+		compactDid := strings.TrimPrefix(subject.String(), "did:")
+		if !c.blocks.add(key, indexedRecord{Group: event.Did, CompactDid: compactDid}) {
+			return nil
+		}
+		c.log.Debug("user blocked by curator", "curator", event.Did, "did", subject.String())
+		if c.blocks.groupCount(compactDid) == c.threshold {
+			c.log.Info("user blocked by enough curators", "did", subject.String(), "threshold", c.threshold)
+			c.notifier()
+		}
+	case "delete":
+		if c.blocks.remove(key) {
+			c.log.Debug("user unblocked by curator", "key", key)
+		}
+	}
+	return nil
+}
+
+// sync fetches all blocks of a curator from their PDS and replaces what we have of them
+func (c *CuratorBlocksInSync) sync(ctx context.Context, curator *identity.Identity) error {
+	did := curator.DID.String()
+	pds := curator.PDSEndpoint()
+	if pds == "" {
+		return fmt.Errorf("curator has no PDS")
+	}
+	client := &xrpc.Client{Host: pds}
+
+	known := c.blocks.keys(did)
+	fetched := make(map[string]indexedRecord)
+	cursor := ""
+	for {
+		out, err := atproto.RepoListRecords(ctx, client, blockCollection, cursor, 100, did, false, "", "")
+		if err != nil {
+			return err
+		}
+		for _, record := range out.Records {
+			block, ok := record.Value.Val.(*bsky.GraphBlock)
+			if !ok {
+				continue
+			}
+			uri, err := syntax.ParseATURI(record.Uri)
+			if err != nil {
+				continue
+			}
+			fetched[recordKey(did, uri.RecordKey().String())] = indexedRecord{
+				Group:      did,
+				CompactDid: strings.TrimPrefix(block.Subject, "did:"),
+			}
+		}
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Records) == 0 {
+			break
+		}
+		cursor = *out.Cursor
+	}
+
+	c.blocks.replace(did, known, fetched)
+	c.log.Info("curator blocks synced", "curator", did, "blocks", len(fetched))
+	c.notifier()
+	return nil
+}
+
+func (c *CuratorBlocksInSync) syncAll(ctx context.Context) {
+	for _, curator := range c.curators {
+		if err := c.sync(ctx, curator); err != nil {
+			c.log.Error("failed to sync curator blocks", "curator", curator.DID.String(), "err", err)
+		}
+	}
+}
+
+func (c *CuratorBlocksInSync) Run(ctx context.Context) chan bool {
+	done := make(chan bool)
+	go func() {
+		defer func() {
+			c.log.Info("curator block sync stopped")
+			done <- true
+		}()
+		if !c.Enabled() {
+			<-ctx.Done()
+			return
+		}
+
+		c.syncAll(ctx)
+		ticker := time.NewTicker(modListResyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.syncAll(ctx)
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,89 @@
+package listener
+
+import (
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+func newTestCurators(threshold int, dids ...string) *CuratorBlocksInSync {
+	curators := make(map[string]*identity.Identity, len(dids))
+	for _, did := range dids {
+		curators[did] = &identity.Identity{DID: syntax.DID(did)}
+	}
+	return &CuratorBlocksInSync{
+		log:       discardLogger(),
+		curators:  curators,
+		threshold: threshold,
+		notifier:  func() {},
+		blocks:    newRecordIndex(),
+	}
+}
+
+func block(t *testing.T, repo, rkey, subject string) *models.Event {
+	t.Helper()
+	return commitEvent(t, repo, "create", blockCollection, rkey, map[string]string{
+		"$type":     blockCollection,
+		"subject":   subject,
+		"createdAt": "2024-01-01T00:00:00Z",
+	})
+}
+
+func TestCuratorBlocksThreshold(t *testing.T) {
+	curators := newTestCurators(2, "did:plc:alice", "did:plc:bob", "did:plc:carol")
+	notified := 0
+	curators.SetNotifier(func() { notified++ })
+	handle := func(event *models.Event) {
+		t.Helper()
+		if err := curators.HandleEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handle(block(t, "did:plc:alice", "1", "did:plc:spammer"))
+	// blocking twice does not make two curators
+	handle(block(t, "did:plc:alice", "2", "did:plc:spammer"))
+	// blocks of anyone else do not count
+	handle(block(t, "did:plc:stranger", "1", "did:plc:spammer"))
+	if curators.Contains("plc:spammer") {
+		t.Error("blocked below the threshold")
+	}
+
+	handle(block(t, "did:plc:bob", "1", "did:plc:spammer"))
+	if !curators.Contains("plc:spammer") {
+		t.Error("not blocked at the threshold")
+	}
+	handle(block(t, "did:plc:carol", "1", "did:plc:spammer"))
+	if notified != 1 {
+		t.Errorf("notified %d times, expected once on reaching the threshold", notified)
+	}
+
+	handle(commitEvent(t, "did:plc:stranger", "delete", blockCollection, "1", nil))
+	handle(commitEvent(t, "did:plc:bob", "delete", blockCollection, "1", nil))
+	if !curators.Contains("plc:spammer") {
+		t.Error("unblocked while still blocked by two curators")
+	}
+	handle(commitEvent(t, "did:plc:carol", "delete", blockCollection, "1", nil))
+	if curators.Contains("plc:spammer") {
+		t.Error("still blocked by a single curator")
+	}
+
+	if err := curators.HandleEvent(block(t, "did:plc:bob", "2", "bob.test")); err == nil {
+		t.Error("expected an error for an invalid subject")
+	}
+}
+
+func TestCuratorBlocksDisabled(t *testing.T) {
+	curators := newTestCurators(1)
+	if curators.Enabled() {
+		t.Error("enabled without curators")
+	}
+	if err := curators.HandleEvent(block(t, "did:plc:alice", "1", "did:plc:spammer")); err != nil {
+		t.Fatal(err)
+	}
+	if curators.Contains("plc:spammer") {
+		t.Error("blocked without curators")
+	}
+}
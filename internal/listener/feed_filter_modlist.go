@@ -0,0 +1,180 @@
+package listener
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+const (
+	listItemCollection = "app.bsky.graph.listitem"
+	// modListResyncInterval is how often the lists are fetched again to catch missed events
+	modListResyncInterval = 6 * time.Hour
+)
+
+// ModListsInSync keeps the members of Bluesky moderation lists,
+// backfilled with app.bsky.graph.getList and then updated from Jetstream listitem events
+type ModListsInSync struct {
+	log      *slog.Logger
+	lists    map[string]syntax.ATURI
+	notifier func()
+	// items are grouped by list
+	items *recordIndex
+}
+
+func NewModListsInSync(uris []string, logger *slog.Logger) (*ModListsInSync, error) {
+	lists := make(map[string]syntax.ATURI)
+	for _, s := range uris {
+		if s == "" {
+			continue
+		}
+		uri, err := syntax.ParseATURI(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid moderation list %q: %w", s, err)
+		}
+		if uri.Collection() != "app.bsky.graph.list" || uri.RecordKey() == "" || !uri.Authority().IsDID() {
+			return nil, fmt.Errorf("not a list AT-URI with a DID: %s", s)
+		}
+		lists[uri.String()] = uri
+	}
+	return &ModListsInSync{
+		log:      logger,
+		lists:    lists,
+		notifier: func() {},
+		items:    newRecordIndex(),
+	}, nil
+}
+
+func (m *ModListsInSync) SetNotifier(notifier func()) {
+	m.notifier = notifier
+}
+
+// Enabled tells if any list is subscribed to
+func (m *ModListsInSync) Enabled() bool {
+	return len(m.lists) != 0
+}
+
+func (m *ModListsInSync) Contains(did string) bool {
+	return m.items.groupCount(did) != 0
+}
+
+// Stats returns the state of each list, keyed by their AT-URIs
+func (m *ModListsInSync) Stats() map[string]*RecordGroupStats {
+	lists := make([]string, 0, len(m.lists))
+	for uri := range m.lists {
+		lists = append(lists, uri)
+	}
+	return m.items.stats(lists)
+}
+
+// HandleEvent applies a listitem commit if it belongs to one of the lists
+func (m *ModListsInSync) HandleEvent(event *models.Event) error {
+	commit := event.Commit
+	key := recordKey(event.Did, commit.RKey)
+	switch commit.Operation {
+	case "create":
+		var record bsky.GraphListitem
+		if err := json.Unmarshal(commit.Record, &record); err != nil {
+			return err
+		}
+		list, ok := m.lists[record.List]
+		// anyone can create items pointing at a list, but only those of the owner count
+		if !ok || list.Authority().String() != event.Did {
+			return nil
+		}
+		subject, err := syntax.ParseDID(record.Subject)
+		if err != nil {
+			return err
+		}
+		added := m.items.add(key, indexedRecord{
+			Group:      record.List,
+			CompactDid: strings.TrimPrefix(subject.String(), "did:"),
+		})
+		if added {
+			m.log.Debug("user added to moderation list", "list", record.List, "did", subject.String())
+			m.notifier()
+		}
+	case "delete":
+		if m.items.remove(key) {
+			m.log.Debug("user removed from moderation list", "key", key)
+		}
+	}
+	return nil
+}
+
+// sync fetches all items of a list and replaces what we have of it
+func (m *ModListsInSync) sync(ctx context.Context, uri syntax.ATURI) error {
+	list := uri.String()
+	known := m.items.keys(list)
+	fetched := make(map[string]indexedRecord)
+	cursor := ""
+	for {
+		out, err := bsky.GraphGetList(ctx, at_utils.PubClient, cursor, 100, list)
+		if err != nil {
+			return err
+		}
+		for _, item := range out.Items {
+			itemUri, err := syntax.ParseATURI(item.Uri)
+			if err != nil || item.Subject == nil {
+				continue
+			}
+			key := recordKey(itemUri.Authority().String(), itemUri.RecordKey().String())
+			fetched[key] = indexedRecord{
+				Group:      list,
+				CompactDid: strings.TrimPrefix(item.Subject.Did, "did:"),
+			}
+		}
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Items) == 0 {
+			break
+		}
+		cursor = *out.Cursor
+	}
+
+	m.items.replace(list, known, fetched)
+	m.log.Info("moderation list synced", "list", list, "members", len(fetched))
+	m.notifier()
+	return nil
+}
+
+func (m *ModListsInSync) syncAll(ctx context.Context) {
+	for _, uri := range m.lists {
+		if err := m.sync(ctx, uri); err != nil {
+			m.log.Error("failed to sync moderation list", "list", uri.String(), "err", err)
+		}
+	}
+}
+
+func (m *ModListsInSync) Run(ctx context.Context) chan bool {
+	done := make(chan bool)
+	go func() {
+		defer func() {
+			m.log.Info("moderation list sync stopped")
+			done <- true
+		}()
+		if !m.Enabled() {
+			<-ctx.Done()
+			return
+		}
+
+		m.syncAll(ctx)
+		ticker := time.NewTicker(modListResyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.syncAll(ctx)
+			}
+		}
+	}()
+	return done
+}
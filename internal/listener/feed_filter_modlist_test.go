@@ -0,0 +1,114 @@
+package listener
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+// commitEvent builds a Jetstream commit of the record by the repo, without a record for deletes
+func commitEvent(t *testing.T, repo, operation, collection, rkey string, record any) *models.Event {
+	t.Helper()
+	commit := &models.Commit{Operation: operation, Collection: collection, RKey: rkey}
+	if record != nil {
+		data, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commit.Record = data
+	}
+	return &models.Event{Did: repo, Kind: models.EventKindCommit, Commit: commit}
+}
+
+func listItem(t *testing.T, repo, rkey, list, subject string) *models.Event {
+	t.Helper()
+	return commitEvent(t, repo, "create", listItemCollection, rkey, map[string]string{
+		"$type":     listItemCollection,
+		"list":      list,
+		"subject":   subject,
+		"createdAt": "2024-01-01T00:00:00Z",
+	})
+}
+
+func TestModListsOwnerItemsOnly(t *testing.T) {
+	const (
+		owner    = "did:plc:owner"
+		list     = "at://did:plc:owner/app.bsky.graph.list/mods"
+		other    = "at://did:plc:owner/app.bsky.graph.list/other"
+		stranger = "did:plc:stranger"
+	)
+	lists, err := NewModListsInSync([]string{list}, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := 0
+	lists.SetNotifier(func() { notified++ })
+	handle := func(event *models.Event) {
+		t.Helper()
+		if err := lists.HandleEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// anyone may create items pointing at the list
+	handle(listItem(t, stranger, "1", list, "did:plc:victim"))
+	handle(listItem(t, owner, "2", other, "did:plc:spammer"))
+	if lists.Contains("plc:victim") || lists.Contains("plc:spammer") {
+		t.Error("items of others or of other lists counted")
+	}
+	if notified != 0 {
+		t.Errorf("notified %d times of ignored items", notified)
+	}
+
+	handle(listItem(t, owner, "3", list, "did:plc:spammer"))
+	handle(listItem(t, owner, "3", list, "did:plc:spammer"))
+	if !lists.Contains("plc:spammer") {
+		t.Error("item of the owner not counted")
+	}
+	if notified != 1 {
+		t.Errorf("notified %d times, expected once for the replayed item", notified)
+	}
+
+	// the key of the stranger's item does not name the owner's one
+	handle(commitEvent(t, stranger, "delete", listItemCollection, "3", nil))
+	if !lists.Contains("plc:spammer") {
+		t.Error("item removed by the delete of another repo")
+	}
+	handle(commitEvent(t, owner, "delete", listItemCollection, "3", nil))
+	if lists.Contains("plc:spammer") {
+		t.Error("item still counted after its delete")
+	}
+
+	if err := lists.HandleEvent(listItem(t, owner, "4", list, "not a did")); err == nil {
+		t.Error("expected an error for an invalid subject")
+	}
+}
+
+func TestRecordIndexReplace(t *testing.T) {
+	index := newRecordIndex()
+	index.add(recordKey("did:plc:owner", "1"), indexedRecord{Group: "list", CompactDid: "plc:aaa"})
+	index.add(recordKey("did:plc:owner", "2"), indexedRecord{Group: "list", CompactDid: "plc:bbb"})
+	index.add(recordKey("did:plc:owner", "3"), indexedRecord{Group: "other", CompactDid: "plc:bbb"})
+	known := index.keys("list")
+
+	// created while fetching, so missing from what was fetched
+	index.add(recordKey("did:plc:owner", "4"), indexedRecord{Group: "list", CompactDid: "plc:ddd"})
+	index.replace("list", known, map[string]indexedRecord{
+		recordKey("did:plc:owner", "2"): {Group: "list", CompactDid: "plc:bbb"},
+		recordKey("did:plc:owner", "5"): {Group: "list", CompactDid: "plc:eee"},
+	})
+
+	for did, groups := range map[string]int{"plc:aaa": 0, "plc:bbb": 2, "plc:ddd": 1, "plc:eee": 1} {
+		if got := index.groupCount(did); got != groups {
+			t.Errorf("%s named in %d groups, expected %d", did, got, groups)
+		}
+	}
+	stats := index.stats([]string{"list", "other"})
+	if stats["list"].Records != 3 || stats["list"].SyncedAt == nil {
+		t.Errorf("got list stats %+v, expected 3 synced records", stats["list"])
+	}
+	if stats["other"].Records != 1 || stats["other"].SyncedAt != nil {
+		t.Errorf("got other stats %+v, expected 1 record never synced", stats["other"])
+	}
+}
@@ -23,6 +23,8 @@ var feedFilters = []feedFilter{
 
 	// extract tags from post, necessary for HasNoTags, MaxTagCount, etc.
 	ExtractTags,
+	// filter out posts with tags or keywords muted by moderators (through `mute-tag` and `keyword` reports)
+	IsNotMuted,
 	// filter out posts with too many tags (probably spams)
 	MaxTagCount(7),
 	// filter out posts with a certain tag (case-insensitive)
@@ -35,6 +37,8 @@ var feedFilters = []feedFilter{
 	Not(ContainsAnyText(
 		"发布了一篇小红书笔记，快来看吧！",
 	)),
+	// // or, to also label the matching posts (with PUBLISH_LABELS set):
+	// LabelDropped(at_utils.LabelSexualString, Not(ContainsAnyText("<keyword>"))),
 
 	// rate-limits to 1 post per 2 minutes per user, allowing 3 posts per 2 minutes burst
 	RateLimit(3, 2*time.Minute),
@@ -52,7 +56,7 @@ var langDetector = lingua.NewLanguageDetectorBuilder().
 	WithPreloadedLanguageModels().
 	Build()
 
-type costlyfeedFilter func(ctx context.Context, post *bsky.FeedPost, did string) bool
+type costlyfeedFilter func(ctx context.Context, post *bsky.FeedPost, event *models.Event) bool
 
 // These filters are more expensive and are called only if the other filters pass
 var costlyFeedFilters = []costlyfeedFilter{
@@ -61,4 +65,8 @@ var costlyFeedFilters = []costlyfeedFilter{
 	// //   - if nsfw > nsfwThreshold && nsfw - sfw > minDiff, filter out
 	// //   - maxConns is the max number of concurrent requests.
 	// NsfwVitFilter("http://localhost:5000", 1.8, 1.2, 4),
+	//
+	// // With PUBLISH_LABELS set, wrap the filters with LabelDropped (or LabelDroppedCostly)
+	// // to publish labels on the posts they filter out, e.g.:
+	// LabelDroppedCostly(at_utils.LabelSexualString, NsfwVitFilter("http://localhost:5000", 1.8, 1.2, 4)),
 }
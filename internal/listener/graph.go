@@ -0,0 +1,593 @@
+package listener
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/database"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"golang.org/x/time/rate"
+)
+
+const (
+	followCollection = "app.bsky.graph.follow"
+	// GraphActor is the actor of the blocks made by graph propagation in the audit trail
+	GraphActor = "graph"
+	// graphReasonType marks the block list entries added by graph propagation,
+	// which are not used as seeds so that blocks do not propagate on their own
+	graphReasonType = "graph"
+	// graphBackfillLimit bounds the follows and the followers fetched for each seed
+	graphBackfillLimit = 1000
+	// followBackfillPrefix makes up the record keys of the follows fetched from the followers of seeds,
+	// which are not listed, so that unfollows of them are only dropped when the seed is pruned
+	followBackfillPrefix = "backfill:"
+)
+
+// GraphStats is the outcome of the last ranking round
+type GraphStats struct {
+	RankedAt *time.Time `json:"rankedAt"`
+	Users    int        `json:"users"`
+	Follows  int        `json:"follows"`
+	Seeds    int        `json:"seeds"`
+	Queued   int        `json:"queued"`
+	Blocked  int        `json:"blocked"`
+	Pruned   int        `json:"pruned"`
+}
+
+// FollowGraph is the Go take on the Python clusterer: it collects follows from and to blocked users
+// and periodically runs a PageRank personalized with the block list, so that accounts close
+// to blocked ones are either queued for review or blocked.
+type FollowGraph struct {
+	log     *slog.Logger
+	db      *database.Service
+	blocker *JetstreamListener
+	// limiter paces the requests backfilling the follows of seeds
+	limiter *rate.Limiter
+
+	lock  sync.Mutex
+	stats GraphStats
+}
+
+func NewFollowGraph(logger *slog.Logger) (*FollowGraph, error) {
+	if config.GraphDamping >= 1 {
+		return nil, fmt.Errorf("GRAPH_DAMPING must be less than 1")
+	}
+	perSecond := max(1, config.AppViewRateLimit/10)
+	return &FollowGraph{
+		log:     logger,
+		db:      database.Instance(),
+		limiter: rate.NewLimiter(rate.Limit(perSecond), perSecond),
+	}, nil
+}
+
+// Enabled tells if follows are collected and ranked
+func (g *FollowGraph) Enabled() bool {
+	return config.GraphPropagation
+}
+
+func (g *FollowGraph) Stats() GraphStats {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.stats
+}
+
+// isSeed tells if the user is in the block lists maintained by us, i.e. the database or the CSV file,
+// by the same rule as seeds
+func (g *FollowGraph) isSeed(did string) bool {
+	blockList := g.blocker.BlockList()
+	if blockList.Propagated(did) {
+		return false
+	}
+	return blockList.Contains(did) || g.blocker.inDbBlockList(did)
+}
+
+// seeds returns the users in the block lists maintained by us, as DIDs without "did:",
+// leaving out those blocked by graph propagation so that blocks do not propagate on their own
+func (g *FollowGraph) seeds() (map[string]struct{}, error) {
+	blocks, err := g.db.GetBlocksSince(0, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	seeds := make(map[string]struct{}, len(blocks))
+	for _, block := range blocks {
+		seeds[block.CompactDid] = struct{}{}
+	}
+	// the users on malformed lines would be missing, and their follows pruned
+	entries, problems := g.blocker.BlockList().Entries()
+	if len(problems) != 0 {
+		return nil, fmt.Errorf("malformed block list: %w", errors.Join(problems...))
+	}
+	for _, entry := range entries {
+		if entry.Did != "" && entry.ReasonType != graphReasonType {
+			seeds[strings.TrimPrefix(entry.Did, "did:")] = struct{}{}
+		}
+	}
+	for _, entry := range entries {
+		if entry.Did != "" && entry.ReasonType == graphReasonType {
+			delete(seeds, strings.TrimPrefix(entry.Did, "did:"))
+		}
+	}
+	return seeds, nil
+}
+
+// HandleEvent records follows from or to blocked users, and drops deleted ones
+func (g *FollowGraph) HandleEvent(event *models.Event) error {
+	commit := event.Commit
+	src := strings.TrimPrefix(event.Did, "did:")
+	switch commit.Operation {
+	case "create":
+		var record bsky.GraphFollow
+		if err := json.Unmarshal(commit.Record, &record); err != nil {
+			return err
+		}
+		subject, err := syntax.ParseDID(record.Subject)
+		if err != nil {
+			return err
+		}
+		dst := strings.TrimPrefix(subject.String(), "did:")
+		if !g.isSeed(src) && !g.isSeed(dst) {
+			return nil
+		}
+		srcUid, err := g.db.GetUserId(event.Did)
+		if err != nil {
+			return err
+		}
+		dstUid, err := g.db.GetUserId(subject.String())
+		if err != nil {
+			return err
+		}
+		return g.db.InsertFollow(srcUid, commit.RKey, dstUid)
+	case "delete":
+		_, err := g.db.DeleteFollow(src, commit.RKey)
+		return err
+	}
+	return nil
+}
+
+// backfillSeed fetches the follows of a seed from their PDS and their followers from the AppView,
+// up to graphBackfillLimit each
+func (g *FollowGraph) backfillSeed(ctx context.Context, did string) error {
+	uid, err := g.db.GetUserId(did)
+	if err != nil {
+		return err
+	}
+	seed, err := at_utils.LookupIdentifier(ctx, did)
+	if err != nil {
+		return err
+	}
+	pds := seed.PDSEndpoint()
+	if pds == "" {
+		return fmt.Errorf("seed has no PDS")
+	}
+	client := &xrpc.Client{Host: pds}
+
+	fetched := 0
+	cursor := ""
+	for fetched < graphBackfillLimit {
+		if err := g.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		out, err := atproto.RepoListRecords(ctx, client, followCollection, cursor, 100, did, false, "", "")
+		if err != nil {
+			return err
+		}
+		for _, record := range out.Records {
+			follow, ok := record.Value.Val.(*bsky.GraphFollow)
+			if !ok {
+				continue
+			}
+			uri, err := syntax.ParseATURI(record.Uri)
+			if err != nil {
+				continue
+			}
+			subject, err := syntax.ParseDID(follow.Subject)
+			if err != nil {
+				continue
+			}
+			dst, err := g.db.GetUserId(subject.String())
+			if err != nil {
+				return err
+			}
+			if err := g.db.InsertFollow(uid, uri.RecordKey().String(), dst); err != nil {
+				return err
+			}
+			fetched++
+		}
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Records) == 0 {
+			break
+		}
+		cursor = *out.Cursor
+	}
+
+	fetched = 0
+	cursor = ""
+	rkey := followBackfillPrefix + strings.TrimPrefix(did, "did:")
+	for fetched < graphBackfillLimit {
+		if err := g.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		out, err := bsky.GraphGetFollowers(ctx, at_utils.PubClient, did, cursor, 100)
+		if err != nil {
+			return err
+		}
+		for _, follower := range out.Followers {
+			src, err := g.db.GetUserId(follower.Did)
+			if err != nil {
+				return err
+			}
+			if err := g.db.InsertFollow(src, rkey, uid); err != nil {
+				return err
+			}
+			fetched++
+		}
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Followers) == 0 {
+			break
+		}
+		cursor = *out.Cursor
+	}
+	return g.db.MarkBackfilled(uid)
+}
+
+// backfill fetches the follows of the seeds not backfilled yet, since Jetstream
+// only brings those made after the users got blocked, returning the number of seeds backfilled
+func (g *FollowGraph) backfill(ctx context.Context) int {
+	seeds, err := g.seeds()
+	if err != nil {
+		g.log.Error("failed to list graph seeds", "err", err)
+		return 0
+	}
+	backfilled, err := g.db.GetBackfilled()
+	if err != nil {
+		g.log.Error("failed to list backfilled seeds", "err", err)
+		return 0
+	}
+	count := 0
+	for did := range seeds {
+		if _, ok := backfilled[did]; ok {
+			continue
+		}
+		if err := g.backfillSeed(ctx, "did:"+did); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			g.log.Warn("failed to backfill follows", "did", "did:"+did, "err", err)
+			continue
+		}
+		count++
+	}
+	if count != 0 {
+		g.log.Info("follows backfilled", "seeds", count)
+	}
+	return count
+}
+
+// prune drops the follows between users who are both no longer seeds, the same rule HandleEvent
+// stores them by, and forgets that those users were backfilled, returning the follows kept.
+// Blocks in the database are looked up in seeds, since the filter of the listener may still be filling.
+func (g *FollowGraph) prune(follows []database.FollowEdge, seeds map[string]struct{}) ([]database.FollowEdge, error) {
+	seed := make(map[string]bool)
+	isSeed := func(did string) bool {
+		is, ok := seed[did]
+		if !ok {
+			_, is = seeds[did]
+			is = is || g.isSeed(did)
+			seed[did] = is
+		}
+		return is
+	}
+	var kept, pruned []database.FollowEdge
+	for _, follow := range follows {
+		if isSeed(follow.Src) || isSeed(follow.Dst) {
+			kept = append(kept, follow)
+		} else {
+			pruned = append(pruned, follow)
+		}
+	}
+	backfilled, err := g.db.GetBackfilled()
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for did := range backfilled {
+		if !isSeed(did) {
+			users = append(users, did)
+		}
+	}
+	if len(pruned) != 0 || len(users) != 0 {
+		if err := g.db.DeleteFollows(pruned, users); err != nil {
+			return nil, err
+		}
+		g.log.Info("follows pruned", "follows", len(pruned), "users", len(users))
+	}
+	g.lock.Lock()
+	g.stats.Pruned = len(pruned)
+	g.lock.Unlock()
+	return kept, nil
+}
+
+// personalizedPageRank ranks the nodes of a directed graph with random walks that restart
+// at nodes chosen by weight, and jump the same way from nodes without out edges.
+// The scores add up to 1.
+func personalizedPageRank(n int, edges [][2]int, weights []float64, damping float64) []float64 {
+	outDegree := make([]int, n)
+	for _, edge := range edges {
+		outDegree[edge[0]]++
+	}
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	restart := make([]float64, n)
+	for i, w := range weights {
+		restart[i] = w / total
+	}
+
+	scores := slices.Clone(restart)
+	next := make([]float64, n)
+	for range 100 {
+		dangling := 0.0
+		for i, degree := range outDegree {
+			if degree == 0 {
+				dangling += scores[i]
+			}
+		}
+		clear(next)
+		for _, edge := range edges {
+			next[edge[1]] += damping * scores[edge[0]] / float64(outDegree[edge[0]])
+		}
+		diff := 0.0
+		for i := range next {
+			next[i] += (1 - damping + damping*dangling) * restart[i]
+			diff += math.Abs(next[i] - scores[i])
+		}
+		scores, next = next, scores
+		if diff < 1e-12 {
+			break
+		}
+	}
+	return scores
+}
+
+type graphCandidate struct {
+	Did string
+	// Score is relative to the average user
+	Score float64
+}
+
+// rank runs PageRank over the follows we have, returning users out of any block list
+// scoring above the review threshold, the highest first
+func (g *FollowGraph) rank() ([]graphCandidate, error) {
+	follows, err := g.db.GetFollowEdges()
+	if err != nil {
+		return nil, err
+	}
+	seedSet, err := g.seeds()
+	if err != nil {
+		return nil, err
+	}
+	follows, err = g.prune(follows, seedSet)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int)
+	var dids []string
+	node := func(did string) int {
+		i, ok := index[did]
+		if !ok {
+			i = len(dids)
+			index[did] = i
+			dids = append(dids, did)
+		}
+		return i
+	}
+	edges := make([][2]int, len(follows))
+	for i, follow := range follows {
+		edges[i] = [2]int{node(follow.Src), node(follow.Dst)}
+	}
+	weights := make([]float64, len(dids))
+	blocked := make([]bool, len(dids))
+	seeds := 0
+	for i, did := range dids {
+		// as in the clusterer, everyone else gets a little weight too
+		weights[i] = 0.1
+		_, seed := seedSet[did]
+		blocked[i] = seed || g.blocker.InBlockList(did) != OutOfBlockList
+		if seed {
+			weights[i] = 1
+			seeds++
+		}
+	}
+
+	now := time.Now().UTC()
+	g.lock.Lock()
+	g.stats = GraphStats{RankedAt: &now, Users: len(dids), Follows: len(edges), Seeds: seeds, Pruned: g.stats.Pruned}
+	g.lock.Unlock()
+
+	threshold := config.GraphReviewThreshold
+	if threshold == 0 {
+		// no review, only blocks
+		threshold = config.GraphBlockThreshold
+	}
+	if seeds == 0 || threshold == 0 {
+		return nil, nil
+	}
+
+	scores := personalizedPageRank(len(dids), edges, weights, config.GraphDamping)
+	var candidates []graphCandidate
+	for i, score := range scores {
+		relative := score * float64(len(dids))
+		if blocked[i] || relative < threshold {
+			continue
+		}
+		allowed, err := g.db.IsUserAllowed(dids[i])
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			candidates = append(candidates, graphCandidate{Did: "did:" + dids[i], Score: relative})
+		}
+	}
+	slices.SortFunc(candidates, func(a, b graphCandidate) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	return candidates, nil
+}
+
+// propagate blocks the candidates above the block threshold and queues the others for review,
+// skipping those already reviewed
+func (g *FollowGraph) propagate(candidates []graphCandidate) error {
+	reporter, err := g.db.GetUserId(at_utils.UserDid.String())
+	if err != nil {
+		return err
+	}
+	var blocks []BlockListEntry
+	queued := 0
+	for _, candidate := range candidates {
+		if queued+len(blocks) >= config.GraphMaxCandidates {
+			break
+		}
+		reason := fmt.Sprintf("graph rank %.1f", candidate.Score)
+		if config.GraphBlockThreshold > 0 && candidate.Score >= config.GraphBlockThreshold {
+			blocks = append(blocks, BlockListEntry{Did: candidate.Did, ReasonType: graphReasonType, Reason: reason})
+			continue
+		}
+
+		reported, err := g.db.HasReported(reporter, candidate.Did)
+		if err != nil {
+			return err
+		}
+		if reported {
+			continue
+		}
+		uid, err := g.db.GetUserId(candidate.Did)
+		if err != nil {
+			return err
+		}
+		_, err = g.db.InsertReport(&database.Report{
+			Uid:        uid,
+			Subject:    candidate.Did,
+			Reporter:   reporter,
+			ReasonType: "com.atproto.moderation.defs#reasonOther",
+			Reason:     reason,
+			Cts:        time.Now().UnixMilli(),
+			Status:     database.ReportPending,
+		})
+		if err != nil {
+			return err
+		}
+		queued++
+	}
+
+	if len(blocks) != 0 {
+		err := g.blocker.BlockList().Add(blocks...)
+		for _, block := range blocks {
+			outcome := "ok"
+			if err != nil {
+				outcome = err.Error()
+			}
+			record := &database.ModerationAction{
+				Actor:   GraphActor,
+				Action:  "block",
+				Subject: block.Did,
+				Reason:  block.Reason,
+				Outcome: outcome,
+			}
+			if err := g.db.RecordAction(record); err != nil {
+				g.log.Error("failed to record moderation action", "subject", block.Did, "err", err)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	g.lock.Lock()
+	g.stats.Queued = queued
+	g.stats.Blocked = len(blocks)
+	g.lock.Unlock()
+	g.log.Info("graph propagated", "candidates", len(candidates), "queued", queued, "blocked", len(blocks))
+	return nil
+}
+
+func (g *FollowGraph) round() error {
+	candidates, err := g.rank()
+	if err != nil {
+		return err
+	}
+	return g.propagate(candidates)
+}
+
+func (g *FollowGraph) Run(ctx context.Context) chan bool {
+	done := make(chan bool)
+	go func() {
+		defer func() {
+			g.log.Info("graph propagation stopped")
+			done <- true
+		}()
+		if !g.Enabled() {
+			<-ctx.Done()
+			return
+		}
+		round := func() {
+			if err := g.round(); err != nil {
+				g.log.Error("failed to propagate blocks over the follow graph", "err", err)
+			}
+		}
+
+		// seeds from the block list file are unknown until it is read, and their follows would be pruned
+		select {
+		case <-ctx.Done():
+			return
+		case <-g.blocker.BlockList().Loaded():
+		}
+		round()
+
+		// backfilling takes a while, so rank in the meantime and again once it is done
+		backfilled := make(chan int, 1)
+		backfill := func() {
+			go func() {
+				backfilled <- g.backfill(ctx)
+			}()
+		}
+		backfill()
+		backfilling := true
+
+		ticker := time.NewTicker(config.GraphRankInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case count := <-backfilled:
+				backfilling = false
+				if count != 0 {
+					round()
+				}
+			case <-ticker.C:
+				round()
+				// new seeds are backfilled once per round
+				if !backfilling {
+					backfill()
+					backfilling = true
+				}
+			}
+		}
+	}()
+	return done
+}
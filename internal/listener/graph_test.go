@@ -0,0 +1,122 @@
+package listener
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPersonalizedPageRank(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		edges   [][2]int
+		weights []float64
+		damping float64
+		scores  []float64
+	}{
+		{
+			name:    "no follows",
+			n:       2,
+			weights: []float64{1, 3},
+			damping: 0.7,
+			scores:  []float64{0.25, 0.75},
+		},
+		{
+			name:    "seed follows a dangling user",
+			n:       2,
+			edges:   [][2]int{{0, 1}},
+			weights: []float64{1, 0},
+			damping: 0.5,
+			// s0 = (1-d) + d*s1, s1 = d*s0
+			scores: []float64{2.0 / 3, 1.0 / 3},
+		},
+		{
+			name:    "seed follows two users",
+			n:       3,
+			edges:   [][2]int{{0, 1}, {0, 2}},
+			weights: []float64{1, 0, 0},
+			damping: 0.5,
+			scores:  []float64{2.0 / 3, 1.0 / 6, 1.0 / 6},
+		},
+		{
+			name:    "uniform cycle",
+			n:       3,
+			edges:   [][2]int{{0, 1}, {1, 2}, {2, 0}},
+			weights: []float64{1, 1, 1},
+			damping: 0.85,
+			scores:  []float64{1.0 / 3, 1.0 / 3, 1.0 / 3},
+		},
+		{
+			name:    "followers of a seed",
+			n:       3,
+			edges:   [][2]int{{1, 0}, {2, 0}, {0, 1}},
+			weights: []float64{1, 0, 0},
+			damping: 0.5,
+			// s0 = (1-d) + d*(s1+s2), s1 = d*s0, s2 = 0
+			scores: []float64{2.0 / 3, 1.0 / 3, 0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scores := personalizedPageRank(test.n, test.edges, test.weights, test.damping)
+			total := 0.0
+			for i, score := range scores {
+				total += score
+				if math.Abs(score-test.scores[i]) > 1e-9 {
+					t.Errorf("got scores %v, expected %v", scores, test.scores)
+					break
+				}
+			}
+			if math.Abs(total-1) > 1e-9 {
+				t.Errorf("scores add up to %v, expected 1", total)
+			}
+		})
+	}
+}
+
+// newTestGraph sets up a follow graph over a jetstream listener with the CSV block list
+// and the users blocked in the database
+func newTestGraph(t *testing.T, csv string, blocked ...string) (*FollowGraph, *ModListsInSync) {
+	t.Helper()
+	listener := newTestJetstream(t, csv, blocked...)
+	return &FollowGraph{log: discardLogger(), db: listener.db, blocker: listener}, listener.modLists
+}
+
+func TestGraphSeeds(t *testing.T) {
+	graph, modLists := newTestGraph(t,
+		"did:plc:csv,spam,by hand\n"+
+			"did:plc:graph,graph,graph rank 0.2\n"+
+			"did:plc:dbgraph,graph,graph rank 0.3\n",
+		"did:plc:db", "did:plc:dbmod", "did:plc:dbgraph",
+	)
+	modLists.items.add(recordKey("did:plc:owner", "1"), indexedRecord{Group: "list", CompactDid: "plc:dbmod"})
+	modLists.items.add(recordKey("did:plc:owner", "2"), indexedRecord{Group: "list", CompactDid: "plc:mod"})
+
+	seeds, err := graph.seeds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for did, seed := range map[string]bool{
+		"plc:db":      true,
+		"plc:dbmod":   true,
+		"plc:csv":     true,
+		"plc:graph":   false,
+		"plc:dbgraph": false,
+		"plc:mod":     false,
+		"plc:none":    false,
+	} {
+		if got := graph.isSeed(did); got != seed {
+			t.Errorf("isSeed(%s) = %v, expected %v", did, got, seed)
+		}
+		if _, got := seeds[did]; got != seed {
+			t.Errorf("%s in seeds = %v, expected %v", did, got, seed)
+		}
+	}
+}
+
+func TestGraphSeedsMalformedBlockList(t *testing.T) {
+	graph, _ := newTestGraph(t, "did:plc:csv\nnot a did!\n")
+	if _, err := graph.seeds(); err == nil {
+		t.Error("expected an error for the malformed line")
+	}
+}
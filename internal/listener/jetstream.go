@@ -2,11 +2,13 @@ package listener
 
 import (
 	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
 	"bluesky-oneshot-labeler/internal/database"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"math"
 	"runtime"
 	"strings"
 	"sync"
@@ -14,11 +16,14 @@ import (
 	"time"
 
 	"github.com/bits-and-blooms/bloom/v3"
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/jetstream/pkg/client"
 	"github.com/bluesky-social/jetstream/pkg/client/schedulers/parallel"
 	"github.com/bluesky-social/jetstream/pkg/models"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/time/rate"
 )
 
 type SerializableInt64 atomic.Int64
@@ -26,11 +31,13 @@ type SerializableInt64 atomic.Int64
 type FeedStats struct {
 	StartedAt time.Time
 
-	ItemsReceived        SerializableInt64
-	ItemsPersisted       SerializableInt64
-	ItemsBlockedByDb     SerializableInt64
-	ItemsBlockedByCsv    SerializableInt64
-	ItemsBlockedByFilter SerializableInt64
+	ItemsReceived          SerializableInt64
+	ItemsPersisted         SerializableInt64
+	ItemsBlockedByDb       SerializableInt64
+	ItemsBlockedByCsv      SerializableInt64
+	ItemsBlockedByList     SerializableInt64
+	ItemsBlockedByCurators SerializableInt64
+	ItemsBlockedByFilter   SerializableInt64
 }
 
 func (i *SerializableInt64) MarshalJSON() ([]byte, error) {
@@ -43,6 +50,12 @@ func (i *SerializableInt64) Load() int64 {
 	return (*atomic.Int64)(i).Load()
 }
 
+// recentQuotes is how many quoting posts are remembered
+const recentQuotes = 1 << 18
+
+// pendingQuoteChecks is how many posts may wait for the quoted posts to be fetched
+const pendingQuoteChecks = 1024
+
 type JetstreamListener struct {
 	log *slog.Logger
 
@@ -53,15 +66,37 @@ type JetstreamListener struct {
 	bloomApprox  int64
 	bloomFilter  *bloom.BloomFilter
 	blockList    *BlockListInSync
+	modLists     *ModListsInSync
+	curators     *CuratorBlocksInSync
+	graph        *FollowGraph
 	listUpdated  chan bool
 	persistQueue chan string
 
+	// quotes maps recent posts to the posts they quote ("" for none), to follow chains of quotes
+	quotes *lru.Cache[string, string]
+	// postLimiter paces the posts fetched to follow chains of quotes
+	postLimiter *rate.Limiter
+	// quoteChecks holds the posts waiting for the quoted posts to be fetched, see checkQuotes
+	quoteChecks chan quoteCheck
+	// allowed holds the users (without "did:") exempted by moderators
+	allowed atomic.Pointer[map[string]struct{}]
+
 	Stats FeedStats
 }
 
-func NewJetStreamListener(upstream *LabelListener, blockList *BlockListInSync, logger *slog.Logger) (*JetstreamListener, error) {
+func NewJetStreamListener(upstream *LabelListener, blockList *BlockListInSync, modLists *ModListsInSync, curators *CuratorBlocksInSync, graph *FollowGraph, logger *slog.Logger) (*JetstreamListener, error) {
+	postsPerSecond := max(1, config.AppViewRateLimit/10)
 	config := client.DefaultClientConfig()
 	config.WantedCollections = []string{"app.bsky.feed.post"}
+	if modLists.Enabled() {
+		config.WantedCollections = append(config.WantedCollections, listItemCollection)
+	}
+	if curators.Enabled() {
+		config.WantedCollections = append(config.WantedCollections, blockCollection)
+	}
+	if graph.Enabled() {
+		config.WantedCollections = append(config.WantedCollections, followCollection)
+	}
 	config.WebsocketURL = "wss://jetstream2.us-west.bsky.network/subscribe"
 
 	db := database.Instance()
@@ -76,6 +111,11 @@ func NewJetStreamListener(upstream *LabelListener, blockList *BlockListInSync, l
 	}
 	syncTime.Store(cursorUs)
 
+	quotes, err := lru.New[string, string](recentQuotes)
+	if err != nil {
+		return nil, err
+	}
+
 	listener := &JetstreamListener{
 		log:         logger,
 		db:          db,
@@ -83,8 +123,15 @@ func NewJetStreamListener(upstream *LabelListener, blockList *BlockListInSync, l
 		bloomApprox: blockCount,
 		bloomFilter: bloom.NewWithEstimates(uint(blockCount), 0.01),
 		blockList:   blockList,
+		modLists:    modLists,
+		curators:    curators,
+		graph:       graph,
+		quotes:      quotes,
 		listUpdated: make(chan bool, 1),
 
+		postLimiter: rate.NewLimiter(rate.Limit(postsPerSecond), postsPerSecond),
+		quoteChecks: make(chan quoteCheck, pendingQuoteChecks),
+
 		persistQueue: make(chan string, runtime.NumCPU()*32),
 
 		Stats: FeedStats{
@@ -92,6 +139,12 @@ func NewJetStreamListener(upstream *LabelListener, blockList *BlockListInSync, l
 		},
 	}
 	blockList.SetNotifier(listener.notifyListUpdated)
+	modLists.SetNotifier(listener.notifyListUpdated)
+	curators.SetNotifier(listener.notifyListUpdated)
+	graph.blocker = listener
+	if err := listener.ReloadAllowed(); err != nil {
+		return nil, err
+	}
 
 	scheduler := parallel.NewScheduler(
 		runtime.NumCPU(), // language classification can be CPU intensive
@@ -108,6 +161,26 @@ func NewJetStreamListener(upstream *LabelListener, blockList *BlockListInSync, l
 	return listener, nil
 }
 
+// BlockList returns the external block list
+func (l *JetstreamListener) BlockList() *BlockListInSync {
+	return l.blockList
+}
+
+// ModLists returns the subscribed moderation lists
+func (l *JetstreamListener) ModLists() *ModListsInSync {
+	return l.modLists
+}
+
+// Curators returns the blocks of the trusted curators
+func (l *JetstreamListener) Curators() *CuratorBlocksInSync {
+	return l.curators
+}
+
+// Graph returns the follow graph used to propagate blocks
+func (l *JetstreamListener) Graph() *FollowGraph {
+	return l.graph
+}
+
 func (l *JetstreamListener) notifyListUpdated() {
 	select {
 	case l.listUpdated <- true:
@@ -121,6 +194,14 @@ func (l *JetstreamListener) HandleEvent(ctx context.Context, event *models.Event
 		return nil
 	}
 	commit := event.Commit
+	switch commit.Collection {
+	case listItemCollection:
+		return l.modLists.HandleEvent(event)
+	case blockCollection:
+		return l.curators.HandleEvent(event)
+	case followCollection:
+		return l.graph.HandleEvent(event)
+	}
 	if commit.Operation != "create" || commit.Collection != "app.bsky.feed.post" {
 		return nil
 	}
@@ -130,7 +211,10 @@ func (l *JetstreamListener) HandleEvent(ctx context.Context, event *models.Event
 	if err := json.Unmarshal(commit.Record, &post); err != nil {
 		return err
 	}
-	if post.Reply != nil {
+	if quoted := quotedUri(&post); quoted != "" {
+		l.quotes.Add("at://"+event.Did+"/"+commit.Collection+"/"+commit.RKey, quoted)
+	}
+	if post.Reply != nil && !config.FeedIncludeReplies {
 		return nil
 	}
 
@@ -149,36 +233,182 @@ func (l *JetstreamListener) HandleEvent(ctx context.Context, event *models.Event
 		l.incStats(blockList)
 		return nil
 	}
-	if post.Embed != nil {
-		record := post.Embed.EmbedRecord
-		if record == nil && post.Embed.EmbedRecordWithMedia != nil {
-			record = post.Embed.EmbedRecordWithMedia.Record
-		}
-		if record != nil {
-			uri, err := syntax.ParseATURI(record.Record.Uri)
-			if err == nil {
-				embedDid := strings.TrimPrefix(uri.Authority().String(), "did:")
-				blockList = l.InBlockList(embedDid)
-				if blockList != OutOfBlockList {
-					l.incStats(blockList)
-					return nil
-				}
-			}
-		}
+	blockList, complete := l.relatedBlockList(&post)
+	if blockList != OutOfBlockList {
+		l.incStats(blockList)
+		return nil
 	}
 
-	if !l.ShouldKeepFeedItemCostly(ctx, &post, did) {
+	if !l.ShouldKeepFeedItemCostly(ctx, &post, event) {
 		l.Stats.ItemsBlockedByFilter.Inc()
 		return nil
 	}
 
 	// uri := "at://" + event.Did + "/" + commit.Collection + "/" + commit.RKey
 	compactUri := event.Did + "/" + commit.RKey
+	if !complete {
+		// only posts about to be kept fetch the quoted posts we have not seen
+		l.checkQuotesLater(compactUri, relatedUris(&post))
+		return nil
+	}
 	l.log.Debug("keeping feed item", "uri", compactUri, "lang", post.Langs, "content", post.Text)
 	l.persistQueue <- compactUri
 	return nil
 }
 
+// maxQuoteDepth is how many quoted posts are followed down a chain of quotes
+const maxQuoteDepth = 4
+
+// quotedUri returns the uri of the post quoted by the post, if any
+func quotedUri(post *bsky.FeedPost) string {
+	if post.Embed == nil {
+		return ""
+	}
+	record := post.Embed.EmbedRecord
+	if record == nil && post.Embed.EmbedRecordWithMedia != nil {
+		record = post.Embed.EmbedRecordWithMedia.Record
+	}
+	if record == nil || record.Record == nil {
+		return ""
+	}
+	return record.Record.Uri
+}
+
+// relatedUris returns the posts a post replies to or quotes
+func relatedUris(post *bsky.FeedPost) []string {
+	var uris []string
+	if post.Reply != nil {
+		for _, ref := range []*comatproto.RepoStrongRef{post.Reply.Root, post.Reply.Parent} {
+			if ref != nil {
+				uris = append(uris, ref.Uri)
+			}
+		}
+	}
+	if quoted := quotedUri(post); quoted != "" {
+		uris = append(uris, quoted)
+	}
+	return uris
+}
+
+// relatedBlockList checks the users a post replies to, quotes or mentions, unless FEED_KEEP_MENTIONS is set.
+//
+// Quotes are followed through the posts quoted by the quoted (or replied) posts,
+// as far as we have seen them recently, and complete tells if none of the chains
+// of quotes ran into a post we have not seen.
+func (l *JetstreamListener) relatedBlockList(post *bsky.FeedPost) (blockList int, complete bool) {
+	blockList, complete = l.chainBlockList(context.Background(), relatedUris(post), false)
+	if blockList != OutOfBlockList || config.FeedKeepMentions {
+		return blockList, complete
+	}
+
+	for _, facet := range post.Facets {
+		for _, feature := range facet.Features {
+			if feature.RichtextFacet_Mention == nil {
+				continue
+			}
+			did := strings.TrimPrefix(feature.RichtextFacet_Mention.Did, "did:")
+			if blockList := l.InBlockList(did); blockList != OutOfBlockList {
+				return blockList, complete
+			}
+		}
+	}
+	return OutOfBlockList, complete
+}
+
+// chainBlockList checks the authors of the posts and of the posts they quote, down to maxQuoteDepth,
+// fetching the posts missing from the recent quotes from the AppView if asked to.
+//
+// The chains are complete unless they run into posts missing from the recent quotes without fetching.
+func (l *JetstreamListener) chainBlockList(ctx context.Context, uris []string, fetch bool) (blockList int, complete bool) {
+	complete = true
+	for _, uri := range uris {
+		for depth := range maxQuoteDepth {
+			parsed, err := syntax.ParseATURI(uri)
+			if err != nil {
+				break
+			}
+			did := strings.TrimPrefix(parsed.Authority().String(), "did:")
+			if blockList := l.InBlockList(did); blockList != OutOfBlockList {
+				return blockList, true
+			}
+			if depth == maxQuoteDepth-1 {
+				break
+			}
+			next, ok := l.quotes.Get(uri)
+			if !ok && fetch {
+				next, ok = l.fetchQuotedUri(ctx, uri)
+			} else if !ok {
+				complete = false
+			}
+			if !ok || next == "" {
+				break
+			}
+			uri = next
+		}
+	}
+	return OutOfBlockList, complete
+}
+
+// quoteCheck is a post to keep unless the chains of quotes of the related posts lead to blocked users
+type quoteCheck struct {
+	compactUri string
+	uris       []string
+}
+
+// checkQuotesLater hands a post over to checkQuotes, so that fetching the quoted posts does not hold up Jetstream.
+// The post is kept right away if too many posts are waiting already.
+func (l *JetstreamListener) checkQuotesLater(compactUri string, uris []string) {
+	select {
+	case l.quoteChecks <- quoteCheck{compactUri: compactUri, uris: uris}:
+	default:
+		l.log.Debug("too many posts waiting for quoted posts, keeping feed item", "uri", compactUri)
+		l.persistQueue <- compactUri
+	}
+}
+
+// checkQuotes fetches the quoted posts missing from the recent quotes for the posts
+// handed over by checkQuotesLater, one at a time, and keeps the posts not leading to blocked users
+func (l *JetstreamListener) checkQuotes(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case check := <-l.quoteChecks:
+			if blockList, _ := l.chainBlockList(ctx, check.uris, true); blockList != OutOfBlockList {
+				l.incStats(blockList)
+				continue
+			}
+			l.log.Debug("keeping feed item", "uri", check.compactUri)
+			select {
+			case l.persistQueue <- check.compactUri:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// fetchQuotedUri fetches a post from the AppView and remembers what it quotes, returning false on errors
+func (l *JetstreamListener) fetchQuotedUri(ctx context.Context, uri string) (string, bool) {
+	if err := l.postLimiter.Wait(ctx); err != nil {
+		return "", false
+	}
+	out, err := bsky.FeedGetPosts(ctx, at_utils.PubClient, []string{uri})
+	if err != nil {
+		l.log.Debug("failed to fetch quoted post", "uri", uri, "err", err)
+		return "", false
+	}
+	quoted := ""
+	// deleted posts are left out, and quote nothing
+	if len(out.Posts) != 0 && out.Posts[0].Record != nil {
+		if post, ok := out.Posts[0].Record.Val.(*bsky.FeedPost); ok {
+			quoted = quotedUri(post)
+		}
+	}
+	l.quotes.Add(uri, quoted)
+	return quoted, true
+}
+
 func (l *JetstreamListener) Persist(ctx context.Context, done chan bool) {
 	lock := sync.Mutex{}
 
@@ -253,6 +483,7 @@ func (l *JetstreamListener) PruneBlockedEntries(lock *sync.Mutex) error {
 func (l *JetstreamListener) Run(ctx context.Context) chan bool {
 	persitCtx, cancelPersist := context.WithCancel(context.Background())
 	go l.KeepBloomFilterInSync(ctx)
+	go l.checkQuotes(ctx)
 
 	go func() {
 		for {
@@ -294,6 +525,10 @@ func (l *JetstreamListener) KeepBloomFilterInSync(ctx context.Context) {
 			return
 		default:
 			err := l.notifier.ForAllLabelsSince(ctx, 0, func(block *Block, new bool) error {
+				if block.Removed {
+					// bloom filters do not support removal
+					return RebuildFilterError{NewSize: approx}
+				}
 				id := block.Id
 				did := block.CompactDid
 				if id > approx*2 {
@@ -311,6 +546,10 @@ func (l *JetstreamListener) KeepBloomFilterInSync(ctx context.Context) {
 					l.log.Debug("rebuilding bloom filter", "new_size", newSize.NewSize)
 					filter = bloom.NewWithEstimates(uint(newSize.NewSize), 0.01)
 					approx = newSize.NewSize
+					// fill the new filter before swapping so that blocked users do not slip through
+					if err := l.fillBloomFilter(filter); err != nil {
+						l.log.Error("failed to fill bloom filter", "err", err)
+					}
 					l.bloomApprox = approx
 					l.bloomFilter = filter
 				} else {
@@ -321,29 +560,80 @@ func (l *JetstreamListener) KeepBloomFilterInSync(ctx context.Context) {
 	}
 }
 
+func (l *JetstreamListener) fillBloomFilter(filter *bloom.BloomFilter) error {
+	blocks, err := l.db.GetBlocksSince(0, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		filter.AddString(block.CompactDid)
+	}
+	return nil
+}
+
 const (
-	OutOfBlockList = 0
-	BlockListDb    = 1
-	BlockListCsv   = 2
+	OutOfBlockList   = 0
+	BlockListDb      = 1
+	BlockListCsv     = 2
+	BlockListMod     = 3
+	BlockListCurated = 4
 )
 
+// ReloadAllowed loads the users exempted by moderators
+func (l *JetstreamListener) ReloadAllowed() error {
+	dids, err := l.db.GetAllowedUsers()
+	if err != nil {
+		return err
+	}
+	allowed := make(map[string]struct{}, len(dids))
+	for _, did := range dids {
+		allowed[did] = struct{}{}
+	}
+	l.allowed.Store(&allowed)
+	return nil
+}
+
+func (l *JetstreamListener) isAllowed(did string) bool {
+	allowed := l.allowed.Load()
+	if allowed == nil {
+		return false
+	}
+	_, ok := (*allowed)[did]
+	return ok
+}
+
 func (l *JetstreamListener) InBlockList(did string) int {
 	if l.blockList.Contains(did) {
 		return BlockListCsv
 	}
+	// users allowed by moderators are exempt from third-party blocks as well,
+	// while allowing a user removes them from the CSV file
+	if !l.isAllowed(did) {
+		if l.modLists.Contains(did) {
+			return BlockListMod
+		}
+		if l.curators.Contains(did) {
+			return BlockListCurated
+		}
+	}
 
+	if l.inDbBlockList(did) {
+		return BlockListDb
+	}
+	return OutOfBlockList
+}
+
+// inDbBlockList tells if the user is blocked in the database, i.e. the internal block list
+func (l *JetstreamListener) inDbBlockList(did string) bool {
 	if !l.bloomFilter.TestString(did) {
-		return OutOfBlockList
+		return false
 	}
 	labeled, err := l.db.IsUserBlocked(did)
 	if err != nil {
 		l.log.Error("failed to check if user is labeled", "err", err)
-		return OutOfBlockList
+		return false
 	}
-	if labeled {
-		return BlockListDb
-	}
-	return OutOfBlockList
+	return labeled
 }
 
 func (l *JetstreamListener) incStats(inBlockList int) {
@@ -352,5 +642,9 @@ func (l *JetstreamListener) incStats(inBlockList int) {
 		l.Stats.ItemsBlockedByDb.Inc()
 	case BlockListCsv:
 		l.Stats.ItemsBlockedByCsv.Inc()
+	case BlockListMod:
+		l.Stats.ItemsBlockedByList.Inc()
+	case BlockListCurated:
+		l.Stats.ItemsBlockedByCurators.Inc()
 	}
 }
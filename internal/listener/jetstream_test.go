@@ -0,0 +1,189 @@
+package listener
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bits-and-blooms/bloom/v3"
+	"github.com/bluesky-social/indigo/xrpc"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/time/rate"
+)
+
+// newTestJetstream returns a listener blocking the users of the csv block list and the blocked users
+func newTestJetstream(t *testing.T, csv string, blocked ...string) *JetstreamListener {
+	t.Helper()
+	db := openTestDatabase(t)
+	path := filepath.Join(t.TempDir(), "blocklist.csv")
+	if err := os.WriteFile(path, []byte(csv), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	blockList, err := NewBlockListInSync(path, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blockList.update(); err != nil {
+		t.Fatal(err)
+	}
+	modLists, err := NewModListsInSync(nil, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotes, err := lru.New[string, string](100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &JetstreamListener{
+		log:          discardLogger(),
+		db:           db,
+		bloomFilter:  bloom.NewWithEstimates(100, 0.01),
+		blockList:    blockList,
+		modLists:     modLists,
+		curators:     newTestCurators(1),
+		quotes:       quotes,
+		postLimiter:  rate.NewLimiter(rate.Inf, 1),
+		quoteChecks:  make(chan quoteCheck, 1),
+		persistQueue: make(chan string, 1),
+	}
+	for _, did := range blocked {
+		uid, err := db.GetUserId(did)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := db.InsertBlock(uid); err != nil {
+			t.Fatal(err)
+		}
+		listener.bloomFilter.AddString(strings.TrimPrefix(did, "did:"))
+	}
+	return listener
+}
+
+func postUri(did string) string {
+	return "at://" + did + "/app.bsky.feed.post/1"
+}
+
+// quoteChain remembers each of the users' posts as quoting the post of the next user
+func quoteChain(l *JetstreamListener, dids ...string) {
+	for i := range len(dids) - 1 {
+		l.quotes.Add(postUri(dids[i]), postUri(dids[i+1]))
+	}
+}
+
+func TestChainBlockListDepth(t *testing.T) {
+	dids := []string{"did:plc:a", "did:plc:b", "did:plc:c", "did:plc:d", "did:plc:e"}
+	tests := []struct {
+		blocked  string
+		expected int
+	}{
+		{"did:plc:a", BlockListDb},
+		{"did:plc:d", BlockListDb},
+		// past maxQuoteDepth
+		{"did:plc:e", OutOfBlockList},
+	}
+	for _, test := range tests {
+		t.Run(test.blocked, func(t *testing.T) {
+			listener := newTestJetstream(t, "", test.blocked)
+			quoteChain(listener, dids...)
+			blockList, complete := listener.chainBlockList(context.Background(), []string{postUri(dids[0])}, false)
+			if blockList != test.expected {
+				t.Errorf("got block list %d, expected %d", blockList, test.expected)
+			}
+			if !complete {
+				t.Error("chain of recent quotes reported incomplete")
+			}
+		})
+	}
+}
+
+func TestChainBlockListCycle(t *testing.T) {
+	listener := newTestJetstream(t, "")
+	quoteChain(listener, "did:plc:a", "did:plc:b", "did:plc:a")
+	blockList, complete := listener.chainBlockList(context.Background(), []string{postUri("did:plc:a")}, false)
+	if blockList != OutOfBlockList || !complete {
+		t.Errorf("got %d, %v, expected the cycle to end out of the block list", blockList, complete)
+	}
+}
+
+func TestChainBlockListUnseenQuote(t *testing.T) {
+	listener := newTestJetstream(t, "", "did:plc:c")
+	quoteChain(listener, "did:plc:a", "did:plc:b")
+	uris := []string{postUri("did:plc:a")}
+
+	blockList, complete := listener.chainBlockList(context.Background(), uris, false)
+	if blockList != OutOfBlockList || complete {
+		t.Errorf("got %d, %v, expected the chain to stop at the post not seen", blockList, complete)
+	}
+
+	listener.quotes.Add(postUri("did:plc:b"), postUri("did:plc:c"))
+	if blockList, _ := listener.chainBlockList(context.Background(), uris, false); blockList != BlockListDb {
+		t.Errorf("got %d once the quote is seen, expected %d", blockList, BlockListDb)
+	}
+}
+
+func TestCheckQuotesLaterDoesNotBlock(t *testing.T) {
+	listener := newTestJetstream(t, "")
+	listener.quoteChecks = make(chan quoteCheck)
+
+	done := make(chan bool)
+	go func() {
+		listener.checkQuotesLater("did:plc:a/1", []string{postUri("did:plc:b")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waited for the quoted posts to be checked")
+	}
+	if uri := <-listener.persistQueue; uri != "did:plc:a/1" {
+		t.Errorf("persisted %s, expected the post to be kept", uri)
+	}
+}
+
+func TestCheckQuotes(t *testing.T) {
+	// the AppView has b's post quoting the blocked user and c's post quoting nothing
+	appView := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri := r.URL.Query().Get("uris")
+		embed := ""
+		if uri == postUri("did:plc:b") {
+			embed = fmt.Sprintf(`,"embed":{"$type":"app.bsky.embed.record","record":{"uri":%q,"cid":"bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"}}`, postUri("did:plc:blocked"))
+		}
+		fmt.Fprintf(w, `{"posts":[{"uri":%q,"cid":"bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm","author":{"did":"did:plc:b","handle":"b.test"},"indexedAt":"2024-01-01T00:00:00Z","record":{"$type":"app.bsky.feed.post","text":"","createdAt":"2024-01-01T00:00:00Z"%s}}]}`, uri, embed)
+	}))
+	pubClient := at_utils.PubClient
+	t.Cleanup(func() {
+		appView.Close()
+		at_utils.PubClient = pubClient
+	})
+	at_utils.PubClient = &xrpc.Client{Host: appView.URL}
+
+	listener := newTestJetstream(t, "", "did:plc:blocked")
+	listener.quoteChecks = make(chan quoteCheck, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go listener.checkQuotes(ctx)
+
+	listener.checkQuotesLater("did:plc:a/1", []string{postUri("did:plc:b")})
+	listener.checkQuotesLater("did:plc:a/2", []string{postUri("did:plc:c")})
+	select {
+	case uri := <-listener.persistQueue:
+		if uri != "did:plc:a/2" {
+			t.Errorf("persisted %s, expected only the post not leading to the blocked user", uri)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("post not persisted")
+	}
+	if listener.Stats.ItemsBlockedByDb.Load() != 1 {
+		t.Errorf("got %d posts blocked, expected 1", listener.Stats.ItemsBlockedByDb.Load())
+	}
+	if quoted, ok := listener.quotes.Get(postUri("did:plc:b")); !ok || quoted != postUri("did:plc:blocked") {
+		t.Errorf("fetched quote not remembered: %q, %v", quoted, ok)
+	}
+}
@@ -0,0 +1,173 @@
+package listener
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// labelMappings maps upstream identifiers (handles or DIDs) to their label value overrides
+type labelMappings map[string]map[string]LabelKind
+
+func ParseLabelKind(s string) (LabelKind, error) {
+	switch s {
+	case at_utils.LabelPornString:
+		return LabelPorn, nil
+	case at_utils.LabelSexualString:
+		return LabelSexual, nil
+	case at_utils.LabelNudityString:
+		return LabelNudity, nil
+	case at_utils.LabelGraphicMediaString:
+		return LabelGraphicMedia, nil
+	case at_utils.LabelOthersString:
+		return LabelOthers, nil
+	case "ignore":
+		return LabelIgnored, nil
+	}
+	return LabelIgnored, fmt.Errorf("unknown label kind: %s", s)
+}
+
+// loadLabelMappings reads a JSON file of the following format:
+//
+//	{ "moderation.bsky.app": { "spam": "ignore", "porn": "porn", ... }, ... }
+func loadLabelMappings(path string) (labelMappings, error) {
+	mappings := make(labelMappings)
+	if path == "" {
+		return mappings, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]map[string]string
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("invalid label mapping file %s: %w", path, err)
+	}
+	for upstream, values := range raw {
+		mapping := make(map[string]LabelKind, len(values))
+		for val, kindStr := range values {
+			kind, err := ParseLabelKind(kindStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid label mapping for %s in %s: %w", val, upstream, err)
+			}
+			mapping[val] = kind
+		}
+		mappings[upstream] = mapping
+	}
+	return mappings, nil
+}
+
+// lookup finds the overrides of an upstream, either by its configured identifier or its DID
+func (m labelMappings) lookup(name string, did syntax.DID) map[string]LabelKind {
+	if mapping, ok := m[name]; ok {
+		return mapping
+	}
+	return m[did.String()]
+}
+
+// buildLabelMapping guesses a LabelKind for each label value the upstream defines,
+// unless it is explicitly configured in overrides.
+func buildLabelMapping(policies *bsky.LabelerDefs_LabelerPolicies, overrides map[string]LabelKind) map[string]LabelKind {
+	m := make(map[string]LabelKind)
+	m[at_utils.LabelPornString] = LabelPorn
+	m[at_utils.LabelSexualString] = LabelSexual
+	m[at_utils.LabelNudityString] = LabelNudity
+	m[at_utils.LabelGraphicMediaString] = LabelGraphicMedia
+	for _, policy := range policies.LabelValueDefinitions {
+		m[policy.Identifier] = guessLabelKind(policy)
+	}
+	for val, kind := range overrides {
+		m[val] = kind
+	}
+	return m
+}
+
+func guessLabelKind(policy *atproto.LabelDefs_LabelValueDefinition) LabelKind {
+	if policy.AdultOnly != nil && *policy.AdultOnly {
+		return LabelSexual
+	} else if policy.Blurs != "none" {
+		return LabelGraphicMedia
+	}
+	return LabelOthers
+}
+
+// DumpLabelMappings prints the label definitions of all upstream labelers
+// along with the mapping we would apply, so that operators can review it.
+func DumpLabelMappings(ctx context.Context, w io.Writer) error {
+	overrides, err := loadLabelMappings(config.LabelMappingFile)
+	if err != nil {
+		return err
+	}
+	for _, upstream := range config.Upstreams {
+		id, err := syntax.ParseAtIdentifier(upstream.Identifier)
+		if err != nil {
+			return err
+		}
+		ident, err := at_utils.IdentityDirectory.Lookup(ctx, *id)
+		if err != nil {
+			return err
+		}
+		info, err := bsky.LabelerGetServices(ctx, at_utils.Client, true, []string{ident.DID.String()})
+		if err != nil {
+			return err
+		}
+		if len(info.Views) != 1 || info.Views[0].LabelerDefs_LabelerViewDetailed == nil {
+			return fmt.Errorf("labeler service of %s not found", upstream.Identifier)
+		}
+		policies := info.Views[0].LabelerDefs_LabelerViewDetailed.Policies
+		configured := overrides.lookup(upstream.Identifier, ident.DID)
+		mapping := buildLabelMapping(policies, configured)
+
+		fmt.Fprintf(w, "# %s (%s), weight %s\n", upstream.Identifier, ident.DID, strconv.FormatFloat(upstream.Weight, 'f', -1, 64))
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VALUE\tSEVERITY\tBLURS\tADULT\tDEFAULT\tKIND\tORIGIN")
+		defined := make(map[string]bool)
+		for _, policy := range policies.LabelValueDefinitions {
+			defined[policy.Identifier] = true
+			adult := policy.AdultOnly != nil && *policy.AdultOnly
+			defaultSetting := "-"
+			if policy.DefaultSetting != nil {
+				defaultSetting = *policy.DefaultSetting
+			}
+			origin := "guessed"
+			if _, ok := configured[policy.Identifier]; ok {
+				origin = "configured"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%s\t%s\t%s\n",
+				policy.Identifier, policy.Severity, policy.Blurs, adult, defaultSetting,
+				mapping[policy.Identifier], origin,
+			)
+		}
+		// global label values and overrides of values not defined by the upstream
+		var others []string
+		for val := range mapping {
+			if !defined[val] {
+				others = append(others, val)
+			}
+		}
+		slices.Sort(others)
+		for _, val := range others {
+			origin := "default"
+			if _, ok := configured[val]; ok {
+				origin = "configured"
+			}
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t%s\t%s\n", val, mapping[val], origin)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
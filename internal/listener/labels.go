@@ -7,17 +7,12 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"math"
-	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/atproto/syntax"
-	"github.com/bluesky-social/indigo/events"
-	"github.com/bluesky-social/indigo/events/schedulers/sequential"
-	"github.com/gorilla/websocket"
 )
 
 type LabelKind int
@@ -28,6 +23,9 @@ const (
 	LabelNudity
 	LabelGraphicMedia
 	LabelOthers
+
+	// LabelIgnored marks upstream label values that we do not count
+	LabelIgnored LabelKind = -1
 )
 
 func (l LabelKind) String() (val string) {
@@ -40,6 +38,8 @@ func (l LabelKind) String() (val string) {
 		val = at_utils.LabelNudityString
 	case LabelGraphicMedia:
 		val = at_utils.LabelGraphicMediaString
+	case LabelIgnored:
+		val = "ignore"
 	default:
 		val = "others"
 	}
@@ -49,169 +49,214 @@ func (l LabelKind) String() (val string) {
 type LabelListener struct {
 	log *slog.Logger
 
-	db        *database.Service
-	serverUrl *url.URL
-	labels    map[string]LabelKind
+	db      *database.Service
+	sources []*labelSource
 
-	cursor  atomic.Int64
 	counter atomic.Int64
 
 	watcher *AccountWatcher
 }
 
 func NewLabelListener(ctx context.Context, logger *slog.Logger) (*LabelListener, error) {
-	labeler, _ := syntax.ParseHandle(config.UpstreamUser)
-	ident, err := at_utils.IdentityDirectory.LookupHandle(ctx, labeler)
-	if err != nil {
-		return nil, err
-	}
-
 	db := database.Instance()
-	cursor, err := db.GetConfigInt("label-cursor", 0)
+	counter, err := db.GetConfigInt("label-counter", 0)
 	if err != nil {
 		return nil, err
 	}
-	counter, err := db.GetConfigInt("label-counter", 0)
+
+	watcher, err := NewAccountWatcher(logger)
 	if err != nil {
 		return nil, err
 	}
 
-	logger.Debug(config.UpstreamUser, "ident", ident)
-	for _, value := range ident.Services {
-		if value.Type == "AtprotoLabeler" {
-			u, err := url.Parse(value.URL)
-			if err != nil {
-				return nil, err
-			}
-
-			info, err := bsky.LabelerGetServices(ctx, at_utils.Client, true, []string{ident.DID.String()})
-			if err != nil {
-				return nil, err
-			}
-			if len(info.Views) != 1 {
-				return nil, fmt.Errorf("expected one service view, got %d", len(info.Views))
-			}
-			view := info.Views[0]
-			details := view.LabelerDefs_LabelerViewDetailed
-			if details == nil {
-				return nil, fmt.Errorf("labeler service view is not detailed")
-			}
+	listener := &LabelListener{
+		log:     logger,
+		db:      db,
+		watcher: watcher,
+	}
+	listener.counter.Store(counter)
+	if config.PublishLabels {
+		postLabeler = watcher.emitter.EmitPostLabel
+	}
 
-			watcher, err := NewAccountWatcher(logger)
-			if err != nil {
-				return nil, err
-			}
+	if err := ReloadMutedWords(db); err != nil {
+		return nil, err
+	}
 
-			listener := &LabelListener{
-				log:       logger,
-				labels:    buildLabelMapping(details.Policies),
-				serverUrl: u,
-				db:        db,
-				watcher:   watcher,
-			}
-			listener.cursor.Store(cursor)
-			listener.counter.Store(counter)
-			return listener, nil
+	if len(config.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream labelers configured")
+	}
+	overrides, err := loadLabelMappings(config.LabelMappingFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, upstream := range config.Upstreams {
+		source, err := newLabelSource(ctx, listener, upstream, overrides)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up upstream %s: %w", upstream.Identifier, err)
 		}
+		listener.sources = append(listener.sources, source)
+	}
+	if err := listener.adoptLegacyUpstream(ctx); err != nil {
+		return nil, fmt.Errorf("failed to adopt the legacy upstream: %w", err)
 	}
-	return nil, fmt.Errorf("labeler service not found")
+	return listener, nil
 }
 
 func (l *LabelListener) Run(ctx context.Context) chan bool {
 	done := make(chan bool)
 	watcherCtx, stopWatcher := context.WithCancel(context.Background())
 	go l.watcher.Listen(watcherCtx, done)
+	go l.startExpireLabels(ctx)
+	go l.startRenewLabels(ctx)
+	go l.startPersistSeq(ctx)
 
+	wg := sync.WaitGroup{}
+	wg.Add(len(l.sources))
+	for _, source := range l.sources {
+		go func() {
+			defer wg.Done()
+			source.run(ctx)
+		}()
+	}
 	go func() {
-		for {
-			l.log.Info("connecting in 1 second")
-			select {
-			case <-ctx.Done():
-				l.log.Info("context done, label listening stopped")
-				stopWatcher()
-				return
-			case <-time.After(1 * time.Second):
-				if err := l.listen(ctx); err != nil {
-					l.log.Error("failed to listen", "err", err)
-				}
-				l.log.Info("websocket disconnected")
-			}
+		wg.Wait()
+		l.log.Info("context done, label listening stopped")
+		if err := l.persistSeq(); err != nil {
+			l.log.Warn("failed to persist label cursor", "err", err)
 		}
+		stopWatcher()
 	}()
 	return done
 }
 
-func (l *LabelListener) listen(ctx context.Context) error {
-	u, _ := url.Parse("wss://example.com/xrpc/com.atproto.label.subscribeLabels")
-	u.Host = l.serverUrl.Host
-	u.RawQuery = fmt.Sprintf("cursor=%d", l.cursor.Load())
+func (l *LabelListener) Notifier() *BlockNotifier {
+	return l.watcher.notifier
+}
 
-	scheduler := sequential.NewScheduler("oneshot-labeler", l.HandleEvent)
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+func (l *LabelListener) Emitter() *LabelEmitter {
+	return l.watcher.emitter
+}
+
+// Stats returns statistics of each upstream labeler, keyed by their identifiers
+func (l *LabelListener) Stats() map[string]*UpstreamStats {
+	stats := make(map[string]*UpstreamStats, len(l.sources))
+	for _, source := range l.sources {
+		stats[source.name] = source.stats()
+	}
+	return stats
+}
+
+// UnblockAccount removes a user from the internal block list, e.g., on moderator request,
+// and starts their counters over
+func (l *LabelListener) UnblockAccount(did string) error {
+	uid, err := l.db.GetUserId(did)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-
-	go l.startPersistSeq(ctx)
-	err = events.HandleRepoStream(ctx, conn, scheduler, l.log)
+	return l.watcher.UnblockAccount(uid, did)
+}
 
-	if err2 := l.persistSeq(); err2 != nil && err == nil {
-		return err2
+// RecheckAccount queues a user for re-evaluation: blocked users are unblocked if they are
+// no longer over the limit, and other users are blocked if they are
+func (l *LabelListener) RecheckAccount(did string) error {
+	uid, err := l.db.GetUserId(did)
+	if err != nil {
+		return err
+	}
+	blocked, err := l.db.IsUserBlocked(strings.TrimPrefix(did, "did:"))
+	if err != nil {
+		return err
+	}
+	if blocked {
+		l.watcher.RecheckAccount(uid, did)
+	} else {
+		l.watcher.CheckAccount(uid, did, 0)
 	}
-	return err
+	return nil
 }
 
-func (l *LabelListener) Notifier() *BlockNotifier {
-	return l.watcher.notifier
+// retractLabel undoes a previously counted label and lets the watcher
+// unblock the user if they are no longer over the limit.
+func (l *LabelListener) retractLabel(src int64, uri string, val string, did string) {
+	uid, err := l.db.RetractUpstreamLabel(src, uri, val)
+	if err != nil {
+		l.log.Warn("failed to retract label", "uri", uri, "val", val, "err", err)
+		return
+	}
+	if uid != 0 {
+		l.log.Debug("label retracted", "uri", uri, "val", val)
+		l.watcher.RecheckAccount(uid, did)
+	}
 }
 
-func (l *LabelListener) HandleEvent(ctx context.Context, event *events.XRPCStreamEvent) error {
-	labels := event.LabelLabels
-	if labels == nil {
-		return nil
+func (l *LabelListener) startExpireLabels(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Minute):
+			if err := l.expireLabels(); err != nil {
+				l.log.Warn("failed to expire labels", "err", err)
+			}
+		}
 	}
-	for _, label := range labels.Labels {
-		if label.Neg != nil && *label.Neg {
-			continue
+}
+
+func (l *LabelListener) expireLabels() error {
+	for {
+		uids, err := l.db.RetractExpiredUpstreamLabels(time.Now(), 500)
+		if err != nil {
+			return err
 		}
-		kind, ok := l.labels[label.Val]
-		if !ok {
-			continue
+		if len(uids) == 0 {
+			return nil
 		}
-
-		info := explainLabel(label.Uri)
-		if info.Kind == LabelUnknown {
-			l.log.Warn("failed to parse label did", "uri", label.Uri)
-			continue
+		l.log.Debug("labels expired", "users", len(uids))
+		for _, uid := range uids {
+			did, err := l.db.GetUserDid(uid)
+			if err != nil {
+				return err
+			}
+			l.watcher.RecheckAccount(uid, did)
 		}
+	}
+}
 
-		uid, err := l.db.GetUserId(info.Did)
-		if err != nil {
-			l.log.Warn("failed to get user id", "did", info.Did, "err", err)
-			continue
-		}
-		var count int64
-		switch info.Kind {
-		case LabelOnList:
-			fallthrough
-		case LabelOnFeed:
-			fallthrough
-		case LabelOnPost:
-			count, err = l.db.IncrementCounter(uid, int(kind))
-		case LabelOnProfile:
-			count, err = l.db.MultiplyCounter(uid, int(kind))
-		case LabelOnUser:
-			count = math.MaxInt64
+func (l *LabelListener) startRenewLabels(ctx context.Context) {
+	if _, ok := config.LabelExpiry[at_utils.LabelOffenderString]; !ok || !config.PublishLabels {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Minute):
+			if err := l.renewLabels(); err != nil {
+				l.log.Warn("failed to renew labels", "err", err)
+			}
 		}
+	}
+}
+
+// renewLabels lets the watcher re-evaluate users whose offender labels are about to expire,
+// that is, in the last tenth of their lifetime
+func (l *LabelListener) renewLabels() error {
+	ahead := config.LabelExpiry[at_utils.LabelOffenderString] / 10
+	expiring, err := l.db.GetExpiringLabels(at_utils.LabelOffenderString, time.Now().Add(ahead))
+	if err != nil {
+		return err
+	}
+	if len(expiring) != 0 {
+		l.log.Debug("renewing expiring labels", "count", len(expiring))
+	}
+	for _, label := range expiring {
+		uid, err := l.db.GetUserId(label.Uri)
 		if err != nil {
-			l.log.Warn("failed to increment counter", "kind", kind, "did", info.Did, "err", err)
-			continue
+			return err
 		}
-		l.watcher.CheckAccount(uid, info.Did, count)
+		l.watcher.RenewAccount(uid, label.Uri)
 	}
-	at_utils.StoreLarger(&l.cursor, labels.Seq)
-	l.counter.Add(1)
 	return nil
 }
 
@@ -235,12 +280,13 @@ func (l *LabelListener) startPersistSeq(ctx context.Context) {
 var syncTime atomic.Int64
 
 func (l *LabelListener) persistSeq() error {
-	cursor := l.cursor.Load()
-	counter := l.counter.Load()
-	l.log.Debug("persisting label cursor", "cursor", cursor, "counter", counter)
-	if err := l.db.SetConfigInt("label-cursor", cursor); err != nil {
-		return err
+	for _, source := range l.sources {
+		if err := source.persistSeq(); err != nil {
+			return err
+		}
 	}
+	counter := l.counter.Load()
+	l.log.Debug("persisting label counter", "counter", counter)
 	if err := l.db.SetConfigInt("label-counter", counter); err != nil {
 		return err
 	}
@@ -250,24 +296,6 @@ func (l *LabelListener) persistSeq() error {
 	return nil
 }
 
-func buildLabelMapping(policies *bsky.LabelerDefs_LabelerPolicies) map[string]LabelKind {
-	m := make(map[string]LabelKind)
-	m[at_utils.LabelPornString] = LabelPorn
-	m[at_utils.LabelSexualString] = LabelSexual
-	m[at_utils.LabelNudityString] = LabelNudity
-	m[at_utils.LabelGraphicMediaString] = LabelGraphicMedia
-	for _, policy := range policies.LabelValueDefinitions {
-		if policy.AdultOnly != nil && *policy.AdultOnly {
-			m[policy.Identifier] = LabelSexual
-		} else if policy.Blurs != "none" {
-			m[policy.Identifier] = LabelGraphicMedia
-		} else {
-			m[policy.Identifier] = LabelOthers
-		}
-	}
-	return m
-}
-
 type LabelIntention int
 
 const (
@@ -0,0 +1,307 @@
+package listener
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/database"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	lex_util "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/xrpc"
+	"golang.org/x/time/rate"
+)
+
+const (
+	exportListRkey    = "oneshot-blocks"
+	exportListPurpose = "app.bsky.graph.defs#modlist"
+)
+
+// ListExporter mirrors our block list into a moderation list owned by the labeler account,
+// so that users can subscribe to it in their own clients.
+//
+// The list items are listed from the repository on startup and every few hours,
+// so that whatever happened while we were not running is reconciled.
+type ListExporter struct {
+	log       *slog.Logger
+	db        *database.Service
+	blockList *BlockListInSync
+	client    *xrpc.Client
+	limiter   *rate.Limiter
+
+	list string
+	// items are the listitem record keys of each member (with "did:"),
+	// more than one if someone else added duplicates
+	items    map[string][]string
+	listedAt time.Time
+}
+
+func NewListExporter(blockList *BlockListInSync, logger *slog.Logger) *ListExporter {
+	perHour := config.ExportModListRateLimit
+	return &ListExporter{
+		log:       logger,
+		db:        database.Instance(),
+		blockList: blockList,
+		limiter:   rate.NewLimiter(rate.Limit(float64(perHour)/3600), max(1, perHour/60)),
+	}
+}
+
+// call runs a request with the labeler account, refreshing the session once if it has expired
+func (e *ListExporter) call(ctx context.Context, fn func(client *xrpc.Client) error) error {
+	if e.client == nil {
+		e.client = at_utils.Client
+	}
+	err := fn(e.client)
+	if !at_utils.IsExpiredToken(err) {
+		return err
+	}
+	client, err := at_utils.RefreshedClient(ctx, e.client)
+	if err != nil {
+		return err
+	}
+	e.client = client
+	return fn(client)
+}
+
+// write is a rate limited call that writes to the repository
+func (e *ListExporter) write(ctx context.Context, fn func(client *xrpc.Client) error) error {
+	if err := e.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return e.call(ctx, fn)
+}
+
+// ensureList creates the list record, or updates it if the name or description changed
+func (e *ListExporter) ensureList(ctx context.Context) error {
+	repo := at_utils.UserDid.String()
+	purpose := exportListPurpose
+	description := config.ExportModListDesc
+	record := &bsky.GraphList{
+		Name:        config.ExportModListName,
+		Description: &description,
+		Purpose:     &purpose,
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+	}
+
+	var prev *atproto.RepoGetRecord_Output
+	err := e.call(ctx, func(client *xrpc.Client) error {
+		var err error
+		prev, err = atproto.RepoGetRecord(ctx, client, "", "app.bsky.graph.list", repo, exportListRkey)
+		return err
+	})
+	if err != nil && !at_utils.IsRecordNotFound(err) {
+		return err
+	}
+	var prevCid *string
+	if err == nil {
+		prevCid = prev.Cid
+		if list, ok := prev.Value.Val.(*bsky.GraphList); ok {
+			if list.Name == record.Name && list.Description != nil && *list.Description == description &&
+				list.Purpose != nil && *list.Purpose == purpose {
+				e.list = prev.Uri
+				return nil
+			}
+			record.CreatedAt = list.CreatedAt
+		}
+	}
+
+	trueValue := true
+	return e.write(ctx, func(client *xrpc.Client) error {
+		output, err := atproto.RepoPutRecord(ctx, client, &atproto.RepoPutRecord_Input{
+			Collection: "app.bsky.graph.list",
+			Repo:       repo,
+			Rkey:       exportListRkey,
+			Record: &lex_util.LexiconTypeDecoder{
+				Val: record,
+			},
+			SwapRecord: prevCid,
+			Validate:   &trueValue,
+		})
+		if err != nil {
+			return err
+		}
+		e.list = output.Uri
+		e.log.Info("moderation list published", "uri", output.Uri)
+		return nil
+	})
+}
+
+// listItems fetches the items of our list from the repository
+func (e *ListExporter) listItems(ctx context.Context) error {
+	items := make(map[string][]string)
+	cursor := ""
+	for {
+		var output *atproto.RepoListRecords_Output
+		err := e.call(ctx, func(client *xrpc.Client) error {
+			var err error
+			output, err = atproto.RepoListRecords(ctx, client, listItemCollection, cursor, 100, at_utils.UserDid.String(), false, "", "")
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, record := range output.Records {
+			item, ok := record.Value.Val.(*bsky.GraphListitem)
+			if !ok || item.List != e.list {
+				continue
+			}
+			uri, err := syntax.ParseATURI(record.Uri)
+			if err != nil {
+				continue
+			}
+			items[item.Subject] = append(items[item.Subject], uri.RecordKey().String())
+		}
+		if output.Cursor == nil || *output.Cursor == "" || len(output.Records) == 0 {
+			break
+		}
+		cursor = *output.Cursor
+	}
+	e.items = items
+	e.listedAt = time.Now()
+	return nil
+}
+
+// members returns the users that should be in the list, in the order they were blocked
+func (e *ListExporter) members() ([]string, error) {
+	blocks, err := e.db.GetBlocksSince(0, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		members = append(members, "did:"+block.CompactDid)
+	}
+	if config.ExportModListCsv {
+		entries, _ := e.blockList.Entries()
+		for _, entry := range entries {
+			if entry.Did != "" {
+				members = append(members, entry.Did)
+			}
+		}
+	}
+	return members, nil
+}
+
+// reconcile adds missing members to the list and removes those no longer blocked
+func (e *ListExporter) reconcile(ctx context.Context) error {
+	if e.list == "" {
+		if err := e.ensureList(ctx); err != nil {
+			return fmt.Errorf("failed to publish the list: %w", err)
+		}
+	}
+	if e.items == nil || time.Since(e.listedAt) > modListResyncInterval {
+		if err := e.listItems(ctx); err != nil {
+			return fmt.Errorf("failed to list the list items: %w", err)
+		}
+	}
+	members, err := e.members()
+	if err != nil {
+		return err
+	}
+
+	repo := at_utils.UserDid.String()
+	wanted := make(map[string]bool, len(members))
+	added, removed := 0, 0
+	for _, did := range members {
+		if wanted[did] {
+			continue
+		}
+		wanted[did] = true
+		if len(e.items[did]) != 0 {
+			continue
+		}
+		err := e.write(ctx, func(client *xrpc.Client) error {
+			output, err := atproto.RepoCreateRecord(ctx, client, &atproto.RepoCreateRecord_Input{
+				Collection: listItemCollection,
+				Repo:       repo,
+				Record: &lex_util.LexiconTypeDecoder{
+					Val: &bsky.GraphListitem{
+						List:      e.list,
+						Subject:   did,
+						CreatedAt: time.Now().UTC().Format(time.RFC3339),
+					},
+				},
+			})
+			if err != nil {
+				return err
+			}
+			uri, err := syntax.ParseATURI(output.Uri)
+			if err != nil {
+				return err
+			}
+			e.items[did] = []string{uri.RecordKey().String()}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		added++
+	}
+
+	for did, rkeys := range e.items {
+		keep := 0
+		if wanted[did] {
+			keep = 1
+		}
+		for len(rkeys) > keep {
+			rkey := rkeys[len(rkeys)-1]
+			err := e.write(ctx, func(client *xrpc.Client) error {
+				_, err := atproto.RepoDeleteRecord(ctx, client, &atproto.RepoDeleteRecord_Input{
+					Collection: listItemCollection,
+					Repo:       repo,
+					Rkey:       rkey,
+				})
+				return err
+			})
+			if err != nil && !at_utils.IsRecordNotFound(err) {
+				return err
+			}
+			rkeys = rkeys[:len(rkeys)-1]
+			removed++
+		}
+		if len(rkeys) == 0 {
+			delete(e.items, did)
+		} else {
+			e.items[did] = rkeys
+		}
+	}
+
+	if added != 0 || removed != 0 {
+		e.log.Info("moderation list reconciled", "added", added, "removed", removed, "members", len(e.items))
+	}
+	return nil
+}
+
+func (e *ListExporter) Run(ctx context.Context) chan bool {
+	done := make(chan bool)
+	go func() {
+		defer func() {
+			e.log.Info("moderation list export stopped")
+			done <- true
+		}()
+		if !config.ExportModList {
+			<-ctx.Done()
+			return
+		}
+
+		ticker := time.NewTicker(config.ExportModListInterval)
+		defer ticker.Stop()
+		for {
+			if err := e.reconcile(ctx); err != nil && ctx.Err() == nil {
+				e.log.Error("failed to export moderation list", "err", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return done
+}
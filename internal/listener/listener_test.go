@@ -0,0 +1,27 @@
+package listener
+
+import (
+	"bluesky-oneshot-labeler/internal/database"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// openTestDatabase opens a fresh database in a temporary directory as the instance
+func openTestDatabase(t *testing.T) *database.Service {
+	t.Helper()
+	if err := database.OpenDatabase(discardLogger(), filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := database.Close(); err != nil {
+			t.Errorf("failed to close database: %v", err)
+		}
+	})
+	return database.Instance()
+}
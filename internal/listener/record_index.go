@@ -0,0 +1,140 @@
+package listener
+
+import (
+	"sync"
+	"time"
+)
+
+// indexedRecord is a record naming a user, e.g. a listitem or a block
+type indexedRecord struct {
+	// Group is where the record comes from, e.g. the list or the curator
+	Group string
+	// CompactDid is the subject without the "did:" prefix
+	CompactDid string
+}
+
+// recordIndex keeps records backfilled from the network and then updated from Jetstream.
+//
+// Records are keyed by "<repo did>/<rkey>", since delete events only carry the record key.
+type recordIndex struct {
+	lock  sync.RWMutex
+	items map[string]indexedRecord
+	// groups counts the records naming each user, by group
+	groups map[string]map[string]int
+	synced map[string]time.Time
+}
+
+// RecordGroupStats is the state of records from a list or a curator
+type RecordGroupStats struct {
+	Records  int        `json:"records"`
+	SyncedAt *time.Time `json:"syncedAt"`
+}
+
+func newRecordIndex() *recordIndex {
+	return &recordIndex{
+		items:  make(map[string]indexedRecord),
+		groups: make(map[string]map[string]int),
+		synced: make(map[string]time.Time),
+	}
+}
+
+func recordKey(did, rkey string) string {
+	return did + "/" + rkey
+}
+
+func (r *recordIndex) addLocked(key string, item indexedRecord) bool {
+	if _, ok := r.items[key]; ok {
+		return false
+	}
+	r.items[key] = item
+	groups, ok := r.groups[item.CompactDid]
+	if !ok {
+		groups = make(map[string]int)
+		r.groups[item.CompactDid] = groups
+	}
+	groups[item.Group]++
+	return true
+}
+
+func (r *recordIndex) removeLocked(key string) bool {
+	item, ok := r.items[key]
+	if !ok {
+		return false
+	}
+	delete(r.items, key)
+	groups := r.groups[item.CompactDid]
+	if groups[item.Group]--; groups[item.Group] <= 0 {
+		delete(groups, item.Group)
+	}
+	if len(groups) == 0 {
+		delete(r.groups, item.CompactDid)
+	}
+	return true
+}
+
+func (r *recordIndex) add(key string, item indexedRecord) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.addLocked(key, item)
+}
+
+func (r *recordIndex) remove(key string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.removeLocked(key)
+}
+
+// groupCount returns the number of groups with records naming the user
+func (r *recordIndex) groupCount(did string) int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.groups[did])
+}
+
+// keys returns the keys of the records in the group
+func (r *recordIndex) keys(group string) map[string]bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	keys := make(map[string]bool)
+	for key, item := range r.items {
+		if item.Group == group {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// replace swaps in the records fetched for a group. Only the records known before fetching
+// are removed if missing, so that those created in the meantime are kept.
+func (r *recordIndex) replace(group string, known map[string]bool, fetched map[string]indexedRecord) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for key := range known {
+		if _, ok := fetched[key]; !ok {
+			r.removeLocked(key)
+		}
+	}
+	for key, item := range fetched {
+		r.addLocked(key, item)
+	}
+	r.synced[group] = time.Now().UTC()
+}
+
+// stats returns the state of each of the groups
+func (r *recordIndex) stats(groups []string) map[string]*RecordGroupStats {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	stats := make(map[string]*RecordGroupStats, len(groups))
+	for _, group := range groups {
+		stats[group] = &RecordGroupStats{}
+		if synced, ok := r.synced[group]; ok {
+			stats[group].SyncedAt = &synced
+		}
+	}
+	for _, item := range r.items {
+		if s, ok := stats[item.Group]; ok {
+			s.Records++
+		}
+	}
+	return stats
+}
@@ -1,30 +1,33 @@
 package listener
 
 import (
-	"bluesky-oneshot-labeler/internal/at_utils"
 	"bluesky-oneshot-labeler/internal/database"
 	"context"
 	"io"
 	"log/slog"
 	"sync"
 	"sync/atomic"
-	"time"
 
-	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/events"
-	"github.com/bluesky-social/indigo/util/labels"
 	cbg "github.com/whyrusleeping/cbor-gen"
 )
 
 type Block struct {
 	Id         int64
 	CompactDid string
+	// Cts is the time the user was blocked, in unix milliseconds
+	Cts int64
+	// Removed is set when the user is unblocked
+	Removed bool
 }
 
 type Subscriber struct {
 	out   chan *Block
 	done  chan bool
 	since int64
+	// lagged is signaled when the subscriber is too slow to keep up,
+	// after which it should catch up from the database instead
+	lagged chan bool
 }
 
 type BlockNotifier struct {
@@ -53,14 +56,42 @@ func NewBlockNotifier(logger *slog.Logger) (*BlockNotifier, error) {
 func (ln *BlockNotifier) Notify(block *Block) {
 	ln.lock.RLock()
 	defer ln.lock.RUnlock()
-	if len(ln.subs) == 0 {
-		return
+	if block.Id > ln.last.Load() {
+		ln.last.Store(block.Id)
 	}
 
-	ln.last.Store(block.Id)
+	for _, sub := range ln.subs {
+		sub.send(block)
+	}
+}
 
+// Latest returns the id of the latest block
+func (ln *BlockNotifier) Latest() int64 {
+	return ln.last.Load()
+}
+
+// NotifyUnblock tells the subscribers that a user is no longer blocked.
+//
+// Unlike Notify, it does not advance the latest block id.
+func (ln *BlockNotifier) NotifyUnblock(compactDid string) {
+	ln.lock.RLock()
+	defer ln.lock.RUnlock()
 	for _, sub := range ln.subs {
-		sub.out <- block
+		sub.send(&Block{
+			CompactDid: compactDid,
+			Removed:    true,
+		})
+	}
+}
+
+func (sub *Subscriber) send(block *Block) {
+	select {
+	case sub.out <- block:
+	default:
+		select {
+		case sub.lagged <- true:
+		default:
+		}
 	}
 }
 
@@ -81,8 +112,9 @@ func SerializeEvent(event *events.XRPCStreamEvent, writer io.Writer) error {
 
 func (ln *BlockNotifier) Subscribe() *Subscriber {
 	sub := &Subscriber{
-		out:  make(chan *Block, 10),
-		done: make(chan bool),
+		out:    make(chan *Block, 10),
+		done:   make(chan bool, 1),
+		lagged: make(chan bool, 1),
 	}
 	ln.lock.Lock()
 	defer ln.lock.Unlock()
@@ -114,35 +146,47 @@ func (ln *BlockNotifier) ForAllLabelsSince(
 	since int64,
 	fn ForAllCallback,
 ) error {
-	sub := ln.Subscribe()
-	latest := sub.since
-	for latest > since {
+	for {
+		sub := ln.Subscribe()
+		if latest := sub.since; latest > since {
+			ln.Unsubscribe(sub)
+			if err := ln.forAllCatchUp(ctx, since, latest, fn); err != nil {
+				return err
+			}
+			since = latest
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+		}
+
+		ln.log.Debug("caught up, starting subscription")
+		lagged, err := ln.forAllLive(ctx, sub, &since, fn)
 		ln.Unsubscribe(sub)
-		err := ln.forAllCatchUp(ctx, since, latest, fn)
-		if err != nil {
+		if !lagged {
 			return err
 		}
-		since = latest
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-			sub = ln.Subscribe()
-		}
-		latest = sub.since
+		ln.log.Debug("subscriber lagged behind, catching up again", "since", since)
 	}
-	ln.log.Debug("caught up, starting subscription")
-	defer ln.Unsubscribe(sub)
+}
 
+// forAllLive passes live blocks to fn until done or fn fails, returning true if the
+// subscriber lagged behind and needs to catch up again
+func (ln *BlockNotifier) forAllLive(ctx context.Context, sub *Subscriber, since *int64, fn ForAllCallback) (bool, error) {
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
+			return false, nil
 		case <-sub.done:
-			return nil
-		case event := <-sub.out:
-			if err := fn(event, true); err != nil {
-				return nil
+			return false, nil
+		case <-sub.lagged:
+			return true, nil
+		case block := <-sub.out:
+			if err := fn(block, true); err != nil {
+				return false, err
+			}
+			if !block.Removed {
+				*since = block.Id
 			}
 		}
 	}
@@ -151,14 +195,15 @@ func (ln *BlockNotifier) ForAllLabelsSince(
 func (ln *BlockNotifier) forAllCatchUp(ctx context.Context, from, to int64, fn ForAllCallback) error {
 	ln.log.Debug("catching up subscription", "from", from, "to", to)
 
-	dids, lastId, err := ln.db.GetBlocksSince(from, to)
+	blocks, err := ln.db.GetBlocksSince(from, to)
 	if err != nil {
 		return err
 	}
-	for _, did := range dids {
+	for _, block := range blocks {
 		if err := fn(&Block{
-			Id:         lastId,
-			CompactDid: did,
+			Id:         block.Id,
+			CompactDid: block.CompactDid,
+			Cts:        block.Cts,
 		}, false); err != nil {
 			return err
 		}
@@ -178,23 +223,3 @@ func (ln *BlockNotifier) Close() {
 	ln.subs = nil
 	ln.last.Store(-1)
 }
-
-func SignRawLabel(kind int, did string, cts int64, profile bool) (*atproto.LabelDefs_Label, error) {
-	var uri string
-	if profile {
-		uri = "at://did:" + did
-	} else {
-		uri = "did:" + did
-	}
-	unsigned := labels.UnsignedLabel{
-		Cts: time.UnixMilli(cts).UTC().Format(time.RFC3339),
-		Src: at_utils.UserDid.String(),
-		// TODO: What on earth? `did:` is not a valid URI and the spec requires one,
-		//   and yet Bluesky AppView expects it to be there?
-		Uri: uri,
-		Val: LabelKind(kind).String(),
-		Ver: &at_utils.AtProtoVersion,
-		Neg: nil,
-	}
-	return at_utils.SignLabel(&unsigned)
-}
@@ -0,0 +1,55 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestForAllLabelsSinceReturnsLiveErrors(t *testing.T) {
+	openTestDatabase(t)
+	notifier, err := NewBlockNotifier(discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rebuild := RebuildFilterError{NewSize: 1}
+	var seen []Block
+	result := make(chan error, 1)
+	go func() {
+		result <- notifier.ForAllLabelsSince(ctx, 0, func(block *Block, new bool) error {
+			seen = append(seen, *block)
+			if block.Removed {
+				return rebuild
+			}
+			return nil
+		})
+	}()
+	for {
+		notifier.lock.RLock()
+		subscribed := len(notifier.subs) != 0
+		notifier.lock.RUnlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	notifier.Notify(&Block{Id: 1, CompactDid: "plc:aaa"})
+	notifier.NotifyUnblock("plc:aaa")
+	select {
+	case err := <-result:
+		var rebuildErr RebuildFilterError
+		if !errors.As(err, &rebuildErr) {
+			t.Errorf("got %v, expected the error of the callback", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("ForAllLabelsSince did not return")
+	}
+	if len(seen) != 2 || seen[0].Id != 1 || !seen[1].Removed {
+		t.Errorf("got blocks %+v", seen)
+	}
+}
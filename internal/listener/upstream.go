@@ -0,0 +1,431 @@
+package listener
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/database"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/gorilla/websocket"
+)
+
+// labelSource is a single upstream labeler, with its own connection and cursor
+type labelSource struct {
+	log      *slog.Logger
+	listener *LabelListener
+
+	did       syntax.DID
+	name      string
+	src       int64
+	weight    float64
+	serverUrl *url.URL
+	labels    map[string]LabelKind
+
+	cursor atomic.Int64
+
+	state           atomic.Value
+	reconnects      atomic.Int64
+	gaps            atomic.Int64
+	outdatedCursors atomic.Int64
+	lastEventAt     atomic.Int64
+
+	invalidSignatures atomic.Int64
+
+	unknownLock   sync.Mutex
+	unknownValues map[string]int64
+}
+
+const (
+	ConnectionConnecting = "connecting"
+	ConnectionConnected  = "connected"
+	ConnectionWaiting    = "waiting"
+	ConnectionStopped    = "stopped"
+)
+
+type UpstreamStats struct {
+	Did    string `json:"did"`
+	State  string `json:"state"`
+	Cursor int64  `json:"cursor"`
+	// LastEventAt is the time of the last event received, in unix milliseconds
+	LastEventAt int64 `json:"lastEventAt"`
+	Reconnects  int64 `json:"reconnects"`
+	// Gaps counts skipped sequence numbers, while OutdatedCursors counts
+	// the times the upstream told us that labels were missed.
+	Gaps            int64 `json:"gaps"`
+	OutdatedCursors int64 `json:"outdatedCursors"`
+	// UnknownValues counts label values that are neither defined by the upstream nor configured
+	UnknownValues map[string]int64 `json:"unknownValues"`
+	// InvalidSignatures counts labels that are unsigned, mis-signed or from another source
+	InvalidSignatures int64 `json:"invalidSignatures"`
+}
+
+func newLabelSource(
+	ctx context.Context,
+	listener *LabelListener,
+	upstream config.Upstream,
+	overrides labelMappings,
+) (*labelSource, error) {
+	id, err := syntax.ParseAtIdentifier(upstream.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	ident, err := at_utils.IdentityDirectory.Lookup(ctx, *id)
+	if err != nil {
+		return nil, err
+	}
+	logger := listener.log.With("upstream", upstream.Identifier)
+	logger.Debug("upstream resolved", "ident", ident)
+
+	var u *url.URL
+	for _, value := range ident.Services {
+		if value.Type == "AtprotoLabeler" {
+			if u, err = url.Parse(value.URL); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if u == nil {
+		return nil, fmt.Errorf("labeler service not found")
+	}
+
+	info, err := bsky.LabelerGetServices(ctx, at_utils.Client, true, []string{ident.DID.String()})
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Views) != 1 {
+		return nil, fmt.Errorf("expected one service view, got %d", len(info.Views))
+	}
+	view := info.Views[0]
+	details := view.LabelerDefs_LabelerViewDetailed
+	if details == nil {
+		return nil, fmt.Errorf("labeler service view is not detailed")
+	}
+
+	db := listener.db
+	src, err := db.GetUpstreamId(ident.DID.String(), upstream.Weight)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := db.GetConfigInt("label-cursor:"+ident.DID.String(), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &labelSource{
+		log:       logger,
+		listener:  listener,
+		did:       ident.DID,
+		name:      upstream.Identifier,
+		src:       src,
+		weight:    upstream.Weight,
+		serverUrl: u,
+		labels:    buildLabelMapping(details.Policies, overrides.lookup(upstream.Identifier, ident.DID)),
+
+		unknownValues: make(map[string]int64),
+	}
+	source.cursor.Store(cursor)
+	source.state.Store(ConnectionWaiting)
+	return source, nil
+}
+
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 5 * time.Minute
+	// connections lasting longer than this reset the backoff
+	stableConnection = 1 * time.Minute
+)
+
+func (s *labelSource) run(ctx context.Context) {
+	backoff := minReconnectDelay
+	for {
+		// "equal jitter": wait for somewhere between backoff/2 and backoff
+		delay := backoff/2 + rand.N(backoff/2+1)
+		s.log.Info("connecting later", "delay", delay)
+		s.state.Store(ConnectionWaiting)
+		select {
+		case <-ctx.Done():
+			s.state.Store(ConnectionStopped)
+			return
+		case <-time.After(delay):
+			started := time.Now()
+			if err := s.listen(ctx); err != nil {
+				s.log.Error("failed to listen", "err", err)
+			}
+			s.log.Info("websocket disconnected")
+			s.reconnects.Add(1)
+			if time.Since(started) > stableConnection {
+				backoff = minReconnectDelay
+			} else {
+				backoff = min(backoff*2, maxReconnectDelay)
+			}
+		}
+	}
+}
+
+func (s *labelSource) listen(ctx context.Context) error {
+	u, _ := url.Parse("wss://example.com/xrpc/com.atproto.label.subscribeLabels")
+	u.Host = s.serverUrl.Host
+	u.RawQuery = fmt.Sprintf("cursor=%d", s.cursor.Load())
+
+	s.state.Store(ConnectionConnecting)
+	scheduler := sequential.NewScheduler("oneshot-labeler", s.HandleEvent)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	s.state.Store(ConnectionConnected)
+
+	return events.HandleRepoStream(ctx, conn, scheduler, s.log)
+}
+
+// adoptLegacyUpstream assigns the counters and the cursor from before multiple upstreams were
+// supported to the upstream UPSTREAM_USER resolves to, or to the first one if it is unset
+// or not subscribed to anymore, so that moving to UPSTREAM_USERS does not replay everything.
+func (l *LabelListener) adoptLegacyUpstream(ctx context.Context) error {
+	legacyCursor, err := l.db.GetConfigInt("label-cursor", -1)
+	if err != nil {
+		return err
+	}
+	hasLegacy, err := l.db.HasLegacyUpstream()
+	if err != nil {
+		return err
+	}
+	if legacyCursor == -1 && !hasLegacy {
+		return nil
+	}
+
+	source := l.sources[0]
+	if config.UpstreamUser != "" {
+		ident, err := at_utils.LookupIdentifier(ctx, config.UpstreamUser)
+		if err != nil {
+			return err
+		}
+		for _, s := range l.sources {
+			if s.did == ident.DID {
+				source = s
+				break
+			}
+		}
+	}
+	source.log.Info("adopting the legacy upstream", "cursor", legacyCursor)
+	if err := l.db.AdoptLegacyUpstream(source.src); err != nil {
+		return err
+	}
+	if legacyCursor == -1 {
+		return nil
+	}
+
+	cursors := map[string]string{"label-cursor": ""}
+	if own, err := l.db.GetConfig("label-cursor:"+source.did.String(), ""); err != nil {
+		return err
+	} else if own == "" {
+		source.cursor.Store(legacyCursor)
+		cursors["label-cursor:"+source.did.String()] = strconv.FormatInt(legacyCursor, 10)
+	}
+	return l.db.SetConfigs(cursors)
+}
+
+func (s *labelSource) persistSeq() error {
+	cursor := s.cursor.Load()
+	s.log.Debug("persisting label cursor", "cursor", cursor)
+	if err := s.listener.db.SetConfigInt("label-cursor:"+s.did.String(), cursor); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *labelSource) handleInfo(name string, message *string) {
+	msg := ""
+	if message != nil {
+		msg = *message
+	}
+	if name == "OutdatedCursor" {
+		s.outdatedCursors.Add(1)
+		s.log.Warn("cursor is outdated, some labels are missed", "cursor", s.cursor.Load(), "message", msg)
+		return
+	}
+	s.log.Info("info from upstream", "name", name, "message", msg)
+}
+
+func (s *labelSource) handleError(frame *events.ErrorFrame) error {
+	if frame.Error == "FutureCursor" {
+		// The upstream has probably been reset. Start over so that we do not
+		// reconnect with the same cursor forever. Counting is idempotent anyway.
+		s.log.Warn("cursor is ahead of the upstream, resetting", "cursor", s.cursor.Load(), "message", frame.Message)
+		s.cursor.Store(0)
+	}
+	return fmt.Errorf("error frame from upstream: %s: %s", frame.Error, frame.Message)
+}
+
+func (s *labelSource) countUnknown(val string) {
+	s.unknownLock.Lock()
+	defer s.unknownLock.Unlock()
+	count := s.unknownValues[val]
+	if count == 0 {
+		s.log.Warn("unknown label value, consider adding it to LABEL_MAPPING", "val", val)
+	}
+	s.unknownValues[val] = count + 1
+}
+
+func (s *labelSource) stats() *UpstreamStats {
+	s.unknownLock.Lock()
+	defer s.unknownLock.Unlock()
+	return &UpstreamStats{
+		Did:               s.did.String(),
+		State:             s.state.Load().(string),
+		Cursor:            s.cursor.Load(),
+		LastEventAt:       s.lastEventAt.Load(),
+		Reconnects:        s.reconnects.Load(),
+		Gaps:              s.gaps.Load(),
+		OutdatedCursors:   s.outdatedCursors.Load(),
+		UnknownValues:     maps.Clone(s.unknownValues),
+		InvalidSignatures: s.invalidSignatures.Load(),
+	}
+}
+
+// verify checks that the label is signed by this upstream.
+//
+// It returns false if the label should be dropped according to UPSTREAM_SIGNATURE_POLICY.
+func (s *labelSource) verify(ctx context.Context, label *atproto.LabelDefs_Label) bool {
+	policy := config.UpstreamSignaturePolicy
+	if policy == "skip" {
+		return true
+	}
+	var err error
+	if label.Src != s.did.String() {
+		err = fmt.Errorf("label from unexpected source %s", label.Src)
+	} else {
+		err = at_utils.VerifyLabel(ctx, label)
+	}
+	if err == nil {
+		return true
+	}
+	s.invalidSignatures.Add(1)
+	s.log.Warn("invalid label signature", "uri", label.Uri, "val", label.Val, "policy", policy, "err", err)
+	return policy != "reject"
+}
+
+func (s *labelSource) HandleEvent(ctx context.Context, event *events.XRPCStreamEvent) error {
+	s.lastEventAt.Store(time.Now().UnixMilli())
+	if event.Error != nil {
+		return s.handleError(event.Error)
+	}
+	if event.RepoInfo != nil {
+		// HandleRepoStream parses #info frames of subscribeLabels as RepoInfo
+		s.handleInfo(event.RepoInfo.Name, event.RepoInfo.Message)
+		return nil
+	}
+	labels := event.LabelLabels
+	if labels == nil {
+		return nil
+	}
+	if prev := s.cursor.Load(); prev != 0 && labels.Seq > prev+1 {
+		s.gaps.Add(1)
+		s.log.Info("gap in label sequence", "from", prev, "to", labels.Seq)
+	}
+	l := s.listener
+	now := time.Now().UnixMilli()
+	for _, label := range labels.Labels {
+		if !s.verify(ctx, label) {
+			continue
+		}
+		kind, ok := s.labels[label.Val]
+		if !ok {
+			s.countUnknown(label.Val)
+			continue
+		}
+		if kind == LabelIgnored {
+			continue
+		}
+
+		info := explainLabel(label.Uri)
+		if info.Kind == LabelUnknown {
+			s.log.Warn("failed to parse label did", "uri", label.Uri)
+			continue
+		}
+
+		if label.Neg != nil && *label.Neg {
+			l.retractLabel(s.src, label.Uri, label.Val, info.Did)
+			continue
+		}
+
+		var exp int64
+		if label.Exp != nil {
+			t, err := syntax.ParseDatetimeLenient(*label.Exp)
+			if err != nil {
+				s.log.Warn("failed to parse label expiration", "uri", label.Uri, "exp", *label.Exp, "err", err)
+				continue
+			}
+			exp = t.Time().UnixMilli()
+			if exp <= now {
+				// already expired, probably replayed from an old cursor
+				continue
+			}
+		}
+
+		uid, err := l.db.GetUserId(info.Did)
+		if err != nil {
+			s.log.Warn("failed to get user id", "did", info.Did, "err", err)
+			continue
+		}
+		var mode database.CounterMode
+		switch info.Kind {
+		case LabelOnList:
+			fallthrough
+		case LabelOnFeed:
+			fallthrough
+		case LabelOnPost:
+			mode = database.CounterIncrement
+		case LabelOnProfile:
+			mode = database.CounterMultiply
+		case LabelOnUser:
+			if s.weight >= 1 {
+				mode = database.CounterNone
+			} else {
+				// less trusted upstreams cannot block users outright
+				mode = database.CounterMultiply
+			}
+		}
+		count, counted, err := l.db.CountUpstreamLabel(&database.UpstreamLabel{
+			Uid:  uid,
+			Src:  s.src,
+			Uri:  label.Uri,
+			Val:  label.Val,
+			Kind: int(kind),
+			Exp:  exp,
+		}, mode)
+		if err != nil {
+			s.log.Warn("failed to increment counter", "kind", kind, "did", info.Did, "err", err)
+			continue
+		}
+		if !counted {
+			continue
+		}
+		if mode == database.CounterNone {
+			count = math.MaxInt64
+		} else {
+			count = int64(float64(count) * s.weight)
+		}
+		l.watcher.CheckAccount(uid, info.Did, count)
+	}
+	at_utils.StoreLarger(&s.cursor, labels.Seq)
+	l.counter.Add(1)
+	return nil
+}
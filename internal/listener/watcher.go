@@ -18,6 +18,19 @@ type upstreamLabel struct {
 	Uid   int64
 	Did   string
 	Count int64
+	// Recheck is set when labels of a blocked user are retracted,
+	// so that we can unblock them if they are no longer over the limit.
+	Recheck bool
+	// Renew is set along with Recheck when the label of the user is about to expire
+	Renew bool
+}
+
+// merge folds another entry of the same user into the label, keeping the strongest action,
+// i.e., renewing over rechecking over checking, and the highest count
+func (l *upstreamLabel) merge(other *upstreamLabel) {
+	l.Count = max(l.Count, other.Count)
+	l.Recheck = l.Recheck || other.Recheck
+	l.Renew = l.Renew || other.Renew
 }
 
 type AccountWatcher struct {
@@ -27,6 +40,7 @@ type AccountWatcher struct {
 	queue    chan *upstreamLabel
 	limiter  *rate.Limiter
 	notifier *BlockNotifier
+	emitter  *LabelEmitter
 
 	offendingPostRatio float64
 }
@@ -44,12 +58,18 @@ func NewAccountWatcher(logger *slog.Logger) (*AccountWatcher, error) {
 		return nil, err
 	}
 
+	emitter, err := NewLabelEmitter(logger.WithGroup("emitter"))
+	if err != nil {
+		return nil, err
+	}
+
 	w := &AccountWatcher{
 		db:       db,
 		log:      logger.WithGroup("watcher"),
 		queue:    make(chan *upstreamLabel, 4096),
 		limiter:  rate.NewLimiter(rate.Limit(config.AppViewRateLimit), config.AppViewRateLimit*2),
 		notifier: notifier,
+		emitter:  emitter,
 
 		offendingPostRatio: ratio,
 	}
@@ -74,11 +94,26 @@ func (w *AccountWatcher) Listen(ctx context.Context, done chan bool) {
 				w.log.Error("failed to check if user is blocked", "err", err)
 				continue
 			}
-			if blocked {
+			if blocked != label.Recheck {
+				// only unblocked users need checking, and only blocked users need rechecking
 				continue
 			}
+			if !label.Recheck {
+				allowed, err := w.db.IsUserAllowed(compact)
+				if err != nil {
+					w.log.Error("failed to check if user is allowed", "err", err)
+					continue
+				}
+				if allowed {
+					continue
+				}
+			}
 
-			batch[label.Did] = label
+			if pending, ok := batch[label.Did]; ok {
+				pending.merge(label)
+			} else {
+				batch[label.Did] = label
+			}
 			if len(batch) >= 25 {
 				w.checkBatch(ctx, batch)
 				batch = make(map[string]*upstreamLabel, 25)
@@ -133,31 +168,102 @@ func (w *AccountWatcher) checkBatchWorker(ctx context.Context, labels map[string
 			continue
 		}
 		offendingPostUpperLimit := int64(float64(*posts) * w.offendingPostRatio)
-		if label.Count > offendingPostUpperLimit {
-			candidates = append(candidates, label)
+		if label.Recheck {
+			offending, err := w.isStillOffending(label.Uid, offendingPostUpperLimit)
+			if err != nil {
+				w.log.Error("failed to recheck user", "err", err)
+			} else if !offending {
+				w.unblock(label)
+			} else if label.Renew {
+				w.renew(label)
+			}
 			continue
 		}
-		count, err := w.db.TotalCounts(label.Uid)
+		offending, err := w.isOffending(label, offendingPostUpperLimit)
 		if err != nil {
 			w.log.Error("failed to get total counts", "err", err)
-			continue
-		}
-		if count > offendingPostUpperLimit {
+		} else if offending {
 			candidates = append(candidates, label)
 		}
 	}
 
 	for _, label := range candidates {
-		blockId, err := w.db.InsertBlock(label.Uid)
+		blockId, cts, err := w.db.InsertBlock(label.Uid)
 		if err != nil {
 			w.log.Error("failed to insert block", "err", err)
 			continue
 		}
+		if blockId == 0 {
+			// already blocked
+			continue
+		}
 		w.notifier.Notify(&Block{
 			Id:         blockId,
 			CompactDid: strings.TrimPrefix(label.Did, "did:"),
+			Cts:        cts,
 		})
+		if err := w.emitOffender(label.Did, false, cts); err != nil {
+			w.log.Error("failed to emit label", "err", err)
+		}
+	}
+}
+
+// isOffending checks if a user is over the limit, either with the labels of the kind just counted or in total
+func (w *AccountWatcher) isOffending(label *upstreamLabel, offendingPostUpperLimit int64) (bool, error) {
+	if label.Count > offendingPostUpperLimit {
+		return true, nil
+	}
+	count, err := w.db.TotalCounts(label.Uid)
+	if err != nil {
+		return false, err
+	}
+	return count > offendingPostUpperLimit, nil
+}
+
+func (w *AccountWatcher) isStillOffending(uid int64, offendingPostUpperLimit int64) (bool, error) {
+	labeled, err := w.db.HasAccountLabel(uid)
+	if err != nil || labeled {
+		return labeled, err
+	}
+	count, err := w.db.TotalCounts(uid)
+	if err != nil {
+		return false, err
 	}
+	return count > offendingPostUpperLimit, nil
+}
+
+func (w *AccountWatcher) unblock(label *upstreamLabel) {
+	removed, err := w.db.DeleteBlock(label.Uid)
+	if err != nil {
+		w.log.Error("failed to delete block", "err", err)
+		return
+	}
+	if removed {
+		w.log.Info("user unblocked", "did", label.Did)
+		w.notifier.NotifyUnblock(strings.TrimPrefix(label.Did, "did:"))
+		if err := w.emitOffender(label.Did, true, time.Now().UnixMilli()); err != nil {
+			w.log.Error("failed to emit label negation", "err", err)
+		}
+	}
+}
+
+// emitOffender appends the offender label (or its negation) of a user to the label log.
+// Nothing is signed nor logged unless labels are published, and the emitter reconciles
+// the log with the blocks on startup once they are.
+func (w *AccountWatcher) emitOffender(did string, neg bool, cts int64) error {
+	if !config.PublishLabels {
+		return nil
+	}
+	_, err := w.emitter.Emit(did, at_utils.LabelOffenderString, neg, cts)
+	return err
+}
+
+func (w *AccountWatcher) renew(label *upstreamLabel) {
+	if err := w.emitOffender(label.Did, false, time.Now().UnixMilli()); err != nil {
+		w.log.Error("failed to renew label", "err", err)
+		return
+	}
+	w.log.Debug("label renewed", "did", label.Did)
 }
 
 func (w *AccountWatcher) CheckAccount(uid int64, did string, count int64) {
@@ -167,3 +273,37 @@ func (w *AccountWatcher) CheckAccount(uid int64, did string, count int64) {
 		Count: count,
 	}
 }
+
+// RecheckAccount checks if a blocked user should be unblocked
+func (w *AccountWatcher) RecheckAccount(uid int64, did string) {
+	w.queue <- &upstreamLabel{
+		Uid:     uid,
+		Did:     did,
+		Recheck: true,
+	}
+}
+
+// UnblockAccount unblocks a user right away, whether they are over the limit or not.
+//
+// Their counters start over, or else the next label would block them again.
+func (w *AccountWatcher) UnblockAccount(uid int64, did string) error {
+	if err := w.db.ResetUpstreamCounts(uid); err != nil {
+		return err
+	}
+	w.unblock(&upstreamLabel{
+		Uid: uid,
+		Did: did,
+	})
+	return nil
+}
+
+// RenewAccount rechecks a blocked user whose label is about to expire,
+// issuing a fresh label if they are still over the limit
+func (w *AccountWatcher) RenewAccount(uid int64, did string) {
+	w.queue <- &upstreamLabel{
+		Uid:     uid,
+		Did:     did,
+		Recheck: true,
+		Renew:   true,
+	}
+}
@@ -0,0 +1,163 @@
+package listener
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/database"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+func TestUpstreamLabelMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		pending  upstreamLabel
+		next     upstreamLabel
+		expected upstreamLabel
+	}{
+		{
+			name:     "checks keep the highest count",
+			pending:  upstreamLabel{Count: 7},
+			next:     upstreamLabel{Count: 3},
+			expected: upstreamLabel{Count: 7},
+		},
+		{
+			name:     "recheck over check",
+			pending:  upstreamLabel{Count: 7},
+			next:     upstreamLabel{Recheck: true},
+			expected: upstreamLabel{Count: 7, Recheck: true},
+		},
+		{
+			name:     "check does not undo a recheck",
+			pending:  upstreamLabel{Recheck: true},
+			next:     upstreamLabel{Count: 2},
+			expected: upstreamLabel{Count: 2, Recheck: true},
+		},
+		{
+			name:     "renew over recheck",
+			pending:  upstreamLabel{Recheck: true},
+			next:     upstreamLabel{Recheck: true, Renew: true},
+			expected: upstreamLabel{Recheck: true, Renew: true},
+		},
+		{
+			name:     "recheck does not undo a renew",
+			pending:  upstreamLabel{Recheck: true, Renew: true},
+			next:     upstreamLabel{Recheck: true},
+			expected: upstreamLabel{Recheck: true, Renew: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			label := test.pending
+			label.merge(&test.next)
+			if label != test.expected {
+				t.Errorf("got %+v, expected %+v", label, test.expected)
+			}
+		})
+	}
+}
+
+func TestOffenderLabelsWaitForPublishing(t *testing.T) {
+	db := openTestDatabase(t)
+	key, err := crypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish, previousKey, previousDid := config.PublishLabels, at_utils.KeyP256, at_utils.UserDid
+	t.Cleanup(func() {
+		config.PublishLabels, at_utils.KeyP256, at_utils.UserDid = publish, previousKey, previousDid
+	})
+	config.PublishLabels = false
+	at_utils.KeyP256 = key
+	at_utils.UserDid = syntax.DID("did:plc:labeler")
+
+	watcher, err := NewAccountWatcher(discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	did := "did:plc:offender"
+	uid, err := db.GetUserId(did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cts, err := db.InsertBlock(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.emitOffender(did, false, cts); err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := db.LastLabelSeq(); err != nil || seq != 0 {
+		t.Fatalf("labels logged while publishing is off: %d, %v", seq, err)
+	}
+
+	config.PublishLabels = true
+	if _, err := NewLabelEmitter(discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+	active, err := db.IsLabelActive(did, at_utils.LabelOffenderString)
+	if err != nil || !active {
+		t.Errorf("blocked user not labeled once publishing is on: %v, %v", active, err)
+	}
+}
+
+func TestUnblockedUserStartsOver(t *testing.T) {
+	db := openTestDatabase(t)
+	watcher, err := NewAccountWatcher(discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	did := "did:plc:offender"
+	uid, err := db.GetUserId(did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := db.GetUpstreamId("did:plc:upstream", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func(rkey string) *upstreamLabel {
+		t.Helper()
+		count, counted, err := db.CountUpstreamLabel(&database.UpstreamLabel{
+			Uid: uid,
+			Src: src,
+			Uri: "at://" + did + "/app.bsky.feed.post/" + rkey,
+			Val: "porn",
+		}, database.CounterIncrement)
+		if err != nil || !counted {
+			t.Fatalf("failed to count label: %v, %v", counted, err)
+		}
+		return &upstreamLabel{Uid: uid, Did: did, Count: count}
+	}
+	// with ten posts, more than five offending posts make an offender
+	const limit = 5
+
+	var label *upstreamLabel
+	for _, rkey := range []string{"1", "2", "3", "4", "5", "6"} {
+		label = count(rkey)
+	}
+	if offending, err := watcher.isOffending(label, limit); err != nil || !offending {
+		t.Fatalf("isOffending = %v, %v with %d labels", offending, err, label.Count)
+	}
+	if _, _, err := db.InsertBlock(uid); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := watcher.UnblockAccount(uid, did); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, err := db.IsUserBlocked(strings.TrimPrefix(did, "did:")); err != nil || blocked {
+		t.Fatalf("IsUserBlocked = %v, %v after the unblock", blocked, err)
+	}
+
+	label = count("7")
+	if label.Count != 1 {
+		t.Errorf("counted %d labels after the unblock, expected 1", label.Count)
+	}
+	if offending, err := watcher.isOffending(label, limit); err != nil || offending {
+		t.Errorf("isOffending = %v, %v for the next label after the unblock", offending, err)
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bluesky-oneshot-labeler/internal/database"
+	"bufio"
+	"encoding/csv"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Actors of actions taken outside of moderation reports
+const (
+	ActorAdminApi = "admin-api"
+	ActorCli      = "cli"
+)
+
+// recordAction appends an action to the audit trail, with err as its outcome
+func (s *FiberServer) recordAction(actor, action, subject, reason string, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = err.Error()
+	}
+	record := &database.ModerationAction{
+		Actor:   actor,
+		Action:  action,
+		Subject: subject,
+		Reason:  reason,
+		Outcome: outcome,
+	}
+	if err := s.db.RecordAction(record); err != nil {
+		s.log.Error("failed to record moderation action", "action", action, "subject", subject, "err", err)
+	}
+}
+
+type actionView struct {
+	Id        int64  `json:"id"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	Subject   string `json:"subject"`
+	Reason    string `json:"reason"`
+	CreatedAt string `json:"createdAt"`
+	Outcome   string `json:"outcome"`
+}
+
+type queryActionsInput struct {
+	Actor   string `query:"actor"`
+	Subject string `query:"subject"`
+	Cursor  int64  `query:"cursor"`
+	Limit   int    `query:"limit"`
+	Format  string `query:"format"`
+}
+
+// QueryActionsHandler lists the audit trail, the latest first, or exports it as CSV with format=csv
+func (s *FiberServer) QueryActionsHandler(c *fiber.Ctx) error {
+	input := queryActionsInput{
+		Cursor: math.MaxInt64,
+		Limit:  50,
+		Format: "json",
+	}
+	if err := c.QueryParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidRequest",
+			Message: err.Error(),
+		})
+	}
+
+	if input.Format == "csv" {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="moderation_actions.csv"`)
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			if err := ExportActions(s.db, w, input.Actor, input.Subject); err != nil {
+				s.log.Error("failed to export moderation actions", "err", err)
+			}
+		})
+		return nil
+	}
+	if input.Format != "json" {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidRequest",
+			Message: "Format must be json or csv",
+		})
+	}
+	if input.Limit > 250 || input.Limit <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidRequest",
+			Message: "Limit must be between 1 and 250",
+		})
+	}
+
+	actions, err := s.db.QueryActions(input.Actor, input.Subject, input.Cursor, input.Limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	views := make([]actionView, len(actions))
+	for i, a := range actions {
+		views[i] = actionView{
+			Id:        a.Id,
+			Actor:     a.Actor,
+			Action:    a.Action,
+			Subject:   a.Subject,
+			Reason:    a.Reason,
+			CreatedAt: time.UnixMilli(a.Cts).UTC().Format(time.RFC3339),
+			Outcome:   a.Outcome,
+		}
+	}
+	var cursor *string
+	if len(actions) == input.Limit {
+		next := strconv.FormatInt(actions[len(actions)-1].Id, 10)
+		cursor = &next
+	}
+	return c.JSON(fiber.Map{
+		"cursor":  cursor,
+		"actions": views,
+	})
+}
+
+// ExportActions writes the audit trail as CSV, the oldest last.
+// Empty actor or subject matches all.
+func ExportActions(db *database.Service, w io.Writer, actor, subject string) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"id", "actor", "action", "subject", "reason", "created_at", "outcome"}); err != nil {
+		return err
+	}
+	cursor := int64(math.MaxInt64)
+	for {
+		actions, err := db.QueryActions(actor, subject, cursor, 1000)
+		if err != nil {
+			return err
+		}
+		for _, a := range actions {
+			if err := writer.Write([]string{
+				strconv.FormatInt(a.Id, 10),
+				a.Actor,
+				a.Action,
+				a.Subject,
+				a.Reason,
+				time.UnixMilli(a.Cts).UTC().Format(time.RFC3339),
+				a.Outcome,
+			}); err != nil {
+				return err
+			}
+		}
+		if len(actions) < 1000 {
+			break
+		}
+		cursor = actions[len(actions)-1].Id
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+type blockListEntryView struct {
+	Did        string `json:"did,omitempty"`
+	Handle     string `json:"handle,omitempty"`
+	ReasonType string `json:"reasonType,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Line       int    `json:"line"`
+}
+
+// BlockListHandler lists the entries in the external block list and the lines that failed to parse
+func (s *FiberServer) BlockListHandler(c *fiber.Ctx) error {
+	entries, problems := s.blockList.Entries()
+	views := make([]blockListEntryView, len(entries))
+	for i, entry := range entries {
+		views[i] = blockListEntryView{
+			Did:        entry.Did,
+			Handle:     entry.Handle,
+			ReasonType: entry.ReasonType,
+			Reason:     entry.Reason,
+			Line:       entry.Line,
+		}
+	}
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.Error()
+	}
+	return c.JSON(fiber.Map{
+		"entries":  views,
+		"problems": messages,
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"bluesky-oneshot-labeler/internal/at_utils"
 	"bluesky-oneshot-labeler/internal/listener"
 	"math"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -64,13 +65,34 @@ func (s *FiberServer) GetFeedSkeletonHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	items, err := s.db.GetFeedItems(&input.Cursor, input.Limit)
+	var pinned []string
+	if c.Query("cursor") == "" {
+		// pinned posts go to the top of the first page, taking up room from the others
+		pinned, err = s.db.GetPinnedPosts()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+				ErrStr:  "InternalError",
+				Message: err.Error(),
+			})
+		}
+		pinned = pinned[:min(len(pinned), input.Limit)]
+	}
+
+	items, err := s.db.GetFeedItems(&input.Cursor, input.Limit-len(pinned))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
 			ErrStr:  "InternalError",
 			Message: err.Error(),
 		})
 	}
+	var pointer *string
+	if len(items) != 0 || len(pinned) != 0 {
+		cursorStr := strconv.FormatInt(input.Cursor, 10)
+		pointer = &cursorStr
+	}
+	items = append(pinned, slices.DeleteFunc(items, func(uri string) bool {
+		return slices.Contains(pinned, uri)
+	})...)
 	feed := make([]*bsky.FeedDefs_SkeletonFeedPost, 0, len(items))
 	for _, uri := range items {
 		splits := strings.SplitN(uri, "/", 2)
@@ -86,11 +108,6 @@ func (s *FiberServer) GetFeedSkeletonHandler(c *fiber.Ctx) error {
 		feed = append(feed, item)
 	}
 
-	var pointer *string
-	if len(items) != 0 {
-		cursorStr := strconv.FormatInt(input.Cursor, 10)
-		pointer = &cursorStr
-	}
 	return c.JSON(&bsky.FeedGetFeedSkeleton_Output{
 		Cursor: pointer,
 		Feed:   feed,
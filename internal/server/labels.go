@@ -1,8 +1,13 @@
 package server
 
 import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/database"
+	"bluesky-oneshot-labeler/internal/listener"
 	"context"
 	"net"
+	"slices"
 	"strconv"
 	"time"
 
@@ -13,16 +18,23 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
-// This file implements a no-op Bluesky labeler that provides no labels.
-// The sole purpose of this labeler is to provide a convenient way to
-// report posts for block list curation.
+// This file implements the labeler endpoints.
+//
+// By default, the labeler is no-op and provides no labels. The sole purpose
+// of it is to provide a convenient way to report posts for block list curation.
+// With PUBLISH_LABELS set, the label log, which holds offender labels of users
+// in the internal block list along with their negations, is published.
 
 func (s *FiberServer) SubscribeLabelsHandler(c *websocket.Conn) {
-	cursorStr := c.Query("cursor", "0")
-	_, err := strconv.ParseInt(cursorStr, 10, 64)
-	if err != nil {
-		s.closeWithError(c, "InvalidRequest", "Invalid cursor")
-		return
+	cursor := s.emitter.Latest()
+	if cursorStr := c.Query("cursor"); cursorStr != "" {
+		var err error
+		cursor, err = strconv.ParseInt(cursorStr, 10, 64)
+		if err != nil || cursor < 0 {
+			s.closeWithError(c, "InvalidRequest", "Invalid cursor")
+			return
+		}
+		cursor = s.emitter.TranslateCursor(cursor)
 	}
 
 	c.SetPingHandler(func(message string) error {
@@ -39,15 +51,55 @@ func (s *FiberServer) SubscribeLabelsHandler(c *websocket.Conn) {
 	})
 
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	c.SetCloseHandler(func(code int, text string) error { cancel(); return nil })
-	<-ctx.Done()
+	go func() {
+		// control messages are only processed when reading
+		defer cancel()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
 
-	err = c.Close()
-	if err != nil {
+	if config.PublishLabels {
+		if cursor > s.emitter.Latest() {
+			s.closeWithError(c, "FutureCursor", "Cursor is in the future")
+			return
+		}
+		err := s.emitter.ForAllLabelsSince(ctx, cursor, func(label *database.Label) error {
+			return s.sendLabel(c, label)
+		})
+		if err != nil && ctx.Err() == nil {
+			s.log.Error("failed to stream labels", "error", err)
+		}
+	} else {
+		<-ctx.Done()
+	}
+
+	if err := c.Close(); err != nil {
 		s.log.Error("failed to close websocket", "error", err)
 	}
 }
 
+func (s *FiberServer) sendLabel(c *websocket.Conn, label *database.Label) error {
+	event := events.XRPCStreamEvent{
+		LabelLabels: &atproto.LabelSubscribeLabels_Labels{
+			Seq:    label.Seq,
+			Labels: []*atproto.LabelDefs_Label{listener.LabelToLexicon(label)},
+		},
+	}
+	writer, err := c.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if err := listener.SerializeEvent(&event, writer); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
 func (s *FiberServer) closeWithError(c *websocket.Conn, errStr string, message string) {
 	event := events.XRPCStreamEvent{
 		Error: &events.ErrorFrame{
@@ -70,14 +122,15 @@ func (s *FiberServer) closeWithError(c *websocket.Conn, errStr string, message s
 }
 
 type QueryLabelsInput struct {
-	Cursor int64
-	Limit  int64
+	UriPatterns []string `query:"uriPatterns"`
+	Sources     []string `query:"sources"`
+	Cursor      string   `query:"cursor"`
+	Limit       int64    `query:"limit"`
 }
 
 func (s *FiberServer) QueryLabelsHandler(c *fiber.Ctx) error {
 	input := QueryLabelsInput{
-		Cursor: 0,
-		Limit:  10,
+		Limit: 50,
 	}
 	err := c.QueryParser(&input)
 	if err != nil {
@@ -94,7 +147,48 @@ func (s *FiberServer) QueryLabelsHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(atproto.LabelQueryLabels_Output{
+	var cursor int64
+	if input.Cursor != "" {
+		cursor, err = strconv.ParseInt(input.Cursor, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+				ErrStr:  "InvalidRequest",
+				Message: "invalid cursor",
+			})
+		}
+		cursor = s.emitter.TranslateCursor(cursor)
+	}
+
+	output := atproto.LabelQueryLabels_Output{
 		Labels: []*atproto.LabelDefs_Label{},
-	})
+	}
+	if !config.PublishLabels {
+		return c.JSON(output)
+	}
+	if len(input.UriPatterns) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidRequest",
+			Message: "uriPatterns is required",
+		})
+	}
+	if len(input.Sources) != 0 && !slices.Contains(input.Sources, at_utils.UserDid.String()) {
+		return c.JSON(output)
+	}
+
+	labels, err := s.db.QueryLabels(input.UriPatterns, cursor, int(input.Limit))
+	if err != nil {
+		s.log.Error("failed to query labels", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalServerError",
+			Message: "failed to query labels",
+		})
+	}
+	for i := range labels {
+		output.Labels = append(output.Labels, listener.LabelToLexicon(&labels[i]))
+	}
+	if len(labels) == int(input.Limit) {
+		next := strconv.FormatInt(labels[len(labels)-1].Seq, 10)
+		output.Cursor = &next
+	}
+	return c.JSON(output)
 }
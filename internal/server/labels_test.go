@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/listener"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/util/labels"
+)
+
+// newLabelServer serves queryLabels over a label log of the given labels,
+// with cursors up to legacyCursor handed out before the log existed
+func newLabelServer(t *testing.T, legacyCursor string, labels ...[2]string) *FiberServer {
+	t.Helper()
+	s := newTestServer(t)
+	key, err := crypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish, previousKey, previousDid := config.PublishLabels, at_utils.KeyP256, at_utils.UserDid
+	t.Cleanup(func() {
+		config.PublishLabels, at_utils.KeyP256, at_utils.UserDid = publish, previousKey, previousDid
+	})
+	config.PublishLabels = true
+	at_utils.KeyP256 = key
+	at_utils.UserDid = syntax.DID("did:plc:labeler")
+
+	if err := s.db.SetConfig("legacy-label-cursor", legacyCursor); err != nil {
+		t.Fatal(err)
+	}
+	s.emitter, err = listener.NewLabelEmitter(discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, label := range labels {
+		neg := label[1] == "neg"
+		if _, err := s.emitter.Emit(label[0], at_utils.LabelOffenderString, neg, time.Now().UnixMilli()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.App.Get("/xrpc/com.atproto.label.queryLabels", s.QueryLabelsHandler)
+	return s
+}
+
+func queryLabels(t *testing.T, s *FiberServer, query url.Values) (int, *atproto.LabelQueryLabels_Output) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/xrpc/com.atproto.label.queryLabels?"+query.Encode(), nil)
+	resp, err := s.App.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var output atproto.LabelQueryLabels_Output
+	if resp.StatusCode == 200 {
+		if err := json.NewDecoder(resp.Body).Decode(&output); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, &output
+}
+
+// verifyOwnLabel checks the signature of a label against the current signing key
+func verifyOwnLabel(label *atproto.LabelDefs_Label) error {
+	unsigned := labels.UnsignedLabel{
+		Cid: label.Cid,
+		Cts: label.Cts,
+		Exp: label.Exp,
+		Neg: label.Neg,
+		Src: label.Src,
+		Uri: label.Uri,
+		Val: label.Val,
+		Ver: label.Ver,
+	}
+	bytes, err := unsigned.BytesForSigning()
+	if err != nil {
+		return err
+	}
+	pub, err := at_utils.KeyP256.PublicKey()
+	if err != nil {
+		return err
+	}
+	return pub.HashAndVerify(bytes, label.Sig)
+}
+
+func labelUris(output *atproto.LabelQueryLabels_Output) []string {
+	uris := []string{}
+	for _, label := range output.Labels {
+		uris = append(uris, label.Uri)
+	}
+	return uris
+}
+
+func TestQueryLabelsHandler(t *testing.T) {
+	s := newLabelServer(t, "2",
+		[2]string{"did:plc:aaa"},
+		[2]string{"did:plc:bbb"},
+		[2]string{"did:plc:bbb", "neg"},
+		[2]string{"did:plc:ccc"},
+		[2]string{"did:plc:a_b"},
+	)
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+		uris   []string
+		cursor string
+	}{
+		{
+			name:   "patterns",
+			query:  url.Values{"uriPatterns": {"did:plc:aaa", "did:plc:bbb"}},
+			status: 200,
+			uris:   []string{"did:plc:aaa"},
+		},
+		{
+			name:   "prefix with a literal underscore",
+			query:  url.Values{"uriPatterns": {"did:plc:a_*"}},
+			status: 200,
+			uris:   []string{"did:plc:a_b"},
+		},
+		{
+			name:   "pages",
+			query:  url.Values{"uriPatterns": {"*"}, "limit": {"2"}},
+			status: 200,
+			uris:   []string{"did:plc:aaa", "did:plc:ccc"},
+			cursor: "4",
+		},
+		{
+			name:   "next page",
+			query:  url.Values{"uriPatterns": {"*"}, "limit": {"2"}, "cursor": {"4"}},
+			status: 200,
+			uris:   []string{"did:plc:a_b"},
+		},
+		{
+			name:   "legacy cursors replay the whole log",
+			query:  url.Values{"uriPatterns": {"*"}, "cursor": {"2"}},
+			status: 200,
+			uris:   []string{"did:plc:aaa", "did:plc:ccc", "did:plc:a_b"},
+		},
+		{
+			name:   "other sources",
+			query:  url.Values{"uriPatterns": {"*"}, "sources": {"did:plc:other"}},
+			status: 200,
+			uris:   []string{},
+		},
+		{
+			name:   "our source",
+			query:  url.Values{"uriPatterns": {"did:plc:ccc"}, "sources": {"did:plc:other", "did:plc:labeler"}},
+			status: 200,
+			uris:   []string{"did:plc:ccc"},
+		},
+		{name: "no patterns", query: url.Values{}, status: 400},
+		{name: "invalid cursor", query: url.Values{"uriPatterns": {"*"}, "cursor": {"x"}}, status: 400},
+		{name: "limit too low", query: url.Values{"uriPatterns": {"*"}, "limit": {"0"}}, status: 400},
+		{name: "limit too high", query: url.Values{"uriPatterns": {"*"}, "limit": {"251"}}, status: 400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, output := queryLabels(t, s, test.query)
+			if status != test.status {
+				t.Fatalf("got status %d, expected %d", status, test.status)
+			}
+			if status != 200 {
+				return
+			}
+			uris := labelUris(output)
+			if len(uris) != len(test.uris) {
+				t.Fatalf("got labels %v, expected %v", uris, test.uris)
+			}
+			for i := range uris {
+				if uris[i] != test.uris[i] {
+					t.Fatalf("got labels %v, expected %v", uris, test.uris)
+				}
+			}
+			cursor := ""
+			if output.Cursor != nil {
+				cursor = *output.Cursor
+			}
+			if cursor != test.cursor {
+				t.Errorf("got cursor %q, expected %q", cursor, test.cursor)
+			}
+			for _, label := range output.Labels {
+				if err := verifyOwnLabel(label); err != nil {
+					t.Errorf("label of %s does not verify: %v", label.Uri, err)
+				}
+			}
+		})
+	}
+
+	config.PublishLabels = false
+	status, output := queryLabels(t, s, url.Values{"uriPatterns": {"*"}})
+	if status != 200 || len(output.Labels) != 0 {
+		t.Errorf("got status %d and labels %v while not publishing", status, labelUris(output))
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/database"
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/gofiber/fiber/v2"
+)
+
+// SeedModerators adds the users in MODERATOR_HANDLES as admins if there are no moderators yet.
+//
+// Handles are only resolved once: afterwards moderators are identified by their DIDs,
+// so that whoever takes over a handle does not become a moderator.
+func SeedModerators(ctx context.Context, logger *slog.Logger) error {
+	db := database.Instance()
+	moderators, err := db.GetModerators()
+	if err != nil {
+		return err
+	}
+	if len(moderators) != 0 {
+		return nil
+	}
+	for _, handle := range config.ModeratorHandles {
+		if handle == "" {
+			continue
+		}
+		ident, err := at_utils.LookupIdentifier(ctx, handle)
+		if err != nil {
+			logger.Warn("failed to resolve moderator handle", "handle", handle, "err", err)
+			continue
+		}
+		uid, err := db.GetUserId(ident.DID.String())
+		if err != nil {
+			return err
+		}
+		if err := db.SetModerator(uid, database.RoleAdmin); err != nil {
+			return err
+		}
+		logger.Info("moderator added", "handle", handle, "did", ident.DID.String(), "role", database.RoleAdmin.String())
+	}
+	return nil
+}
+
+// AdminAuthMiddleware guards the admin API with ADMIN_TOKEN, which is disabled if not set
+func (s *FiberServer) AdminAuthMiddleware(c *fiber.Ctx) error {
+	token := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+	if config.AdminToken == "" ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidToken",
+			Message: "Invalid admin token",
+		})
+	}
+	return c.Next()
+}
+
+type moderatorView struct {
+	Did       string `json:"did"`
+	Handle    string `json:"handle"`
+	Role      string `json:"role"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func (s *FiberServer) ListModeratorsHandler(c *fiber.Ctx) error {
+	moderators, err := s.db.GetModerators()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	views := make([]moderatorView, len(moderators))
+	for i, m := range moderators {
+		views[i] = moderatorView{
+			Did:       m.Did,
+			Handle:    at_utils.DisplayHandle(c.Context(), m.Did),
+			Role:      m.Role.String(),
+			CreatedAt: time.UnixMilli(m.Cts).UTC().Format(time.RFC3339),
+		}
+	}
+	return c.JSON(fiber.Map{
+		"moderators": views,
+	})
+}
+
+type setModeratorInput struct {
+	Role string `json:"role"`
+}
+
+// SetModeratorHandler adds a moderator by their handle or DID, or changes their role
+func (s *FiberServer) SetModeratorHandler(c *fiber.Ctx) error {
+	input := setModeratorInput{}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "BadRequest",
+			Message: err.Error(),
+		})
+	}
+	role, err := database.ParseModeratorRole(input.Role)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "BadRequest",
+			Message: err.Error(),
+		})
+	}
+	ident, err := at_utils.LookupIdentifier(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "BadRequest",
+			Message: err.Error(),
+		})
+	}
+	uid, err := s.db.GetUserId(ident.DID.String())
+	if err == nil {
+		err = s.db.SetModerator(uid, role)
+	}
+	s.recordAction(ActorAdminApi, "set-moderator", ident.DID.String(), role.String(), err)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	s.log.Info("moderator set", "did", ident.DID.String(), "role", role.String())
+	return c.JSON(moderatorView{
+		Did:       ident.DID.String(),
+		Handle:    ident.Handle.String(),
+		Role:      role.String(),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+func (s *FiberServer) RemoveModeratorHandler(c *fiber.Ctx) error {
+	ident, err := at_utils.LookupIdentifier(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "BadRequest",
+			Message: err.Error(),
+		})
+	}
+	uid, err := s.db.GetUserId(ident.DID.String())
+	var removed bool
+	if err == nil {
+		removed, err = s.db.RemoveModerator(uid)
+	}
+	if err == nil && removed {
+		s.recordAction(ActorAdminApi, "remove-moderator", ident.DID.String(), "", nil)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	if !removed {
+		return c.Status(fiber.StatusNotFound).JSON(xrpc.XRPCError{
+			ErrStr:  "NotFound",
+			Message: "Not a moderator",
+		})
+	}
+	s.log.Info("moderator removed", "did", ident.DID.String())
+	return c.SendStatus(fiber.StatusNoContent)
+}
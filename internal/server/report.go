@@ -3,43 +3,38 @@ package server
 import (
 	"bluesky-oneshot-labeler/internal/at_utils"
 	"bluesky-oneshot-labeler/internal/config"
-	"os"
-	"slices"
+	"bluesky-oneshot-labeler/internal/database"
+	"bluesky-oneshot-labeler/internal/listener"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/gofiber/fiber/v2"
 )
 
-var writeToCsvLock = sync.Mutex{}
+// Reporters look up their reports with these queries of our own, which their PDSes proxy to us
+// (with the atproto-proxy header set to "<labeler did>#atproto_labeler") like createReport.
+const (
+	createReportMethod = "com.atproto.moderation.createReport"
+	listReportsMethod  = "party.iroiro.oneshot.listReports"
+	getReportMethod    = "party.iroiro.oneshot.getReport"
+)
 
 func (s *FiberServer) CreateReportHandler(c *fiber.Ctx) error {
-	auth := c.Get("Authorization")
-	if !strings.HasPrefix(auth, "Bearer ") {
-		return c.Status(fiber.StatusUnauthorized).JSON(xrpc.XRPCError{
-			ErrStr:  "InvalidToken",
-			Message: "Missing Bearer token",
-		})
-	}
-	bearer := strings.TrimPrefix(auth, "Bearer ")
-	ident, err := at_utils.VerifyJwtToken(c.Context(), bearer)
+	ident, err := verifyServiceAuth(c, createReportMethod)
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(xrpc.XRPCError{
 			ErrStr:  "InvalidToken",
 			Message: err.Error(),
 		})
 	}
-	if !slices.Contains(config.ModeratorHandles, ident.Handle.String()) {
-		return c.Status(fiber.StatusUnauthorized).JSON(xrpc.XRPCError{
-			ErrStr:  "InvalidToken",
-			Message: "Not a moderator",
-		})
-	}
-
 	input := atproto.ModerationCreateReport_Input{}
 	if err := c.BodyParser(&input); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
@@ -77,60 +72,412 @@ func (s *FiberServer) CreateReportHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	if uri != "" && input.Reason != nil && strings.TrimSpace(*input.Reason) == "del" {
-		compactUri := uri.Authority().String() + "/" + uri.RecordKey().String()
-		if err := s.db.DeleteFeedItem(compactUri); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
-				ErrStr:  "InternalError",
-				Message: err.Error(),
-			})
-		}
-	} else {
-		go s.writeToBlockListCsv(offender.String(), input.ReasonType, input.Reason)
+	role, err := s.db.GetModeratorRole(strings.TrimPrefix(ident.DID.String(), "did:"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	if role == 0 {
+		return s.queueReport(c, ident.DID, offender, &input)
+	}
+
+	command, err := parseReportCommand(input.Reason)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidReportCommand",
+			Message: err.Error(),
+		})
+	}
+	if role < command.requiredRole() {
+		return c.Status(fiber.StatusForbidden).JSON(xrpc.XRPCError{
+			ErrStr:  "InsufficientRole",
+			Message: command.Name + " requires the " + command.requiredRole().String() + " role",
+		})
+	}
+	if command.needsPost() && (uri == "" || uri.Collection().String() != "app.bsky.feed.post") {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidReportCommand",
+			Message: command.Name + " applies to posts only",
+		})
+	}
+	reporterUid, err := s.db.GetUserId(ident.DID.String())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	report, err := s.newReport(reporterUid, offender, &input)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+
+	cmdErr := s.runReportCommand(command, offender, uri, input.ReasonType)
+	s.recordAction(ident.DID.String(), command.Name, report.Subject, report.Reason, cmdErr)
+	report.Status = database.ReportAccepted
+	if cmdErr != nil {
+		report.Status = database.ReportFailed
+	}
+	id, err := s.db.InsertReport(report)
+	if err != nil {
+		s.log.Error("failed to persist report", "subject", report.Subject, "err", err)
 	}
+	if cmdErr != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: cmdErr.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	s.log.Info("report command", "id", id, "by", ident.DID.String(), "handle", ident.Handle.String(), "command", command.Name, "subject", report.Subject)
+
+	return c.JSON(reportOutput(id, report, ident.DID, &input))
+}
+
+// verifyServiceAuth verifies the service auth token of the request for the XRPC method, returning the requester
+func verifyServiceAuth(c *fiber.Ctx, method string) (*identity.Identity, error) {
+	auth := c.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, fmt.Errorf("missing Bearer token")
+	}
+	bearer := strings.TrimPrefix(auth, "Bearer ")
+	return at_utils.VerifyJwtToken(c.Context(), bearer, method)
+}
+
+func (s *FiberServer) newReport(reporterUid int64, offender syntax.DID, input *atproto.ModerationCreateReport_Input) (*database.Report, error) {
+	uid, err := s.db.GetUserId(offender.String())
+	if err != nil {
+		return nil, err
+	}
+	report := &database.Report{
+		Uid:      uid,
+		Subject:  input.Subject.RepoStrongRef.Uri,
+		Reporter: reporterUid,
+		Cts:      time.Now().UnixMilli(),
+		Status:   database.ReportPending,
+	}
+	if input.ReasonType != nil {
+		report.ReasonType = *input.ReasonType
+	}
+	if input.Reason != nil {
+		report.Reason = *input.Reason
+	}
+	return report, nil
+}
 
-	return c.JSON(&atproto.ModerationCreateReport_Output{
-		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
-		Id:         0,
+func reportOutput(id int64, report *database.Report, reporter syntax.DID, input *atproto.ModerationCreateReport_Input) *atproto.ModerationCreateReport_Output {
+	return &atproto.ModerationCreateReport_Output{
+		CreatedAt:  time.UnixMilli(report.Cts).UTC().Format(time.RFC3339),
+		Id:         id,
 		Reason:     input.Reason,
 		ReasonType: input.ReasonType,
-		ReportedBy: ident.DID.String(),
+		ReportedBy: reporter.String(),
 		Subject: &atproto.ModerationCreateReport_Output_Subject{
 			RepoStrongRef: input.Subject.RepoStrongRef,
 		},
-	})
+	}
 }
 
-func escapeCsvString(s *string) string {
-	if s == nil {
-		return ""
+func (s *FiberServer) runReportCommand(command *reportCommand, offender syntax.DID, uri syntax.ATURI, reasonType *string) error {
+	switch command.Name {
+	case reportDelete:
+		return s.db.DeleteFeedItem(compactPostUri(uri))
+	case reportBlock:
+		var note *string
+		if command.Arg != "" {
+			note = &command.Arg
+		}
+		return s.writeToBlockList(offender.String(), reasonType, note)
+	case reportUnblock:
+		return s.unblock(offender)
+	case reportAllow:
+		uid, err := s.db.GetUserId(offender.String())
+		if err != nil {
+			return err
+		}
+		if err := s.db.AllowUser(uid); err != nil {
+			return err
+		}
+		if err := s.moderator.ReloadAllowed(); err != nil {
+			return err
+		}
+		return s.unblock(offender)
+	case reportPin:
+		return s.db.PinPost(compactPostUri(uri))
+	case reportUnpin:
+		return s.db.UnpinPost(compactPostUri(uri))
+	case reportMuteTag, reportKeyword:
+		kind := database.MutedTag
+		if command.Name == reportKeyword {
+			kind = database.MutedKeyword
+		}
+		if err := s.db.MuteWord(kind, command.Arg); err != nil {
+			return err
+		}
+		return listener.ReloadMutedWords(s.db)
+	case reportRecheck:
+		return s.moderator.RecheckAccount(offender.String())
+	case reportAccept, reportReject:
+		uid, err := s.db.GetUserId(offender.String())
+		if err != nil {
+			return err
+		}
+		status := database.ReportRejected
+		if command.Name == reportAccept {
+			// reviewers may not block anyone they like, only those reported by others
+			open, err := s.db.CountReporters(uid, 0)
+			if err != nil {
+				return err
+			}
+			if open == 0 {
+				return fmt.Errorf("no open reports on %s", offender.String())
+			}
+			status = database.ReportAccepted
+			note := "accepted reports"
+			if err := s.writeToBlockList(offender.String(), reasonType, &note); err != nil {
+				return err
+			}
+		}
+		closed, err := s.db.UpdateReports(uid, status)
+		if err != nil {
+			return err
+		}
+		s.log.Info("reports closed", "did", offender.String(), "status", status.String(), "count", closed)
 	}
-	return `"` + strings.ReplaceAll(*s, `"`, `""`) + `"`
+	return nil
 }
 
-func (s *FiberServer) writeToBlockListCsv(did string, reasonType, reason *string) {
-	writeToCsvLock.Lock()
-	defer writeToCsvLock.Unlock()
+// queueReport puts a report from a non-moderator into the review queue
+func (s *FiberServer) queueReport(c *fiber.Ctx, reporter, offender syntax.DID, input *atproto.ModerationCreateReport_Input) error {
+	reporterUid, err := s.db.GetUserId(reporter.String())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	recent, err := s.db.CountRecentReports(reporterUid, time.Now().Add(-time.Hour))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	if recent >= int64(config.ReportRateLimit) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(xrpc.XRPCError{
+			ErrStr:  "RateLimitExceeded",
+			Message: "Too many reports, please try again later",
+		})
+	}
 
-	path := config.ExternalBlockList
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	report, err := s.newReport(reporterUid, offender, input)
 	if err != nil {
-		s.log.Error("failed to open blocklist csv file for writing", "err", err)
-		return
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	id, err := s.db.InsertReport(report)
+	if err == nil && id == 0 {
+		// already reported and still open
+		id, err = s.db.GetOpenReportId(reporterUid, report.Subject)
+	} else if err == nil {
+		s.log.Info("report queued", "id", id, "subject", report.Subject)
+		s.escalateReports(report.Uid, offender)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
 	}
-	defer f.Close()
 
-	typeStr := escapeCsvString(reasonType)
-	line := did + "," + typeStr + "," + escapeCsvString(reason) + "\n"
+	return c.JSON(reportOutput(id, report, reporter, input))
+}
+
+type reportView struct {
+	Id         int64  `json:"id"`
+	Subject    string `json:"subject"`
+	ReasonType string `json:"reasonType,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+	Status     string `json:"status"`
+}
+
+func newReportView(report *database.Report) reportView {
+	return reportView{
+		Id:         report.Id,
+		Subject:    report.Subject,
+		ReasonType: report.ReasonType,
+		Reason:     report.Reason,
+		CreatedAt:  time.UnixMilli(report.Cts).UTC().Format(time.RFC3339),
+		Status:     report.Status.String(),
+	}
+}
+
+type listReportsInput struct {
+	Cursor int64 `query:"cursor"`
+	Limit  int   `query:"limit"`
+}
+
+// ListReportsHandler lets a reporter look up the status of their own reports, the latest first
+func (s *FiberServer) ListReportsHandler(c *fiber.Ctx) error {
+	ident, err := verifyServiceAuth(c, listReportsMethod)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidToken",
+			Message: err.Error(),
+		})
+	}
+	input := listReportsInput{
+		Cursor: math.MaxInt64,
+		Limit:  50,
+	}
+	if err := c.QueryParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidRequest",
+			Message: err.Error(),
+		})
+	}
+	if input.Limit > 100 || input.Limit <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidRequest",
+			Message: "Limit must be between 1 and 100",
+		})
+	}
 
-	if _, err := f.WriteString(line); err != nil {
-		s.log.Error("failed to write to blocklist csv file", "err", err)
+	reporter, err := s.db.GetUserId(ident.DID.String())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	reports, err := s.db.GetReportsByReporter(reporter, input.Cursor, input.Limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	views := make([]reportView, len(reports))
+	for i := range reports {
+		views[i] = newReportView(&reports[i])
+	}
+	var cursor *string
+	if len(reports) == input.Limit {
+		next := strconv.FormatInt(reports[len(reports)-1].Id, 10)
+		cursor = &next
+	}
+	return c.JSON(fiber.Map{
+		"cursor":  cursor,
+		"reports": views,
+	})
+}
+
+// GetReportHandler lets a reporter look up the status of one of their reports
+func (s *FiberServer) GetReportHandler(c *fiber.Ctx) error {
+	ident, err := verifyServiceAuth(c, getReportMethod)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidToken",
+			Message: err.Error(),
+		})
+	}
+	id, err := strconv.ParseInt(c.Query("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(xrpc.XRPCError{
+			ErrStr:  "InvalidRequest",
+			Message: "Invalid report id",
+		})
+	}
+
+	reporter, err := s.db.GetUserId(ident.DID.String())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	report, err := s.db.GetReport(reporter, id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(xrpc.XRPCError{
+			ErrStr:  "InternalError",
+			Message: err.Error(),
+		})
+	}
+	if report == nil {
+		return c.Status(fiber.StatusNotFound).JSON(xrpc.XRPCError{
+			ErrStr:  "NotFound",
+			Message: "Report not found",
+		})
+	}
+	return c.JSON(newReportView(report))
+}
+
+// escalateReports escalates the open reports on an account once enough distinct users have reported it
+func (s *FiberServer) escalateReports(uid int64, offender syntax.DID) {
+	threshold := int64(config.ReportEscalationThreshold)
+	if threshold == 0 {
+		return
+	}
+	// the candidates of the follow graph are queued for review by the labeler itself,
+	// which is no reporter of its own
+	labeler, err := s.db.GetUserId(at_utils.UserDid.String())
+	if err != nil {
+		s.log.Error("failed to look up the labeler", "err", err)
+		return
+	}
+	reporters, err := s.db.CountReporters(uid, labeler)
+	if err != nil {
+		s.log.Error("failed to count reporters", "err", err)
+		return
+	}
+	if reporters < threshold {
 		return
 	}
-	if err := f.Sync(); err != nil {
-		s.log.Error("failed to sync blocklist csv file", "err", err)
+	if _, err := s.db.UpdateReports(uid, database.ReportEscalated); err != nil {
+		s.log.Error("failed to escalate reports", "err", err)
 		return
 	}
+	s.log.Warn("reports escalated", "did", offender.String(), "reporters", reporters)
+}
+
+// compactPostUri converts a post uri to the "did/rkey" form used in the feed
+func compactPostUri(uri syntax.ATURI) string {
+	return uri.Authority().String() + "/" + uri.RecordKey().String()
+}
+
+func (s *FiberServer) unblock(offender syntax.DID) error {
+	removed, err := s.blockList.Remove(offender.String())
+	if removed {
+		s.log.Info("removed from blocklist csv", "did", offender.String())
+	}
+	// the internal block list does not depend on the file, so unblock there anyway
+	return errors.Join(err, s.moderator.UnblockAccount(offender.String()))
+}
 
-	s.log.Info("added to blocklist csv", "did", did, "type", typeStr)
+func (s *FiberServer) writeToBlockList(did string, reasonType, reason *string) error {
+	entry := listener.BlockListEntry{Did: did}
+	if reasonType != nil {
+		entry.ReasonType = *reasonType
+	}
+	if reason != nil {
+		entry.Reason = *reason
+	}
+	if err := s.blockList.Add(entry); err != nil {
+		return fmt.Errorf("failed to write to blocklist: %w", err)
+	}
+	s.log.Info("added to blocklist csv", "did", did, "type", entry.ReasonType)
+	return nil
 }
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bluesky-oneshot-labeler/internal/database"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Moderators control the labeler through the reason of their reports:
+//
+//	(empty)          same as block
+//	del              remove the reported post from the feed
+//	block [note]     add the author to the CSV block list, with an optional note
+//	unblock          remove the author from both the CSV and the internal block lists
+//	allow            unblock the author and never block them automatically again
+//	pin / unpin      pin the reported post to the top of the feed, or unpin it
+//	mute-tag #foo    filter out posts tagged #foo
+//	keyword "..."    filter out posts containing the (quoted) text
+//	recheck          re-evaluate the author against the upstream labels
+//	accept           block the author and close the queued reports on them, if there are any
+//	reject           close the queued reports on the author without action
+const (
+	reportDelete  = "del"
+	reportBlock   = "block"
+	reportUnblock = "unblock"
+	reportAllow   = "allow"
+	reportPin     = "pin"
+	reportUnpin   = "unpin"
+	reportMuteTag = "mute-tag"
+	reportKeyword = "keyword"
+	reportRecheck = "recheck"
+	reportAccept  = "accept"
+	reportReject  = "reject"
+)
+
+type reportCommand struct {
+	Name string
+	Arg  string
+}
+
+// needsPost tells if the command applies to the reported post instead of its author
+func (c *reportCommand) needsPost() bool {
+	switch c.Name {
+	case reportDelete, reportPin, reportUnpin:
+		return true
+	}
+	return false
+}
+
+// requiredRole is the lowest moderator role that may run the command
+func (c *reportCommand) requiredRole() database.ModeratorRole {
+	switch c.Name {
+	case reportDelete, reportRecheck, reportAccept, reportReject:
+		return database.RoleReviewer
+	case reportAllow:
+		return database.RoleAdmin
+	default:
+		return database.RoleModerator
+	}
+}
+
+func parseReportCommand(reason *string) (*reportCommand, error) {
+	text := ""
+	if reason != nil {
+		text = strings.TrimSpace(*reason)
+	}
+	if text == "" {
+		return &reportCommand{Name: reportBlock}, nil
+	}
+
+	name, arg, _ := strings.Cut(text, " ")
+	name = strings.ToLower(name)
+	arg = strings.TrimSpace(arg)
+	command := &reportCommand{Name: name, Arg: arg}
+	switch name {
+	case reportBlock:
+	case reportDelete, reportUnblock, reportAllow, reportPin, reportUnpin, reportRecheck, reportAccept, reportReject:
+		if arg != "" {
+			return nil, fmt.Errorf("%s takes no argument", name)
+		}
+	case reportMuteTag:
+		tag := strings.TrimPrefix(arg, "#")
+		if tag == "" || strings.ContainsAny(tag, " \t\n#") {
+			return nil, fmt.Errorf("usage: mute-tag #tag")
+		}
+		command.Arg = tag
+	case reportKeyword:
+		if strings.HasPrefix(arg, `"`) {
+			unquoted, err := strconv.Unquote(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted keyword: %w", err)
+			}
+			arg = unquoted
+		}
+		if strings.TrimSpace(arg) == "" {
+			return nil, fmt.Errorf(`usage: keyword "text"`)
+		}
+		command.Arg = arg
+	default:
+		return nil, fmt.Errorf(
+			"unknown command %q, expecting one of: del, block [note], unblock, allow, pin, unpin, mute-tag #tag, keyword \"text\", recheck, accept, reject",
+			name,
+		)
+	}
+	return command, nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestParseReportCommand(t *testing.T) {
+	tests := []struct {
+		reason  *string
+		name    string
+		arg     string
+		wantErr bool
+	}{
+		{reason: nil, name: reportBlock},
+		{reason: ptr(""), name: reportBlock},
+		{reason: ptr("  \n"), name: reportBlock},
+		{reason: ptr("block"), name: reportBlock},
+		{reason: ptr("block spam account"), name: reportBlock, arg: "spam account"},
+		{reason: ptr("BLOCK   note "), name: reportBlock, arg: "note"},
+		{reason: ptr("del"), name: reportDelete},
+		{reason: ptr("del now"), wantErr: true},
+		{reason: ptr("unblock"), name: reportUnblock},
+		{reason: ptr("allow"), name: reportAllow},
+		{reason: ptr("pin"), name: reportPin},
+		{reason: ptr("unpin"), name: reportUnpin},
+		{reason: ptr("recheck"), name: reportRecheck},
+		{reason: ptr("accept"), name: reportAccept},
+		{reason: ptr("reject please"), wantErr: true},
+		{reason: ptr("mute-tag #foo"), name: reportMuteTag, arg: "foo"},
+		{reason: ptr("mute-tag foo"), name: reportMuteTag, arg: "foo"},
+		{reason: ptr("mute-tag"), wantErr: true},
+		{reason: ptr("mute-tag #"), wantErr: true},
+		{reason: ptr("mute-tag #foo bar"), wantErr: true},
+		{reason: ptr("mute-tag #foo#bar"), wantErr: true},
+		{reason: ptr(`keyword "hello world"`), name: reportKeyword, arg: "hello world"},
+		{reason: ptr(`keyword "say \"hi\""`), name: reportKeyword, arg: `say "hi"`},
+		{reason: ptr("keyword plain text"), name: reportKeyword, arg: "plain text"},
+		{reason: ptr(`keyword "unterminated`), wantErr: true},
+		{reason: ptr(`keyword ""`), wantErr: true},
+		{reason: ptr(`keyword "  "`), wantErr: true},
+		{reason: ptr("keyword"), wantErr: true},
+		{reason: ptr("spam"), wantErr: true},
+	}
+	for _, test := range tests {
+		command, err := parseReportCommand(test.reason)
+		reason := "<nil>"
+		if test.reason != nil {
+			reason = *test.reason
+		}
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseReportCommand(%q) = %+v, expected an error", reason, command)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseReportCommand(%q) failed: %v", reason, err)
+			continue
+		}
+		if command.Name != test.name || command.Arg != test.arg {
+			t.Errorf("parseReportCommand(%q) = %+v, expected %s %q", reason, command, test.name, test.arg)
+		}
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,539 @@
+package server
+
+import (
+	"bluesky-oneshot-labeler/internal/at_utils"
+	"bluesky-oneshot-labeler/internal/config"
+	"bluesky-oneshot-labeler/internal/database"
+	"bluesky-oneshot-labeler/internal/listener"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const (
+	offenderDid  = "did:plc:offender"
+	offenderPost = "at://did:plc:offender/app.bsky.feed.post/3kpost"
+)
+
+// fakeModerator records the actions on accounts that report commands take through the listeners
+type fakeModerator struct {
+	unblocked []string
+	rechecked []string
+	reloads   int
+}
+
+func (m *fakeModerator) UnblockAccount(did string) error {
+	m.unblocked = append(m.unblocked, did)
+	return nil
+}
+
+func (m *fakeModerator) RecheckAccount(did string) error {
+	m.rechecked = append(m.rechecked, did)
+	return nil
+}
+
+func (m *fakeModerator) ReloadAllowed() error {
+	m.reloads++
+	return nil
+}
+
+// reportServer serves createReport to reporters whose service auth tokens it can verify
+type reportServer struct {
+	*FiberServer
+	moderator *fakeModerator
+	directory identity.MockDirectory
+	keys      map[string]*crypto.PrivateKeyP256
+}
+
+func newReportServer(t *testing.T) *reportServer {
+	t.Helper()
+	s := newTestServer(t)
+	blockList, err := listener.NewBlockListInSync(filepath.Join(t.TempDir(), "blocklist.csv"), discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	moderator := &fakeModerator{}
+	s.blockList = blockList
+	s.moderator = moderator
+	s.App.Post("/xrpc/"+createReportMethod, s.CreateReportHandler)
+
+	directory, userDid := at_utils.IdentityDirectory, at_utils.UserDid
+	t.Cleanup(func() {
+		at_utils.IdentityDirectory, at_utils.UserDid = directory, userDid
+	})
+	server := &reportServer{
+		FiberServer: s,
+		moderator:   moderator,
+		directory:   identity.NewMockDirectory(),
+		keys:        make(map[string]*crypto.PrivateKeyP256),
+	}
+	at_utils.IdentityDirectory = &server.directory
+	at_utils.UserDid = syntax.DID("did:plc:labeler")
+	return server
+}
+
+// addUser registers a user able to sign service auth tokens, as a moderator if role is set
+func (s *reportServer) addUser(t *testing.T, did string, role database.ModeratorRole) {
+	t.Helper()
+	key, err := crypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.keys[did] = key
+	s.directory.Insert(identity.Identity{
+		DID:    syntax.DID(did),
+		Handle: syntax.Handle(strings.TrimPrefix(did, "did:plc:") + ".test"),
+		Keys: map[string]identity.Key{
+			"atproto": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()},
+		},
+	})
+	if role == 0 {
+		return
+	}
+	uid, err := s.db.GetUserId(did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.SetModerator(uid, role); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serviceAuth signs a service auth token of the user for createReport
+func (s *reportServer) serviceAuth(t *testing.T, did string) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	now := time.Now().Unix()
+	signed := encode(map[string]string{"alg": "ES256", "typ": "JWT"}) + "." + encode(map[string]any{
+		"iss": did,
+		"aud": at_utils.UserDid.String(),
+		"lxm": createReportMethod,
+		"iat": now,
+		"exp": now + 60,
+	})
+	signature, err := s.keys[did].HashAndSign([]byte(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// report sends a report on the subject as the user, returning the status and the error if any
+func (s *reportServer) report(t *testing.T, did, subject, reason string) (int, string) {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{
+		"reasonType": "com.atproto.moderation.defs#reasonSpam",
+		"reason":     reason,
+		"subject": map[string]string{
+			"$type": "com.atproto.repo.strongRef",
+			"uri":   subject,
+			"cid":   "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/xrpc/"+createReportMethod, strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.serviceAuth(t, did))
+	resp, err := s.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var xrpcErr xrpc.XRPCError
+	if resp.StatusCode != 200 {
+		if err := json.NewDecoder(resp.Body).Decode(&xrpcErr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, xrpcErr.ErrStr
+}
+
+func (s *reportServer) blockedDids(t *testing.T) []string {
+	t.Helper()
+	entries, problems := s.blockList.Entries()
+	if len(problems) != 0 {
+		t.Fatalf("malformed block list: %v", problems)
+	}
+	dids := make([]string, len(entries))
+	for i, entry := range entries {
+		dids[i] = entry.Did
+	}
+	return dids
+}
+
+// reportStatuses lists the statuses of the reports of the user, the latest first
+func (s *reportServer) reportStatuses(t *testing.T, did string) []database.ReportStatus {
+	t.Helper()
+	uid, err := s.db.GetUserId(did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err := s.db.GetReportsByReporter(uid, math.MaxInt64, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make([]database.ReportStatus, len(reports))
+	for i, report := range reports {
+		statuses[i] = report.Status
+	}
+	return statuses
+}
+
+func (s *reportServer) feedItems(t *testing.T) []string {
+	t.Helper()
+	cursor := int64(math.MaxInt64)
+	items, err := s.db.GetFeedItems(&cursor, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func TestReportCommandsByRole(t *testing.T) {
+	const (
+		reviewer  = "did:plc:reviewer"
+		moderator = "did:plc:moderator"
+		admin     = "did:plc:admin"
+		user      = "did:plc:user"
+	)
+	tests := []struct {
+		name     string
+		reporter string
+		subject  string
+		reason   string
+		// setup runs with the users registered, before the report
+		setup  func(t *testing.T, s *reportServer)
+		status int
+		errStr string
+		check  func(t *testing.T, s *reportServer)
+	}{
+		{
+			name:     "reviewer removes a post from the feed",
+			reporter: reviewer,
+			subject:  offenderPost,
+			reason:   "del",
+			setup: func(t *testing.T, s *reportServer) {
+				if err := s.db.InsertFeedItem(compactPostUri(syntax.ATURI(offenderPost))); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status: 200,
+			check: func(t *testing.T, s *reportServer) {
+				if items := s.feedItems(t); len(items) != 0 {
+					t.Errorf("post still in the feed: %v", items)
+				}
+			},
+		},
+		{
+			name:     "reviewer may not block",
+			reporter: reviewer,
+			subject:  offenderDid,
+			reason:   "block",
+			status:   403,
+			errStr:   "InsufficientRole",
+			check: func(t *testing.T, s *reportServer) {
+				if dids := s.blockedDids(t); len(dids) != 0 {
+					t.Errorf("blocked %v", dids)
+				}
+				if statuses := s.reportStatuses(t, reviewer); len(statuses) != 0 {
+					t.Errorf("rejected command stored as reports %v", statuses)
+				}
+			},
+		},
+		{
+			name:     "moderator blocks",
+			reporter: moderator,
+			subject:  offenderPost,
+			reason:   "block spam account",
+			status:   200,
+			check: func(t *testing.T, s *reportServer) {
+				entries, _ := s.blockList.Entries()
+				if len(entries) != 1 || entries[0].Did != offenderDid || entries[0].Reason != "spam account" {
+					t.Errorf("got block list %+v, expected the offender with the note", entries)
+				}
+				statuses := s.reportStatuses(t, moderator)
+				if !slices.Equal(statuses, []database.ReportStatus{database.ReportAccepted}) {
+					t.Errorf("got reports %v, expected the command accepted", statuses)
+				}
+			},
+		},
+		{
+			name:     "moderator unblocks",
+			reporter: moderator,
+			subject:  offenderDid,
+			reason:   "unblock",
+			setup: func(t *testing.T, s *reportServer) {
+				if err := s.blockList.Add(listener.BlockListEntry{Did: offenderDid}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status: 200,
+			check: func(t *testing.T, s *reportServer) {
+				if dids := s.blockedDids(t); len(dids) != 0 {
+					t.Errorf("still blocked in the block list: %v", dids)
+				}
+				if !slices.Equal(s.moderator.unblocked, []string{offenderDid}) {
+					t.Errorf("got unblocked %v, expected the offender unblocked internally", s.moderator.unblocked)
+				}
+			},
+		},
+		{
+			name:     "moderator mutes a tag",
+			reporter: moderator,
+			subject:  offenderPost,
+			reason:   "mute-tag #spam",
+			status:   200,
+			check: func(t *testing.T, s *reportServer) {
+				words, err := s.db.GetMutedWords()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(words) != 1 || words[0].Kind != database.MutedTag || words[0].Value != "spam" {
+					t.Errorf("got muted words %+v, expected the tag", words)
+				}
+			},
+		},
+		{
+			name:     "moderator pins posts only",
+			reporter: moderator,
+			subject:  offenderDid,
+			reason:   "pin",
+			status:   400,
+			errStr:   "InvalidReportCommand",
+		},
+		{
+			name:     "moderator may not allow",
+			reporter: moderator,
+			subject:  offenderDid,
+			reason:   "allow",
+			status:   403,
+			errStr:   "InsufficientRole",
+			check: func(t *testing.T, s *reportServer) {
+				if allowed, err := s.db.IsUserAllowed(strings.TrimPrefix(offenderDid, "did:")); err != nil || allowed {
+					t.Errorf("got allowed %v, %v", allowed, err)
+				}
+				if s.moderator.reloads != 0 || len(s.moderator.unblocked) != 0 {
+					t.Errorf("listeners updated: %+v", s.moderator)
+				}
+			},
+		},
+		{
+			name:     "admin allows",
+			reporter: admin,
+			subject:  offenderDid,
+			reason:   "allow",
+			setup: func(t *testing.T, s *reportServer) {
+				if err := s.blockList.Add(listener.BlockListEntry{Did: offenderDid}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status: 200,
+			check: func(t *testing.T, s *reportServer) {
+				if allowed, err := s.db.IsUserAllowed(strings.TrimPrefix(offenderDid, "did:")); err != nil || !allowed {
+					t.Errorf("got allowed %v, %v", allowed, err)
+				}
+				if s.moderator.reloads != 1 {
+					t.Errorf("allowed users reloaded %d times, expected once", s.moderator.reloads)
+				}
+				if dids := s.blockedDids(t); len(dids) != 0 || len(s.moderator.unblocked) != 1 {
+					t.Errorf("allowed user left blocked: %v, %v", dids, s.moderator.unblocked)
+				}
+			},
+		},
+		{
+			name:     "admin runs reviewer commands",
+			reporter: admin,
+			subject:  offenderDid,
+			reason:   "recheck",
+			status:   200,
+			check: func(t *testing.T, s *reportServer) {
+				if !slices.Equal(s.moderator.rechecked, []string{offenderDid}) {
+					t.Errorf("got rechecked %v", s.moderator.rechecked)
+				}
+			},
+		},
+		{
+			name:     "reviewer accepts open reports",
+			reporter: reviewer,
+			subject:  offenderDid,
+			reason:   "accept",
+			setup: func(t *testing.T, s *reportServer) {
+				if status, errStr := s.report(t, user, offenderPost, "spam"); status != 200 {
+					t.Fatalf("failed to queue report: %d %s", status, errStr)
+				}
+			},
+			status: 200,
+			check: func(t *testing.T, s *reportServer) {
+				if dids := s.blockedDids(t); !slices.Equal(dids, []string{offenderDid}) {
+					t.Errorf("got block list %v, expected the offender", dids)
+				}
+				statuses := s.reportStatuses(t, user)
+				if !slices.Equal(statuses, []database.ReportStatus{database.ReportAccepted}) {
+					t.Errorf("got reports %v, expected the queued report accepted", statuses)
+				}
+			},
+		},
+		{
+			name:     "reviewer may not accept without reports",
+			reporter: reviewer,
+			subject:  offenderDid,
+			reason:   "accept",
+			status:   500,
+			errStr:   "InternalError",
+			check: func(t *testing.T, s *reportServer) {
+				if dids := s.blockedDids(t); len(dids) != 0 {
+					t.Errorf("blocked %v", dids)
+				}
+				statuses := s.reportStatuses(t, reviewer)
+				if !slices.Equal(statuses, []database.ReportStatus{database.ReportFailed}) {
+					t.Errorf("got reports %v, expected the command failed", statuses)
+				}
+			},
+		},
+		{
+			name:     "reviewer rejects open reports",
+			reporter: reviewer,
+			subject:  offenderDid,
+			reason:   "reject",
+			setup: func(t *testing.T, s *reportServer) {
+				if status, errStr := s.report(t, user, offenderPost, "spam"); status != 200 {
+					t.Fatalf("failed to queue report: %d %s", status, errStr)
+				}
+			},
+			status: 200,
+			check: func(t *testing.T, s *reportServer) {
+				if dids := s.blockedDids(t); len(dids) != 0 {
+					t.Errorf("blocked %v", dids)
+				}
+				statuses := s.reportStatuses(t, user)
+				if !slices.Equal(statuses, []database.ReportStatus{database.ReportRejected}) {
+					t.Errorf("got reports %v, expected the queued report rejected", statuses)
+				}
+			},
+		},
+		{
+			name:     "commands of other users are queued as reports",
+			reporter: user,
+			subject:  offenderDid,
+			reason:   "block",
+			status:   200,
+			check: func(t *testing.T, s *reportServer) {
+				if dids := s.blockedDids(t); len(dids) != 0 {
+					t.Errorf("blocked %v", dids)
+				}
+				statuses := s.reportStatuses(t, user)
+				if !slices.Equal(statuses, []database.ReportStatus{database.ReportPending}) {
+					t.Errorf("got reports %v, expected the report queued", statuses)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newReportServer(t)
+			s.addUser(t, reviewer, database.RoleReviewer)
+			s.addUser(t, moderator, database.RoleModerator)
+			s.addUser(t, admin, database.RoleAdmin)
+			s.addUser(t, user, 0)
+			if test.setup != nil {
+				test.setup(t, s)
+			}
+			status, errStr := s.report(t, test.reporter, test.subject, test.reason)
+			if status != test.status || errStr != test.errStr {
+				t.Errorf("got %d %s, expected %d %s", status, errStr, test.status, test.errStr)
+			}
+			if test.check != nil {
+				test.check(t, s)
+			}
+		})
+	}
+}
+
+func TestReportRejectsForgedTokens(t *testing.T) {
+	s := newReportServer(t)
+	s.addUser(t, "did:plc:moderator", database.RoleModerator)
+	s.addUser(t, "did:plc:forger", 0)
+	// signed by the forger under the name of the moderator
+	s.keys["did:plc:moderator"] = s.keys["did:plc:forger"]
+
+	status, errStr := s.report(t, "did:plc:moderator", offenderDid, "block")
+	if status != 401 || errStr != "InvalidToken" {
+		t.Errorf("got %d %s, expected 401 InvalidToken", status, errStr)
+	}
+	if dids := s.blockedDids(t); len(dids) != 0 {
+		t.Errorf("blocked %v", dids)
+	}
+}
+
+func TestEscalationLeavesOutLabelerReports(t *testing.T) {
+	s := newReportServer(t)
+	threshold := config.ReportEscalationThreshold
+	t.Cleanup(func() {
+		config.ReportEscalationThreshold = threshold
+	})
+	config.ReportEscalationThreshold = 2
+	s.addUser(t, "did:plc:alice", 0)
+	s.addUser(t, "did:plc:bob", 0)
+
+	// queued for review by the follow graph
+	labeler, err := s.db.GetUserId(at_utils.UserDid.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	offender, err := s.db.GetUserId(offenderDid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.db.InsertReport(&database.Report{
+		Uid:      offender,
+		Subject:  offenderDid,
+		Reporter: labeler,
+		Cts:      time.Now().UnixMilli(),
+		Reason:   "graph rank 0.5",
+		Status:   database.ReportPending,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, errStr := s.report(t, "did:plc:alice", offenderPost, "spam"); status != 200 {
+		t.Fatalf("failed to queue report: %d %s", status, errStr)
+	}
+	statuses := s.reportStatuses(t, "did:plc:alice")
+	if !slices.Equal(statuses, []database.ReportStatus{database.ReportPending}) {
+		t.Errorf("got reports %v, expected a single reporter besides the labeler", statuses)
+	}
+
+	if status, errStr := s.report(t, "did:plc:bob", offenderDid, "spam"); status != 200 {
+		t.Fatalf("failed to queue report: %d %s", status, errStr)
+	}
+	for _, reporter := range []string{"did:plc:alice", "did:plc:bob"} {
+		statuses := s.reportStatuses(t, reporter)
+		if !slices.Equal(statuses, []database.ReportStatus{database.ReportEscalated}) {
+			t.Errorf("got reports %v of %s, expected them escalated", statuses, reporter)
+		}
+	}
+}
@@ -27,14 +27,27 @@ func (s *FiberServer) RegisterFiberRoutes() {
 	s.App.Get("/xrpc/com.atproto.label.subscribeLabels", websocket.New(s.SubscribeLabelsHandler))
 	s.App.Get("/xrpc/app.bsky.feed.describeFeedGenerator", s.DescribeFeedGeneratorHandler)
 	s.App.Get("/xrpc/app.bsky.feed.getFeedSkeleton", s.GetFeedSkeletonHandler)
-	s.App.Post("/xrpc/com.atproto.moderation.createReport", s.CreateReportHandler)
+	s.App.Post("/xrpc/"+createReportMethod, s.CreateReportHandler)
+	s.App.Get("/xrpc/"+listReportsMethod, s.ListReportsHandler)
+	s.App.Get("/xrpc/"+getReportMethod, s.GetReportHandler)
 	s.App.All("/xrpc/*", s.NotImplementedHandler)
+
+	admin := s.App.Group("/admin", s.AdminAuthMiddleware)
+	admin.Get("/moderators", s.ListModeratorsHandler)
+	admin.Put("/moderators/:id", s.SetModeratorHandler)
+	admin.Delete("/moderators/:id", s.RemoveModeratorHandler)
+	admin.Get("/actions", s.QueryActionsHandler)
+	admin.Get("/blocklist", s.BlockListHandler)
 }
 
 func (s *FiberServer) HomeHandler(c *fiber.Ctx) error {
+	upstreams := make([]string, len(config.Upstreams))
+	for i, upstream := range config.Upstreams {
+		upstreams[i] = upstream.Identifier
+	}
 	return c.Render("views/home", fiber.Map{
-		"Upstream": config.UpstreamUser,
-		"User":     config.Username,
+		"Upstreams": upstreams,
+		"User":      config.Username,
 	})
 }
 
@@ -50,9 +63,13 @@ func (s *FiberServer) HealthHandler(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(fiber.Map{
-		"version": at_utils.AtProtoVersion,
-		"latest":  id,
-		"stats":   &s.blocker.Stats,
+		"version":   at_utils.AtProtoVersion,
+		"latest":    id,
+		"stats":     &s.blocker.Stats,
+		"upstreams": s.upstream.Stats(),
+		"modlists":  s.blocker.ModLists().Stats(),
+		"curators":  s.blocker.Curators().Stats(),
+		"graph":     s.blocker.Graph().Stats(),
 	})
 }
 
@@ -21,7 +21,36 @@ type FiberServer struct {
 	db  *database.Service
 	log *slog.Logger
 
-	blocker *listener.JetstreamListener
+	upstream  *listener.LabelListener
+	emitter   *listener.LabelEmitter
+	blocker   *listener.JetstreamListener
+	blockList *listener.BlockListInSync
+	moderator accountModerator
+}
+
+// accountModerator applies the decisions of moderators on accounts to the listeners
+type accountModerator interface {
+	UnblockAccount(did string) error
+	RecheckAccount(did string) error
+	ReloadAllowed() error
+}
+
+// listenerModerator is the accountModerator of the label and jetstream listeners
+type listenerModerator struct {
+	upstream *listener.LabelListener
+	blocker  *listener.JetstreamListener
+}
+
+func (m listenerModerator) UnblockAccount(did string) error {
+	return m.upstream.UnblockAccount(did)
+}
+
+func (m listenerModerator) RecheckAccount(did string) error {
+	return m.upstream.RecheckAccount(did)
+}
+
+func (m listenerModerator) ReloadAllowed() error {
+	return m.blocker.ReloadAllowed()
 }
 
 //go:embed views/*
@@ -39,7 +68,11 @@ func New(upstream *listener.LabelListener, source *listener.JetstreamListener, l
 		db:  database.Instance(),
 		log: logger,
 
-		blocker: source,
+		upstream:  upstream,
+		emitter:   upstream.Emitter(),
+		blocker:   source,
+		blockList: source.BlockList(),
+		moderator: listenerModerator{upstream: upstream, blocker: source},
 	}
 
 	return server
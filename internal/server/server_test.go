@@ -0,0 +1,34 @@
+package server
+
+import (
+	"bluesky-oneshot-labeler/internal/database"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestServer opens a fresh database in a temporary directory for a server
+// with none of the listeners, which tests fill in as needed
+func newTestServer(t *testing.T) *FiberServer {
+	t.Helper()
+	if err := database.OpenDatabase(discardLogger(), filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := database.Close(); err != nil {
+			t.Errorf("failed to close database: %v", err)
+		}
+	})
+	return &FiberServer{
+		App: fiber.New(),
+		db:  database.Instance(),
+		log: discardLogger(),
+	}
+}